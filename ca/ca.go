@@ -0,0 +1,385 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+const (
+	CertTypeCA     = "ca"
+	CertTypeServer = "server"
+	CertTypeClient = "client"
+)
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+	indexFile  = "index.json"
+	crlFile    = "crl.pem"
+
+	crlValidity = 30 * 24 * time.Hour
+)
+
+var (
+	NotInitialized = errors.New("ca is not initialized, run init-ca first")
+	NotFound       = errors.New("certificate not found")
+)
+
+// Record of one certificate issued by ca
+type Record struct {
+	Serial    string     `json:"serial"` // hex
+	Name      string     `json:"name"`   // file name without extension
+	Type      string     `json:"type"`
+	CN        string     `json:"cn"`
+	DNSNames  []string   `json:"dnsNames,omitempty"`
+	IPs       []string   `json:"ips,omitempty"`
+	NotBefore time.Time  `json:"notBefore"`
+	NotAfter  time.Time  `json:"notAfter"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Index of issued certificates saved in ca dir
+type Index struct {
+	CRLNumber int64     `json:"crlNumber"`
+	Records   []*Record `json:"records"`
+}
+
+// Authority a certificate authority stored in a directory
+type Authority struct {
+	dir   string
+	cert  *x509.Certificate
+	key   crypto.Signer
+	index *Index
+}
+
+// Request of issuing a certificate
+type Request struct {
+	Name     string // file name, default is CN
+	CN       string
+	DNSNames []string // SAN of server default to CN if neither DNSNames nor IPs is set
+	IPs      []net.IP
+	KeyType  string
+	Validity time.Duration
+}
+
+// Init create a new ca in dir, existing ca is not overwritten
+func Init(dir, cn, keyType string, validity time.Duration) (a *Authority, err error) {
+	if validity <= 0 {
+		return nil, errors.New("validity must be positive")
+	}
+	if _, err = os.Stat(filepath.Join(dir, caKeyFile)); err == nil {
+		return nil, fmt.Errorf("ca already exists in %v", dir)
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+
+	key, err := newKey(keyType)
+	if err != nil {
+		return
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return
+	}
+
+	a = &Authority{dir: dir, cert: cert, key: key, index: &Index{}}
+	if err = writeKeyPair(dir, "ca", der, key); err != nil {
+		return nil, err
+	}
+	a.index.Records = append(a.index.Records, newRecord(CertTypeCA, "ca", cert))
+	if err = a.save(); err != nil {
+		return nil, err
+	}
+	// an empty crl, so server can load it before anything is revoked
+	if err = a.WriteCRL(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Load ca from dir
+func Load(dir string) (a *Authority, err error) {
+	certPem, err := os.ReadFile(filepath.Join(dir, caCertFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, NotInitialized
+	}
+	if err != nil {
+		return
+	}
+	keyPem, err := os.ReadFile(filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return
+	}
+
+	a = &Authority{dir: dir, index: &Index{}}
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		return nil, fmt.Errorf("parse %v error", caCertFile)
+	}
+	if a.cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+		return
+	}
+	if block, _ = pem.Decode(keyPem); block == nil {
+		return nil, fmt.Errorf("parse %v error", caKeyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return
+	}
+	var ok bool
+	if a.key, ok = key.(crypto.Signer); !ok {
+		return nil, fmt.Errorf("unsupported ca key %T", key)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, a.index); err != nil {
+			return nil, fmt.Errorf("parse %v error: %w", indexFile, err)
+		}
+	}
+	return a, nil
+}
+
+// Issue sign a new server or client certificate, key and certificate are written to dir
+func (a *Authority) Issue(certType string, req Request) (r *Record, err error) {
+	if req.CN == "" {
+		return nil, errors.New("common name is required")
+	}
+	if req.Name == "" {
+		req.Name = req.CN
+	}
+	if strings.ContainsAny(req.Name, `/\`) || req.Name == "ca" || req.Name == "crl" {
+		return nil, fmt.Errorf("invalid name %q", req.Name)
+	}
+	if a.find(req.Name) != nil {
+		return nil, fmt.Errorf("certificate %v already exists, revoke it or use another name", req.Name)
+	}
+	if req.Validity <= 0 {
+		return nil, errors.New("validity must be positive")
+	}
+	// server is verified by SAN, CN is used if none is given
+	if certType == CertTypeServer && len(req.DNSNames) == 0 && len(req.IPs) == 0 {
+		if ip := net.ParseIP(req.CN); ip != nil {
+			req.IPs = []net.IP{ip}
+		} else {
+			req.DNSNames = []string{req.CN}
+		}
+	}
+
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: req.CN},
+		NotBefore:   time.Now().Add(-time.Minute),
+		NotAfter:    time.Now().Add(req.Validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		DNSNames:    req.DNSNames,
+		IPAddresses: req.IPs,
+	}
+	switch certType {
+	case CertTypeServer:
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	case CertTypeClient:
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	default:
+		return nil, fmt.Errorf("unknown certificate type %v", certType)
+	}
+	if tmpl.NotAfter.After(a.cert.NotAfter) {
+		tmpl.NotAfter = a.cert.NotAfter
+	}
+
+	key, err := newKey(req.KeyType)
+	if err != nil {
+		return
+	}
+	if tmpl.SerialNumber, err = newSerial(); err != nil {
+		return
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, key.Public(), a.key)
+	if err != nil {
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return
+	}
+
+	if err = writeKeyPair(a.dir, req.Name, der, key); err != nil {
+		return
+	}
+	r = newRecord(certType, req.Name, cert)
+	a.index.Records = append(a.index.Records, r)
+	return r, a.save()
+}
+
+// Revoke certificate by name or serial, crl is regenerated
+func (a *Authority) Revoke(nameOrSerial string) (r *Record, err error) {
+	if r = a.find(nameOrSerial); r == nil || r.Type == CertTypeCA {
+		return nil, NotFound
+	}
+	if r.RevokedAt != nil {
+		return r, fmt.Errorf("certificate %v is already revoked", r.Name)
+	}
+	now := time.Now()
+	r.RevokedAt = &now
+
+	if err = a.save(); err != nil {
+		return
+	}
+	return r, a.WriteCRL()
+}
+
+// List all records in index
+func (a *Authority) List() []*Record {
+	return a.index.Records
+}
+
+// WriteCRL sign a crl of all revoked certificates
+func (a *Authority) WriteCRL() (err error) {
+	a.index.CRLNumber++
+	list := &x509.RevocationList{
+		Number:     big.NewInt(a.index.CRLNumber),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(crlValidity),
+	}
+	for _, r := range a.index.Records {
+		if r.RevokedAt == nil {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(r.Serial, 16)
+		if !ok {
+			return fmt.Errorf("serial %v format error", r.Serial)
+		}
+		list.RevokedCertificateEntries = append(list.RevokedCertificateEntries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: *r.RevokedAt})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, list, a.cert, a.key)
+	if err != nil {
+		return
+	}
+	if err = a.save(); err != nil {
+		return
+	}
+	return writeFile(filepath.Join(a.dir, crlFile), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+}
+
+// CRLFile return path of crl
+func (a *Authority) CRLFile() string {
+	return filepath.Join(a.dir, crlFile)
+}
+
+// find the valid record of name, or the record of serial, a revoked name can be issued again
+func (a *Authority) find(nameOrSerial string) *Record {
+	for _, r := range a.index.Records {
+		if r.Name == nameOrSerial && r.RevokedAt == nil {
+			return r
+		}
+	}
+	for _, r := range a.index.Records {
+		if strings.EqualFold(r.Serial, nameOrSerial) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (a *Authority) save() (err error) {
+	data, err := json.MarshalIndent(a.index, "", "  ")
+	if err != nil {
+		return
+	}
+	return writeFile(filepath.Join(a.dir, indexFile), data, 0644)
+}
+
+func newRecord(certType, name string, cert *x509.Certificate) *Record {
+	r := &Record{
+		Serial:    fmt.Sprintf("%x", cert.SerialNumber),
+		Name:      name,
+		Type:      certType,
+		CN:        cert.Subject.CommonName,
+		DNSNames:  cert.DNSNames,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	}
+	for _, ip := range cert.IPAddresses {
+		r.IPs = append(r.IPs, ip.String())
+	}
+	return r
+}
+
+func newKey(keyType string) (key crypto.Signer, err error) {
+	switch strings.ToLower(keyType) {
+	case "", KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+		return
+	}
+	return nil, fmt.Errorf("unsupported key type %v, use %v or %v", keyType, KeyTypeECDSA, KeyTypeEd25519)
+}
+
+// newSerial random 128 bits serial number
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// writeKeyPair write name.crt and name.key in dir
+func writeKeyPair(dir, name string, der []byte, key crypto.Signer) (err error) {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return
+	}
+	if err = writeFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return
+	}
+	return writeFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// writeFile write to a temp file then rename, so reader never see a partial file
+func writeFile(file string, data []byte, perm os.FileMode) (err error) {
+	tmp := file + ".tmp"
+	if err = os.WriteFile(tmp, data, perm); err != nil {
+		return
+	}
+	return os.Rename(tmp, file)
+}
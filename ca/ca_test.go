@@ -0,0 +1,142 @@
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func loadCert(t *testing.T, file string) *x509.Certificate {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("no pem in %v", file)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestAuthority(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Init(dir, "through", KeyTypeECDSA, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Init(dir, "through", KeyTypeECDSA, 24*time.Hour); err == nil {
+		t.Error("Init() want error when ca exists")
+	}
+
+	a, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := a.Issue(CertTypeServer, Request{CN: "server", DNSNames: []string{"localhost"}, IPs: []net.IP{net.IPv4(127, 0, 0, 1)}, Validity: 365 * 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Issue(CertTypeClient, Request{Name: "laptop", CN: "alice", KeyType: KeyTypeEd25519, Validity: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Issue(CertTypeClient, Request{Name: "laptop", CN: "alice", Validity: time.Hour}); err == nil {
+		t.Error("Issue() want error for existing name")
+	}
+	if _, err = a.Issue(CertTypeClient, Request{Name: "x", CN: "x", KeyType: "rsa", Validity: time.Hour}); err == nil {
+		t.Error("Issue() want error for unsupported key type")
+	}
+
+	// issued certificates are verified by ca, validity is capped by ca
+	roots := x509.NewCertPool()
+	roots.AddCert(loadCert(t, filepath.Join(dir, "ca.crt")))
+	serverCert := loadCert(t, filepath.Join(dir, "server.crt"))
+	if _, err = serverCert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "127.0.0.1"}); err != nil {
+		t.Errorf("verify server certificate error: %v", err)
+	}
+	if !serverCert.NotAfter.Equal(a.cert.NotAfter) {
+		t.Errorf("server not after = %v, want capped to %v", serverCert.NotAfter, a.cert.NotAfter)
+	}
+	clientCert := loadCert(t, filepath.Join(dir, "laptop.crt"))
+	if _, err = clientCert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("verify client certificate error: %v", err)
+	}
+	// SAN of server default to CN
+	if _, err = a.Issue(CertTypeServer, Request{CN: "proxy.example.com", Validity: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadCert(t, filepath.Join(dir, "proxy.example.com.crt")).Verify(x509.VerifyOptions{Roots: roots, DNSName: "proxy.example.com"}); err != nil {
+		t.Errorf("verify server certificate by CN error: %v", err)
+	}
+	if _, err = a.Issue(CertTypeServer, Request{CN: "10.0.0.1", Validity: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadCert(t, filepath.Join(dir, "10.0.0.1.crt")).Verify(x509.VerifyOptions{Roots: roots, DNSName: "10.0.0.1"}); err != nil {
+		t.Errorf("verify server certificate by ip CN error: %v", err)
+	}
+	if _, err = a.Issue(CertTypeServer, Request{CN: "expired", Validity: -time.Hour}); err == nil {
+		t.Error("Issue() want error for non-positive validity")
+	}
+	if _, err = Init(t.TempDir(), "through", KeyTypeECDSA, 0); err == nil {
+		t.Error("Init() want error for non-positive validity")
+	}
+
+	if info, err := os.Stat(filepath.Join(dir, "laptop.key")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, %v", info.Mode(), err)
+	}
+
+	// revoke by name then the name can be issued again
+	revoked, err := a.Revoke("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Revoke(revoked.Serial); err == nil {
+		t.Error("Revoke() want error when already revoked")
+	}
+	if _, err = a.Revoke("nobody"); err != NotFound {
+		t.Errorf("Revoke() error = %v, want %v", err, NotFound)
+	}
+	if _, err = a.Issue(CertTypeClient, Request{Name: "laptop", CN: "alice", Validity: time.Hour}); err != nil {
+		t.Errorf("Issue() after revoke error: %v", err)
+	}
+
+	data, err := os.ReadFile(a.CRLFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = crl.CheckSignatureFrom(a.cert); err != nil {
+		t.Errorf("crl signature error: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(clientCert.SerialNumber) != 0 {
+		t.Errorf("crl revoked = %v, want %x", crl.RevokedCertificateEntries, clientCert.SerialNumber)
+	}
+
+	// index survive reload
+	a, err = Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(a.List()); n != 6 {
+		t.Errorf("List() = %d records, want 6", n)
+	}
+	if a.find(server.Serial) == nil {
+		t.Error("find() by serial = nil")
+	}
+}
+
+func TestLoad_NotInitialized(t *testing.T) {
+	if _, err := Load(t.TempDir()); err != NotInitialized {
+		t.Errorf("Load() error = %v, want %v", err, NotInitialized)
+	}
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// AdminHandler http api to inspect servers and groups, and choose the member of select groups.
+//
+//	GET /servers        health and active tunnels of servers
+//	GET /groups         groups and their members in use
+//	PUT /groups/{name}  {"server": "member"} select member of select group
+type AdminHandler struct {
+	forwards *ForwardManger
+}
+
+// ServerInfo state of a server
+type ServerInfo struct {
+	Name   string      `json:"name"`
+	Net    string      `json:"net"`
+	Addr   string      `json:"addr"`
+	Active int64       `json:"active"`
+	Health HealthStats `json:"health"`
+}
+
+// GroupInfo state of a group
+type GroupInfo struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Strategy string   `json:"strategy,omitempty"`
+	Current  string   `json:"current,omitempty"` // member in use, empty for load-balance
+	Servers  []string `json:"servers"`
+}
+
+// selectRequest body of PUT /groups/{name}
+type selectRequest struct {
+	Server string `json:"server"`
+}
+
+func NewAdminHandler(forwards *ForwardManger) *AdminHandler {
+	return &AdminHandler{forwards: forwards}
+}
+
+func (a *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/servers" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, a.servers())
+	case path == "/groups" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, a.groups())
+	case strings.HasPrefix(path, "/groups/") && r.Method == http.MethodPut:
+		a.selectServer(w, r, strings.TrimPrefix(path, "/groups/"))
+	case path == "/servers" || path == "/groups" || strings.HasPrefix(path, "/groups/"):
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *AdminHandler) servers() (infos []ServerInfo) {
+	infos = []ServerInfo{}
+	for name, forward := range *a.forwards.forwardClients.Load() {
+		if fc, ok := forward.(*ForwardClient); ok {
+			infos = append(infos, ServerInfo{Name: name, Net: fc.net, Addr: fc.addr, Active: fc.Active(), Health: fc.Health()})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return
+}
+
+func (a *AdminHandler) groups() (infos []GroupInfo) {
+	infos = []GroupInfo{}
+	for _, forward := range *a.forwards.forwardClients.Load() {
+		if g, ok := forward.(*ProxyGroup); ok {
+			infos = append(infos, g.Info())
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return
+}
+
+func (a *AdminHandler) selectServer(w http.ResponseWriter, r *http.Request, name string) {
+	forward, _ := a.forwards.GetForward(name)
+	g, ok := forward.(*ProxyGroup)
+	if !ok {
+		http.Error(w, "group "+name+" not found", http.StatusNotFound)
+		return
+	}
+	var req selectRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := g.Select(req.Server); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, g.Info())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
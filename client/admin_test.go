@@ -0,0 +1,77 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"through/config"
+)
+
+func TestAdminHandler(t *testing.T) {
+	forwards := &ForwardManger{}
+	members := map[string]Forward{
+		"direct": &DirectClient{},
+		"reject": &RejectClient{},
+		"a":      &ForwardClient{net: "tcp", addr: "127.0.0.1:1", pool: &ConnectionPool{}},
+	}
+	g, err := NewProxyGroup(config.ProxyGroup{Name: "sel", Type: GroupTypeSelect, Servers: []string{"direct", "reject"}}, forwards.GetForward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members["sel"] = g
+	forwards.forwardClients.Store(&members)
+	ts := httptest.NewServer(NewAdminHandler(forwards))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/servers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var servers []ServerInfo
+	err = json.NewDecoder(resp.Body).Decode(&servers)
+	_ = resp.Body.Close()
+	if err != nil || len(servers) != 1 || servers[0].Name != "a" || servers[0].Health.State != HealthHealthy {
+		t.Errorf("GET /servers = %+v, %v", servers, err)
+	}
+
+	put := func(path, body string) int {
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := put("/groups/sel", `{"server": "reject"}`); code != http.StatusOK || g.Current() != "reject" {
+		t.Errorf("PUT /groups/sel = %v, current %v", code, g.Current())
+	}
+	if code := put("/groups/sel", `{"server": "a"}`); code != http.StatusBadRequest {
+		t.Errorf("PUT /groups/sel with non member = %v, want 400", code)
+	}
+	if code := put("/groups/none", `{"server": "a"}`); code != http.StatusNotFound {
+		t.Errorf("PUT /groups/none = %v, want 404", code)
+	}
+
+	resp, err = http.Get(ts.URL + "/groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var groups []GroupInfo
+	err = json.NewDecoder(resp.Body).Decode(&groups)
+	_ = resp.Body.Close()
+	if err != nil || len(groups) != 1 || groups[0].Current != "reject" {
+		t.Errorf("GET /groups = %+v, %v", groups, err)
+	}
+
+	resp, err = http.Post(ts.URL+"/servers", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /servers = %v, want 405", resp.StatusCode)
+	}
+}
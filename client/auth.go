@@ -0,0 +1,224 @@
+package client
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"through/config"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UserStore verify username and password of proxy users
+type UserStore interface {
+	Authenticate(username, password string) bool
+}
+
+// PasswordStore user store which know the plain password, required by digest auth
+type PasswordStore interface {
+	UserStore
+	Password(username string) (password string, ok bool)
+}
+
+// NewUserStore build user store from config users and user file, return nil if auth is disabled
+func NewUserStore(users []config.User, userFile string) (s UserStore, err error) {
+	stores := MultiUserStore{}
+	if len(users) > 0 {
+		stores = append(stores, NewStaticUserStore(users))
+	}
+	if userFile != "" {
+		var hs *HtpasswdUserStore
+		if hs, err = NewHtpasswdUserStore(userFile); err != nil {
+			return
+		}
+		stores = append(stores, hs)
+	}
+
+	switch len(stores) {
+	case 0:
+		return nil, nil
+	case 1:
+		return stores[0], nil
+	}
+	return stores, nil
+}
+
+// MultiUserStore authenticate user with each store in order
+type MultiUserStore []UserStore
+
+func (m MultiUserStore) Authenticate(username, password string) bool {
+	for _, s := range m {
+		if s.Authenticate(username, password) {
+			return true
+		}
+	}
+	return false
+}
+
+// Password return the plain password from the first store which know it
+func (m MultiUserStore) Password(username string) (password string, ok bool) {
+	for _, s := range m {
+		if ps, is := s.(PasswordStore); is {
+			if password, ok = ps.Password(username); ok {
+				return
+			}
+		}
+	}
+	return
+}
+
+// StaticUserStore users with plain password from config
+type StaticUserStore struct {
+	users map[string]string
+}
+
+func NewStaticUserStore(users []config.User) (s *StaticUserStore) {
+	s = &StaticUserStore{users: make(map[string]string, len(users))}
+	for _, u := range users {
+		s.users[u.Username] = u.Password
+	}
+	return
+}
+
+func (s *StaticUserStore) Authenticate(username, password string) bool {
+	pwd, ok := s.users[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(pwd), []byte(password)) == 1
+}
+
+// Password return the plain password of user
+func (s *StaticUserStore) Password(username string) (password string, ok bool) {
+	password, ok = s.users[username]
+	return
+}
+
+// HtpasswdUserStore users from htpasswd-style file, one "user:hash" per line,
+// support bcrypt, apr1, {SHA} and plain text hash
+type HtpasswdUserStore struct {
+	users map[string]string
+}
+
+func NewHtpasswdUserStore(file string) (s *HtpasswdUserStore, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	s = &HtpasswdUserStore{users: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, fmt.Errorf("user file %v line %d format error", file, line)
+		}
+		s.users[user] = hash
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (s *HtpasswdUserStore) Authenticate(username, password string) bool {
+	hash, ok := s.users[username]
+	if !ok {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, apr1Magic):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, apr1Magic), "$")
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte("{SHA}"+base64.StdEncoding.EncodeToString(sum[:])), []byte(hash)) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+}
+
+const (
+	apr1Magic = "$apr1$"
+	apr1Chars = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// apr1 apache variant of md5 crypt
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pwd := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pwd)
+	alt.Write([]byte(salt))
+	alt.Write(pwd)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pwd)
+	ctx.Write([]byte(apr1Magic + salt))
+	for i := len(pwd); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:i])
+		}
+	}
+	for i := len(pwd); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pwd[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pwd)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pwd)
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write(pwd)
+		}
+		final = round.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, apr1Chars[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+
+	return apr1Magic + salt + "$" + string(out)
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"through/config"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswdUserStore_Authenticate(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pwd"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "# comment\n" +
+		"bcrypt:" + string(bcryptHash) + "\n" +
+		"apr1:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n" +
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n" +
+		"plain:plain-pwd\n"
+	file := filepath.Join(t.TempDir(), "users.htpasswd")
+	if err = os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewHtpasswdUserStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     bool
+	}{
+		{"bcrypt", "bcrypt", "bcrypt-pwd", true},
+		{"bcrypt wrong", "bcrypt", "wrong", false},
+		{"apr1", "apr1", "secret", true},
+		{"apr1 wrong", "apr1", "wrong", false},
+		{"sha", "sha", "secret", true},
+		{"sha wrong", "sha", "wrong", false},
+		{"plain", "plain", "plain-pwd", true},
+		{"unknown user", "nobody", "secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.Authenticate(tt.username, tt.password); got != tt.want {
+				t.Errorf("Authenticate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewUserStore(t *testing.T) {
+	s, err := NewUserStore(nil, "")
+	if err != nil || s != nil {
+		t.Fatalf("NewUserStore() = %v, %v, want nil store", s, err)
+	}
+
+	s, err = NewUserStore([]config.User{{Username: "alice", Password: "alice-pwd"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Authenticate("alice", "alice-pwd") || s.Authenticate("alice", "wrong") {
+		t.Errorf("static user store authenticate failed")
+	}
+}
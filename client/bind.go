@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"net"
+	"through/log"
+	"through/proto"
+	"through/util"
+	"time"
+)
+
+// bindTimeout limit the time waiting for peer, the same as server
+const bindTimeout = 2 * time.Minute
+
+// Binding wait for one inbound connection of socks BIND, address is in host:port format
+type Binding interface {
+	Addr() string
+	Accept() (conn net.Conn, peer string, err error)
+	Close() error
+}
+
+// directBinding listen at local, only the expected peer is accepted like server
+type directBinding struct {
+	lis     *net.TCPListener
+	addr    string
+	allowed map[string]bool // ips of expected peer, nil accept any peer
+}
+
+// newDirectBinding listen for peer at target, unspecified target like 0.0.0.0:0 accept any peer.
+// ip of address is unspecified if the route to target is unknown
+func newDirectBinding(target string) (b *directBinding, err error) {
+	b = &directBinding{}
+	route := target
+	if !util.AnyPeer(target) {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), directDialTimeout)
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		b.allowed = map[string]bool{}
+		for _, ip := range ips {
+			b.allowed[ip.IP.String()] = true
+		}
+		route = net.JoinHostPort(ips[0].IP.String(), port)
+	}
+
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return
+	}
+	b.lis, b.addr = lis.(*net.TCPListener), lis.Addr().String()
+
+	// report the local ip which route to target, no packet is sent by udp dial
+	if c, err := net.Dial("udp", route); err == nil {
+		host, _, _ := net.SplitHostPort(c.LocalAddr().String())
+		_, port, _ := net.SplitHostPort(b.addr)
+		b.addr = net.JoinHostPort(host, port)
+		_ = c.Close()
+	}
+	return b, nil
+}
+
+func (d *directBinding) Addr() string {
+	return d.addr
+}
+
+func (d *directBinding) Accept() (conn net.Conn, peer string, err error) {
+	conn, err = util.AcceptPeer(d.lis, d.allowed, bindTimeout, func(addr net.Addr) {
+		log.Warnf("bind refuse unexpected peer %v", addr)
+	})
+	if err != nil {
+		return
+	}
+	return conn, conn.RemoteAddr().String(), nil
+}
+
+func (d *directBinding) Close() error {
+	return d.lis.Close()
+}
+
+// tunnelBinding listen at server, the tunnel connection is spliced with the inbound connection
+type tunnelBinding struct {
+	conn     net.Conn
+	addr     string
+	accepted bool
+}
+
+func newTunnelBinding(conn *tunnelConn) (b *tunnelBinding) {
+	return &tunnelBinding{conn: conn, addr: conn.BoundAddr()}
+}
+
+func (t *tunnelBinding) Addr() string {
+	return t.addr
+}
+
+func (t *tunnelBinding) Accept() (conn net.Conn, peer string, err error) {
+	resp, err := proto.ReadResponse(t.conn)
+	if err != nil {
+		return
+	}
+	if err = resp.Err(); err != nil {
+		return
+	}
+	t.accepted = true
+	return t.conn, resp.GetBoundAddress(), nil
+}
+
+// Close the tunnel if nothing accepted, otherwise it is closed by who accepted it
+func (t *tunnelBinding) Close() error {
+	if t.accepted {
+		return nil
+	}
+	return t.conn.Close()
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"through/config"
+	"through/proto"
+	"time"
+)
+
+// dialPeer connect bound address like the peer of BIND, and echo data
+func dialPeer(t *testing.T, bound string) net.Conn {
+	_, port, err := net.SplitHostPort(bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = peer.Close() })
+	go func() { _, _ = io.Copy(peer, peer) }()
+	return peer
+}
+
+func TestSocksProxy_BindDirect(t *testing.T) {
+	proxy := newTestSocksProxy(t, []string{
+		"ip-cidr: 127.0.0.0/8, direct",
+		"ip-cidr: 0.0.0.0/32, direct",
+		"match-all, reject",
+	}, nil)
+
+	conn := dialSocks(t, proxy)
+	handshake(t, conn)
+	sendRequest(t, conn, SocksCmdBind, SocksIPv4Host, net.IPv4(127, 0, 0, 1).To4(), 0)
+	rep, bound := readReply(t, conn)
+	if rep != StatusSuccess {
+		t.Fatalf("first rep = %v, want %v", rep, StatusSuccess)
+	}
+	peer := dialPeer(t, bound)
+	rep, from := readReply(t, conn)
+	if rep != StatusSuccess || from != peer.LocalAddr().String() {
+		t.Fatalf("second rep = %v from %v, want success from %v", rep, from, peer.LocalAddr())
+	}
+	assertEcho(t, conn)
+
+	// only the expected peer is accepted
+	conn = dialSocks(t, proxy)
+	handshake(t, conn)
+	sendRequest(t, conn, SocksCmdBind, SocksIPv4Host, net.IPv4(127, 0, 0, 2).To4(), 0)
+	if rep, bound = readReply(t, conn); rep != StatusSuccess {
+		t.Fatalf("first rep = %v, want %v", rep, StatusSuccess)
+	}
+	other := dialPeer(t, bound)
+	_ = other.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := other.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("unexpected peer read error = %v, want EOF", err)
+	}
+	_, port, _ := net.SplitHostPort(bound)
+	dialer := &net.Dialer{Timeout: time.Second, LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	if peer, err := dialer.Dial("tcp", net.JoinHostPort("127.0.0.1", port)); err == nil {
+		defer peer.Close()
+		if rep, from = readReply(t, conn); rep != StatusSuccess || from != peer.LocalAddr().String() {
+			t.Errorf("second rep = %v from %v, want success from %v", rep, from, peer.LocalAddr())
+		}
+	}
+
+	// client gone cancel the bind
+	conn = dialSocks(t, proxy)
+	handshake(t, conn)
+	sendRequest(t, conn, SocksCmdBind, SocksIPv4Host, net.IPv4zero.To4(), 0)
+	if rep, bound = readReply(t, conn); rep != StatusSuccess {
+		t.Fatalf("first rep = %v, want %v", rep, StatusSuccess)
+	}
+	_ = conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	_, port, _ = net.SplitHostPort(bound)
+	if peer, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), time.Second); err == nil {
+		_ = peer.Close()
+		t.Error("listener is not closed after client gone")
+	}
+
+	// failures are replied with their status
+	conn = dialSocks(t, proxy)
+	handshake(t, conn)
+	sendRequest(t, conn, SocksCmdBind, SocksIPv4Host, net.IPv4(192, 0, 2, 1).To4(), 21)
+	if rep, _ = readReply(t, conn); rep != StatusConnectNotAllow {
+		t.Errorf("rep of rejected host = %v, want %v", rep, StatusConnectNotAllow)
+	}
+}
+
+func TestBindAddr(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	local := &addrConn{Conn: server, local: &net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1080}}
+	if got := bindAddr("[::]:4000", local); got != "192.168.1.2:4000" {
+		t.Errorf("bindAddr() = %v, want local ip", got)
+	}
+	if got := bindAddr("10.0.0.1:4000", local); got != "10.0.0.1:4000" {
+		t.Errorf("bindAddr() = %v, want unchanged", got)
+	}
+}
+
+// addrConn conn with a fixed local address
+type addrConn struct {
+	net.Conn
+	local net.Addr
+}
+
+func (a *addrConn) LocalAddr() net.Addr {
+	return a.local
+}
+
+func TestForwardClient_BindTunnel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f, err := NewForwardClient(ctx, config.ProxyServer{Name: "bind", Net: "tcp", Addr: serveThrough(t, ctx, config.AclCfg{AllowPrivate: true}), Insecure: true}, nil, nil, &tls.Config{}, "", 1, config.MuxCfg{Enable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	binding, err := f.Bind(&proto.Meta{Net: proto.NetBind, Address: "0.0.0.0:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer binding.Close()
+	peer := dialPeer(t, binding.Addr())
+	conn, from, err := binding.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if from != peer.LocalAddr().String() {
+		t.Errorf("peer = %v, want %v", from, peer.LocalAddr())
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	assertEcho(t, conn)
+}
+
+func TestSocksProxy_BindTunnelDenied(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f, err := NewForwardClient(ctx, config.ProxyServer{Name: "bind", Net: "tcp", Addr: serveThrough(t, ctx, config.AclCfg{}), Insecure: true}, nil, nil, &tls.Config{}, "", 1, config.MuxCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	proxy := NewSocksProxy(ctx, &ForwardManger{}, nil, nil)
+	proxy.forwardManager.forwardClients.Store(&map[string]Forward{"bind": f})
+	resolvers, err := NewResolverManger(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy.ruleManager, err = NewRuleManager(resolvers, []string{"match-all, forward: bind"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server deny private peer, it's replied as not allowed
+	client, server := net.Pipe()
+	defer client.Close()
+	go proxy.bind(server, &proto.Meta{Net: proto.NetBind, Address: "10.0.0.1:21"}, "")
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	if rep, _ := readReply(t, client); rep != StatusConnectNotAllow {
+		t.Errorf("rep = %v, want %v", rep, StatusConnectNotAllow)
+	}
+}
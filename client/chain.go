@@ -0,0 +1,129 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"through/config"
+	"through/proto"
+	"time"
+)
+
+// hop a server the tunnel to next server pass through
+type hop struct {
+	name   string
+	net    string
+	addr   string
+	tlsCfg *tls.Config
+}
+
+// chainOf return config of servers in chain of c, they must be servers without chain
+func chainOf(c config.ProxyServer, servers []config.ProxyServer) (hops []config.ProxyServer, err error) {
+	byName := map[string]config.ProxyServer{}
+	for _, s := range servers {
+		byName[s.Name] = s
+	}
+	seen := map[string]bool{c.Name: true}
+	for _, name := range c.Chain {
+		h, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown server %q in chain", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("server %q is used twice in chain", name)
+		}
+		if len(h.Chain) > 0 {
+			return nil, fmt.Errorf("server %q in chain has its own chain", name)
+		}
+		if isUpstream(h.Net) {
+			return nil, fmt.Errorf("server %q in chain is an %v proxy, use it as proxy of the first server", name, h.Net)
+		}
+		seen[name] = true
+		hops = append(hops, h)
+	}
+	return
+}
+
+// proxyOf return config of the http or socks5 proxy the first server connected through, nil if none.
+// a chained server is connected through the proxy of its first hop
+func proxyOf(c config.ProxyServer, hops []config.ProxyServer, servers []config.ProxyServer) (*config.ProxyServer, error) {
+	if len(hops) > 0 {
+		if c.Proxy != "" {
+			return nil, errors.New("proxy of chained server should be set on the first server of chain")
+		}
+		c = hops[0]
+	}
+	if c.Proxy == "" {
+		return nil, nil
+	}
+	if c.Net != "tcp" {
+		return nil, fmt.Errorf("server %q is %v, only tcp server can connect through proxy", c.Name, c.Net)
+	}
+	for _, s := range servers {
+		if s.Name == c.Proxy {
+			if !isUpstream(s.Net) {
+				return nil, fmt.Errorf("proxy %q is not an http or socks5 proxy", c.Proxy)
+			}
+			return &s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown proxy %q", c.Proxy)
+}
+
+// chainProducer connect server at addr through hops, the tls session with every server
+// is tunneled inside the one with the server before it. the first hop is connected through proxy if it's set
+func chainProducer(hops []hop, network string, proxy *upstream) Producer {
+	return func(addr string, tlsCfg *tls.Config) (conn net.Conn, err error) {
+		first := dialProducer(hops[0].net, proxy)
+		if first == nil {
+			return nil, fmt.Errorf("unsupported network %v", hops[0].net)
+		}
+		if conn, err = first(hops[0].addr, hops[0].tlsCfg); err != nil {
+			return nil, fmt.Errorf("hop %v: %w", hops[0].name, err)
+		}
+
+		for i, h := range hops {
+			next := hop{net: network, addr: addr, tlsCfg: tlsCfg}
+			if i+1 < len(hops) {
+				next = hops[i+1]
+			}
+			if err = openHop(conn, next); err != nil {
+				_ = conn.Close()
+				return nil, fmt.Errorf("hop %v: %w", h.name, err)
+			}
+			conn = tls.Client(conn, next.tlsCfg)
+		}
+		return
+	}
+}
+
+// openHop ask the hop server on conn to dial next server, then conn carry the raw stream to next
+func openHop(conn net.Conn, next hop) (err error) {
+	_ = conn.SetDeadline(time.Now().Add(helloTimeout))
+	if err = proto.WriteHello(conn, proto.NewHello()); err != nil {
+		return
+	}
+	hello, err := proto.ReadHello(conn)
+	if err == nil {
+		err = hello.Check()
+	}
+	if err != nil {
+		return fmt.Errorf("hello error, the server may be legacy: %w", err)
+	}
+	if next.net == proto.NetKcp && !hello.Has(proto.CapKcp) {
+		return fmt.Errorf("server not support %v", proto.CapKcp)
+	}
+
+	if err = proto.WriteMeta(conn, &proto.Meta{Net: next.net, Address: next.addr}); err != nil {
+		return
+	}
+	resp, err := proto.ReadResponse(conn)
+	if err == nil {
+		err = resp.Err()
+	}
+	if err != nil {
+		return
+	}
+	return conn.SetDeadline(time.Time{})
+}
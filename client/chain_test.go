@@ -0,0 +1,67 @@
+package client
+
+import (
+	"crypto/tls"
+	"io"
+	"testing"
+	"through/config"
+	"through/proto"
+)
+
+func TestChainProducer(t *testing.T) {
+	cert := testCertificate(t)
+	final := serveHello(t, cert, proto.NewHello(), echoConn)
+	hopTls := &tls.Config{InsecureSkipVerify: true}
+	hops := []hop{
+		{name: "bastion", net: "tcp", addr: serveHello(t, cert, proto.NewHello(), fakeHop), tlsCfg: hopTls},
+		{name: "middle", net: "tcp", addr: serveHello(t, cert, proto.NewHello(), fakeHop), tlsCfg: hopTls},
+	}
+
+	conn, err := chainProducer(hops, "tcp", nil)(final, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// conn is the tls session with the final server
+	if err = proto.WriteHello(conn, proto.NewHello()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = proto.ReadHello(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("read %q, %v, want ping", buf, err)
+	}
+
+	// hop fail to reach next server
+	if _, err = chainProducer(hops, "tcp", nil)("127.0.0.1:1", &tls.Config{InsecureSkipVerify: true}); err == nil {
+		t.Error("chainProducer() want error for unreachable server")
+	}
+}
+
+func TestChainOf(t *testing.T) {
+	servers := []config.ProxyServer{
+		{Name: "bastion", Net: "tcp", Addr: "127.0.0.1:1"},
+		{Name: "exit", Net: "tcp", Addr: "10.0.0.1:8888", Chain: []string{"bastion"}},
+	}
+	hops, err := chainOf(servers[1], servers)
+	if err != nil || len(hops) != 1 || hops[0].Name != "bastion" {
+		t.Errorf("chainOf() = %v, %v", hops, err)
+	}
+
+	bad := []config.ProxyServer{
+		{Name: "a", Chain: []string{"missing"}},
+		{Name: "a", Chain: []string{"a"}},
+		{Name: "a", Chain: []string{"bastion", "bastion"}},
+		{Name: "a", Chain: []string{"exit"}},
+	}
+	for _, c := range bad {
+		if _, err = chainOf(c, servers); err == nil {
+			t.Errorf("chainOf(%v) want error", c.Chain)
+		}
+	}
+}
@@ -3,18 +3,29 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"through/config"
 	"through/log"
 	"through/util"
+
+	"github.com/oschwald/geoip2-golang"
 )
 
 type Client struct {
-	ctx           context.Context
-	ruleManager   *RuleManager
-	forwardManger *ForwardManger
+	ctx             context.Context
+	ruleManager     *RuleManager
+	forwardManger   *ForwardManger
+	providerManager *ProviderManager
+
+	lc             sync.Mutex         // serialize reloads
+	resolverCancel context.CancelFunc // stop the resolvers in use
+	asnFile        string             // asn database loaded
 
 	httpListener net.Listener
 	httpProxy    *HttpProxy
@@ -22,52 +33,222 @@ type Client struct {
 	socksListener net.Listener
 	socksProxy    *SocksProxy
 
+	adminListener net.Listener
+
 	wg sync.WaitGroup
 }
 
 func NewClient(ctx context.Context) (c *Client, err error) {
 	cfg := config.Client
 	var tlsCfg *tls.Config
-	tlsCfg, err = util.LoadTlsConfig(cfg.PrivateKey, cfg.CrtFile, "", true)
+	tlsCfg, err = util.LoadClientTlsConfig(ctx, cfg.PrivateKey, cfg.CrtFile)
 	if err != nil {
 		return
 	}
 
 	// new proxy server manager
-	forwardManger, err := NewForwardManger(ctx, cfg.Servers, tlsCfg, cfg.PoolSize)
+	forwardManger, err := NewForwardManger(ctx, cfg.Servers, cfg.Groups, tlsCfg, cfg.CAFile, cfg.PoolSize, cfg.Mux)
 	if err != nil {
 		return
 	}
 
 	// new host resolver
-	resolvers, err := NewResolverManger(ctx, cfg.Resolvers)
+	resolverCtx, resolverCancel := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			resolverCancel()
+		}
+	}()
+	resolvers, err := NewResolverManger(resolverCtx, cfg.Resolvers)
 	if err != nil {
 		return
 	}
 
+	if cfg.AsnFile != "" {
+		var asn *geoip2.Reader
+		if asn, err = util.LoadASN(cfg.AsnFile); err != nil {
+			return
+		}
+		util.SetASN(asn)
+	}
+
 	// new proxy rule manger
-	ruleManger, err := NewRuleManager(resolvers, cfg.Rules)
+	rules, err := ParseRuleCfgs(cfg.Rules)
+	if err != nil {
+		return
+	}
+	if err = checkRules(rules, cfg.Servers, cfg.Groups, util.HasASN()); err != nil {
+		return
+	}
+	providerManager := NewProviderManager(ctx, forwardManger)
+	providers, err := providerManager.Prepare(cfg.Providers, cfg.Servers, cfg.Groups)
+	if err != nil {
+		return
+	}
+	if err = bindProviders(rules, providers.providers); err != nil {
+		return
+	}
+	providerManager.Commit(providers)
+	bindForwards(rules, forwardManger)
+	ruleManger := &RuleManager{}
+	ruleManger.Update(resolvers, rules)
+
+	// new proxy user store, nil if no user configured
+	users, err := NewUserStore(cfg.Users, cfg.UserFile)
 	if err != nil {
 		return
 	}
 
 	// new http proxy handler
-	httpProxy := NewHttpProxy(ctx, forwardManger, ruleManger)
+	httpProxy := NewHttpProxy(ctx, forwardManger, ruleManger, users)
 
 	// new socks proxy handler
-	socksProxy := NewSocksProxy(ctx, forwardManger, ruleManger)
+	socksProxy := NewSocksProxy(ctx, forwardManger, ruleManger, users)
 
 	c = &Client{
-		ctx:           ctx,
-		httpProxy:     httpProxy,
-		socksProxy:    socksProxy,
-		wg:            sync.WaitGroup{},
-		forwardManger: forwardManger,
-		ruleManager:   ruleManger,
+		ctx:             ctx,
+		httpProxy:       httpProxy,
+		socksProxy:      socksProxy,
+		wg:              sync.WaitGroup{},
+		forwardManger:   forwardManger,
+		ruleManager:     ruleManger,
+		providerManager: providerManager,
+		resolverCancel:  resolverCancel,
+		asnFile:         cfg.AsnFile,
+	}
+	return
+}
+
+// Reload read config file again and apply resolvers, rule providers, rules and servers.
+// the running config is kept if the new one is invalid.
+// listen addresses, certificate and users need restart
+func (c *Client) Reload() (err error) {
+	c.lc.Lock()
+	defer c.lc.Unlock()
+
+	all, err := config.Load(config.File())
+	if err != nil {
+		return
+	}
+	cfg := &all.ClientCfg
+
+	// asn database is replaced only if the whole config is applied
+	var asn *geoip2.Reader
+	if cfg.AsnFile != "" && cfg.AsnFile != c.asnFile {
+		if asn, err = util.LoadASN(cfg.AsnFile); err != nil {
+			return
+		}
+	}
+
+	rules, err := ParseRuleCfgs(cfg.Rules)
+	if err != nil {
+		return
+	}
+	if err = checkRules(rules, cfg.Servers, cfg.Groups, asn != nil || util.HasASN()); err != nil {
+		return
+	}
+	providers, err := c.providerManager.Prepare(cfg.Providers, cfg.Servers, cfg.Groups)
+	if err != nil {
+		return
 	}
+	if err = bindProviders(rules, providers.providers); err != nil {
+		return
+	}
+	resolverCtx, resolverCancel := context.WithCancel(c.ctx)
+	resolvers, err := NewResolverManger(resolverCtx, cfg.Resolvers)
+	if err != nil {
+		resolverCancel()
+		return
+	}
+	// servers first, so new rules never point to a missing server
+	if err = c.forwardManger.Update(cfg.Servers, cfg.Groups, cfg.CAFile, cfg.PoolSize, cfg.Mux); err != nil {
+		resolverCancel()
+		return
+	}
+	if asn != nil {
+		util.SetASN(asn)
+		c.asnFile = cfg.AsnFile
+	}
+	c.providerManager.Commit(providers)
+	bindForwards(rules, c.forwardManger)
+	c.ruleManager.Update(resolvers, rules)
+	c.resolverCancel()
+	c.resolverCancel = resolverCancel
+
+	log.Infof("config reloaded, %d servers, %d groups, %d rules", len(cfg.Servers), len(cfg.Groups), len(rules))
 	return
 }
 
+// watchConfig reload when config file change or SIGHUP is received
+func (c *Client) watchConfig() {
+	defer c.wg.Done()
+
+	reload := func(reason string) {
+		log.Infof("%v, reload config %v", reason, config.File())
+		if err := c.Reload(); err != nil {
+			log.Errorf("reload config error, keep the running one: %v", err)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-hup:
+				reload("receive SIGHUP")
+			}
+		}
+	}()
+
+	// an invalid config is reported once, it's checked again on next change
+	util.WatchFiles(c.ctx, util.WatchInterval, []string{config.File()}, func() error {
+		reload("config file changed")
+		return nil
+	})
+}
+
+// checkRules make sure every forward rule point to a configured server or group,
+// and ip-asn rules are used with asn database
+func checkRules(rules []Rule, serverCfgs []config.ProxyServer, groups []config.ProxyGroup, hasASN bool) error {
+	names := forwardNames(serverCfgs, groups)
+	servers := forwardNames(serverCfgs, nil)
+	for i := range rules {
+		ru := &rules[i]
+		if ru.Action == RuleActionTypeForward && !names[ru.Server] {
+			return fmt.Errorf("rule %v forward to unknown server %q", ru, ru.Server)
+		}
+		err := ru.walk(func(r *Rule) error {
+			if r.CondType == RuleCondTypeIPASN && !hasASN {
+				return fmt.Errorf("rule %v need asnFile", ru)
+			}
+			if r.CondType == RuleCondTypeServerState && !servers[r.target] {
+				return fmt.Errorf("rule %v check state of unknown server %q", ru, r.target)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forwardNames names of servers and groups
+func forwardNames(servers []config.ProxyServer, groups []config.ProxyGroup) map[string]bool {
+	names := map[string]bool{}
+	for _, s := range servers {
+		names[s.Name] = true
+	}
+	for _, g := range groups {
+		names[g.Name] = true
+	}
+	return names
+}
+
 // Start listen and proxy
 func (c *Client) Start() (err error) {
 
@@ -96,6 +277,23 @@ func (c *Client) Start() (err error) {
 	c.wg.Add(1)
 	go c.listenSocks()
 
+	// start admin api, it has no auth, so listen on a local address
+	if cfg.AdminAddr != "" {
+		adminLis, err := net.Listen("tcp", cfg.AdminAddr)
+		if err != nil {
+			log.Infof("tcp admin listener error: %v", err)
+			return err
+		}
+		c.adminListener = adminLis
+
+		log.Infof("client admin api listen at %v", cfg.AdminAddr)
+		c.wg.Add(1)
+		go c.listenAdmin()
+	}
+
+	c.wg.Add(1)
+	go c.watchConfig()
+
 	<-c.ctx.Done()
 	return
 }
@@ -107,6 +305,13 @@ func (c *Client) listenHttp() {
 	}
 }
 
+func (c *Client) listenAdmin() {
+	defer c.wg.Done()
+	if err := http.Serve(c.adminListener, NewAdminHandler(c.forwardManger)); err != nil {
+		log.Errorf("admin server error: %v", err)
+	}
+}
+
 func (c *Client) listenSocks() {
 	defer c.wg.Done()
 	for {
@@ -132,5 +337,9 @@ func (c *Client) Stop() {
 		log.Info("close socks listener")
 		_ = c.socksListener.Close()
 	}
+	if c.adminListener != nil {
+		log.Info("close admin listener")
+		_ = c.adminListener.Close()
+	}
 	c.wg.Wait()
 }
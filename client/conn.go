@@ -4,44 +4,76 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"github.com/xtaci/kcp-go"
+	"io"
 	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
 	"through/log"
+	"through/proto"
 	"time"
 )
 
-const MaxProducer = 20
+var (
+	legacyServer = errors.New("server is legacy, reconnect")
+	PoolClosed   = errors.New("connection pool is closed")
+	PoolTimeout  = errors.New("no connection to server in time")
+)
+
+const (
+	MaxProducer = 20
+	// helloTimeout limit the time server take to reply hello
+	helloTimeout = 5 * time.Second
+	// serverDialTimeout limit the time to connect server
+	serverDialTimeout = 10 * time.Second
+	// min and max wait of producer before dialing again after failure, doubled on each failure
+	minDialBackoff = time.Second
+	maxDialBackoff = 30 * time.Second
+	// legacyRecheckInterval how long a legacy server is used without hello before probing it again
+	legacyRecheckInterval = 10 * time.Minute
+)
 
 type ConnectionPool struct {
 	ctx     context.Context
 	tlsCfg  *tls.Config
 	network string
 	addr    string
+	hops    []hop     // servers to pass through, in order
+	proxy   *upstream // http or socks5 proxy to connect server or the first hop through
 	pool    chan net.Conn
 	logger  *log.Logger
 
 	lc          sync.Mutex
 	wg          sync.WaitGroup
 	producerCnt atomic.Int32
+	server      atomic.Pointer[proto.Hello] // hello of server, set after first handshake
+	legacyAt    atomic.Int64                // unix nano when server was found not understanding hello, 0 if not
+	active      atomic.Int64                // connections and streams in use, see track
+	failures    atomic.Int32                // consecutive dial failures of producers
+	health      *health
 }
 
-func NewConnectionPool(ctx context.Context, size int, network, addr string, tlsCfg *tls.Config) (p *ConnectionPool) {
+func NewConnectionPool(ctx context.Context, size int, network, addr string, tlsCfg *tls.Config, hops []hop, proxy *upstream) (p *ConnectionPool) {
 	p = &ConnectionPool{
 		ctx:         ctx,
 		pool:        make(chan net.Conn, size),
 		network:     network,
 		addr:        addr,
+		hops:        hops,
+		proxy:       proxy,
 		tlsCfg:      tlsCfg,
 		logger:      log.NewLogger().With("type", "connectionPool").With("network", network).With("address", addr),
 		wg:          sync.WaitGroup{},
 		lc:          sync.Mutex{},
 		producerCnt: atomic.Int32{},
 	}
+	p.health = newHealth(p.logger)
 
 	p.addProducer()
+	p.wg.Add(1)
+	go p.checkHealth()
 	return p
 }
 
@@ -49,11 +81,15 @@ func NewConnectionPool(ctx context.Context, size int, network, addr string, tlsC
 func (p *ConnectionPool) Get(timeout context.Context) (c net.Conn, err error) {
 	select {
 	case <-p.ctx.Done():
+		err = PoolClosed
 		return
 	case <-timeout.Done():
 		p.logger.Debug("get connect timeout, add one producer")
 		p.addProducer()
-		err = errors.New("timeout")
+		err = PoolTimeout
+		if p.failures.Load() > 0 {
+			err = fmt.Errorf("%w, last error: %v", PoolTimeout, p.health.LastError())
+		}
 		return
 	case c = <-p.pool:
 		// if pool close to null, add producer
@@ -84,7 +120,7 @@ func (p *ConnectionPool) addProducer() {
 type Producer func(addr string, tlsCfg *tls.Config) (conn net.Conn, err error)
 
 var tcpProducer Producer = func(addr string, tlsCfg *tls.Config) (conn net.Conn, err error) {
-	conn, err = tls.Dial("tcp", addr, tlsCfg)
+	conn, err = tls.DialWithDialer(&net.Dialer{Timeout: serverDialTimeout}, "tcp", addr, tlsCfg)
 	return
 }
 
@@ -97,17 +133,37 @@ var kcpProducer Producer = func(addr string, tlsCfg *tls.Config) (conn net.Conn,
 }
 
 func (p *ConnectionPool) getProducer() (pro Producer) {
-	switch p.network {
+	if len(p.hops) > 0 {
+		return chainProducer(p.hops, p.network, p.proxy)
+	}
+	return dialProducer(p.network, p.proxy)
+}
+
+// dialProducer return producer of network which connect through proxy if it's set, nil if unsupported
+func dialProducer(network string, proxy *upstream) Producer {
+	if proxy == nil {
+		return netProducer(network)
+	}
+	if network != "tcp" {
+		return nil
+	}
+	return proxy.producer()
+}
+
+// netProducer return producer of network, nil if unsupported
+func netProducer(network string) Producer {
+	switch network {
 	case "tcp":
 		return tcpProducer
 	case "kcp":
 		return kcpProducer
 	}
-	return
+	return nil
 }
 
 func (p *ConnectionPool) producer() {
 	defer p.wg.Done()
+	backoff := minDialBackoff
 	for {
 		select {
 		case <-p.ctx.Done():
@@ -132,24 +188,29 @@ func (p *ConnectionPool) producer() {
 
 		start := time.Now()
 		// new connection
-		prod := p.getProducer()
-		if prod == nil {
-			p.logger.Errorf("unsupported network %v", p.network)
-			return
+		c, err := p.dial()
+		if errors.Is(err, legacyServer) {
+			continue
 		}
-		c, err := prod(p.addr, p.tlsCfg)
 		if err != nil {
-			p.logger.Errorf("dial server error:%v", err)
-			time.Sleep(10 * time.Second)
+			p.logger.Errorf("dial server error: %v, retry in %v", err, backoff)
+			select {
+			case <-p.ctx.Done():
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxDialBackoff {
+				backoff = maxDialBackoff
+			}
 			continue
 		}
+		backoff = minDialBackoff
 		p.logger.Debugf("produce one connect cost %v", time.Now().Sub(start))
 
 		// return when server is closed
 		select {
 		case <-p.ctx.Done():
 			p.logger.Debug("connection producer stop")
-			close(p.pool)
+			_ = c.Close()
 			return
 		case p.pool <- c:
 			p.logger.Debug("put one connect")
@@ -158,13 +219,167 @@ func (p *ConnectionPool) producer() {
 	}
 }
 
+// dial connect server and exchange hello, the result is recorded to health
+func (p *ConnectionPool) dial() (c net.Conn, err error) {
+	prod := p.getProducer()
+	if prod == nil {
+		return nil, fmt.Errorf("unsupported network %v", p.network)
+	}
+	start := time.Now()
+	if c, err = prod(p.addr, p.tlsCfg); err == nil {
+		err = p.handshake(c)
+	}
+	switch {
+	case errors.Is(err, legacyServer):
+		p.health.success(0)
+	case err != nil:
+		p.failures.Add(1)
+		p.health.failure(err)
+	default:
+		p.failures.Store(0)
+		p.health.success(time.Since(start))
+	}
+	return
+}
+
+// checkHealth probe server by dialing a new connection, more often while it's down.
+// the connection is kept in pool if there is room.
+// healthy server with idle connections is not probed, tunnels opened on them keep health up to date
+func (p *ConnectionPool) checkHealth() {
+	defer p.wg.Done()
+	for {
+		interval := healthCheckInterval
+		if p.health.State() == HealthDown {
+			interval = downCheckInterval
+		}
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if p.health.State() == HealthHealthy && len(p.pool) > 0 {
+			continue
+		}
+
+		c, err := p.dial()
+		if err != nil {
+			continue
+		}
+		select {
+		case p.pool <- c:
+		default:
+			_ = c.Close()
+		}
+	}
+}
+
+// Health return health of server
+func (p *ConnectionPool) Health() HealthStats {
+	return p.health.Stats()
+}
+
+// handshake exchange hello with server, legacy server close the connection on hello,
+// then following connections are used without hello until legacyRecheckInterval passed
+func (p *ConnectionPool) handshake(conn net.Conn) (err error) {
+	if at := p.legacyAt.Load(); at != 0 {
+		if time.Since(time.Unix(0, at)) < legacyRecheckInterval {
+			return
+		}
+		p.logger.Info("probe legacy server with hello again")
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(helloTimeout))
+	// tls errors must not be taken as closed by legacy server
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err = tc.Handshake(); err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+	if err = proto.WriteHello(conn, proto.NewHello()); err != nil {
+		_ = conn.Close()
+		return
+	}
+	hello, err := proto.ReadHello(conn)
+	if closedOnHello(err) {
+		p.logger.Warnf("server close connection on hello, fallback to legacy protocol")
+		p.legacyAt.Store(time.Now().UnixNano())
+		p.server.Store(proto.LegacyHello())
+		_ = conn.Close()
+		return legacyServer
+	}
+	if err == nil {
+		err = hello.Check()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	p.legacyAt.Store(0)
+	if old := p.server.Swap(hello); old == nil || old.GetVersion() != hello.GetVersion() {
+		p.logger.Infof("server protocol version %d, capabilities %v", hello.GetVersion(), hello.GetCapabilities())
+	}
+	return
+}
+
+// closedOnHello return true if server closed connection cleanly without sending any byte of hello
+func closedOnHello(err error) bool {
+	var frameErr *proto.FrameError
+	return errors.As(err, &frameErr) && frameErr.Op == "read header" && frameErr.Err == io.EOF
+}
+
+// Server return hello of server, nil if no connection is produced yet
+func (p *ConnectionPool) Server() *proto.Hello {
+	return p.server.Load()
+}
+
+// track count conn as in use until it's closed
+func (p *ConnectionPool) track(conn net.Conn) net.Conn {
+	return countActive(conn, &p.active)
+}
+
+// Active return number of connections and streams in use
+func (p *ConnectionPool) Active() int64 {
+	return p.active.Load()
+}
+
+// Failing return true if producers fail to dial server and no idle connection is left
+func (p *ConnectionPool) Failing() bool {
+	return p.failures.Load() > 0 && len(p.pool) == 0
+}
+
+// trackedConn connection counted in active until closed
+type trackedConn struct {
+	net.Conn
+	active *atomic.Int64
+	once   sync.Once
+}
+
+// countActive add conn to active, it's removed when conn is closed
+func countActive(conn net.Conn, active *atomic.Int64) net.Conn {
+	active.Add(1)
+	return &trackedConn{Conn: conn, active: active}
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.active.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// Close wait producers to stop after ctx is done, then close idle connections
 func (p *ConnectionPool) Close() {
 	p.logger.Info("close pool")
-	for c := range p.pool {
-		if c == nil {
-			break
+	p.wg.Wait()
+	for {
+		select {
+		case c := <-p.pool:
+			_ = c.Close()
+		default:
+			return
 		}
-		_ = c.Close()
 	}
-	p.wg.Wait()
 }
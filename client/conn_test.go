@@ -0,0 +1,62 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"through/log"
+	"through/proto"
+	"time"
+)
+
+func TestConnectionPool_Handshake(t *testing.T) {
+	cert := testCertificate(t)
+	legacy := serveTls(t, cert, func(conn *tls.Conn) {})
+	partial := serveTls(t, cert, func(conn *tls.Conn) {
+		_, _ = conn.Write([]byte{0, 0})
+	})
+	versioned := serveHello(t, cert, proto.NewHello(), func(conn net.Conn) {})
+
+	p := &ConnectionPool{logger: log.NewLogger()}
+	handshake := func(addr string, tlsCfg *tls.Config) error {
+		raw, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := tls.Client(raw, tlsCfg)
+		defer conn.Close()
+		return p.handshake(conn)
+	}
+	insecure := &tls.Config{InsecureSkipVerify: true}
+
+	// failed tls handshake and partial hello are errors, not legacy server
+	if err := handshake(legacy, &tls.Config{ServerName: "through"}); err == nil || errors.Is(err, legacyServer) {
+		t.Errorf("handshake() with untrusted certificate error = %v", err)
+	}
+	if err := handshake(partial, insecure); err == nil || errors.Is(err, legacyServer) {
+		t.Errorf("handshake() with partial hello error = %v", err)
+	}
+	if p.legacyAt.Load() != 0 {
+		t.Fatal("fallback to legacy on errors")
+	}
+
+	if err := handshake(legacy, insecure); !errors.Is(err, legacyServer) {
+		t.Fatalf("handshake() with legacy server error = %v", err)
+	}
+	if err := handshake(legacy, insecure); err != nil {
+		t.Errorf("handshake() after fallback error = %v", err)
+	}
+	if !p.Server().Legacy() {
+		t.Error("Server() is not legacy")
+	}
+
+	// server is probed again after a while
+	p.legacyAt.Store(time.Now().Add(-legacyRecheckInterval).UnixNano())
+	if err := handshake(versioned, insecure); err != nil {
+		t.Fatal(err)
+	}
+	if p.legacyAt.Load() != 0 || p.Server().GetVersion() != proto.ProtocolVersion {
+		t.Errorf("server after probe = %v, legacy at %v", p.Server(), p.legacyAt.Load())
+	}
+}
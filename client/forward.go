@@ -4,10 +4,14 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"go.uber.org/zap"
 	"io"
 	"net"
 	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"through/config"
 	"through/log"
 	"through/proto"
@@ -15,71 +19,255 @@ import (
 	"time"
 )
 
+var (
+	RejectError = errors.New("rejected by rule")
+)
+
+const (
+	directDialTimeout = 10 * time.Second
+	// getConnTimeout wait for a connection of pool or mux stream
+	getConnTimeout = 5 * time.Second
+	// responseTimeout wait for server response, longer than dial timeout of server
+	responseTimeout = 15 * time.Second
+)
+
 type Forward interface {
 	Http(writer http.ResponseWriter, request *http.Request)
-	Connect(conn net.Conn, meta *proto.Meta)
+	// Dial connect to the address in meta, caller should copy data between remote and client
+	Dial(ctx context.Context, meta *proto.Meta) (remote net.Conn, err error)
+	// Relay send datagrams of an association, meta hold the first destination of it
+	Relay(meta *proto.Meta) (relay UdpRelay, err error)
+	Bind(meta *proto.Meta) (binding Binding, err error)
 	Close()
 }
 
+// ForwardManger hold forwards by name, servers can be updated at runtime
 type ForwardManger struct {
-	forwardClients map[string]Forward
+	ctx    context.Context
+	tlsCfg *tls.Config
+
+	lc             sync.Mutex // serialize updates
+	forwardClients atomic.Pointer[map[string]Forward]
+	configs        map[string]forwardCfg        // config of each ForwardClient, to find changed servers on update
+	groupCfgs      map[string]config.ProxyGroup // config of each ProxyGroup
+}
+
+// forwardCfg everything a ForwardClient is built from
+type forwardCfg struct {
+	server   config.ProxyServer
+	hops     []config.ProxyServer
+	proxy    *config.ProxyServer
+	caFile   string
+	poolSize int
+	mux      config.MuxCfg
+}
+
+func NewForwardManger(ctx context.Context, server []config.ProxyServer, groups []config.ProxyGroup, tlsCfg *tls.Config, caFile string, poolSize int, mux config.MuxCfg) (f *ForwardManger, err error) {
+	f = &ForwardManger{ctx: ctx, tlsCfg: tlsCfg}
+	if err = f.Update(server, groups, caFile, poolSize, mux); err != nil {
+		return nil, err
+	}
+	return
 }
 
-func NewForwardManger(ctx context.Context, server []config.ProxyServer, tlsCfg *tls.Config, poolSize int) (f *ForwardManger, err error) {
-	f = &ForwardManger{forwardClients: map[string]Forward{}}
+// Update replace servers and groups, unchanged servers keep their pools, new and changed ones are created.
+// nothing is replaced if any server or group fail to create.
+// removed servers are drained, so tunnels in use are not broken
+func (f *ForwardManger) Update(server []config.ProxyServer, groups []config.ProxyGroup, caFile string, poolSize int, mux config.MuxCfg) (err error) {
 	if len(server) == 0 {
-		err = errors.New("server config must more then zero")
-		return
+		return errors.New("server config must more then zero")
 	}
 
-	f.forwardClients["reject"] = &RejectClient{}
-	f.forwardClients["direct"] = &DirectClient{}
+	f.lc.Lock()
+	defer f.lc.Unlock()
 
+	var old map[string]Forward
+	if p := f.forwardClients.Load(); p != nil {
+		old = *p
+	}
+	clients := map[string]Forward{
+		"reject": &RejectClient{},
+		"direct": &DirectClient{},
+	}
+	configs := map[string]forwardCfg{}
+	var created []*ForwardClient
 	for _, c := range server {
-		if _, ok := f.forwardClients[c.Name]; ok {
+		if _, ok := clients[c.Name]; ok {
+			continue
+		}
+		if isUpstream(c.Net) {
+			uc, err := NewUpstreamClient(c)
+			if err != nil {
+				for _, fc := range created {
+					fc.Close()
+				}
+				return fmt.Errorf("server %v: %w", c.Name, err)
+			}
+			clients[c.Name] = uc
+			continue
+		}
+		hops, err := chainOf(c, server)
+		if err == nil && c.Net == "" && len(hops) > 0 {
+			err = errors.New("net of chained server is required")
+		}
+		var proxy *config.ProxyServer
+		if err == nil {
+			proxy, err = proxyOf(c, hops, server)
+		}
+		if err != nil {
+			for _, fc := range created {
+				fc.Close()
+			}
+			return fmt.Errorf("server %v: %w", c.Name, err)
+		}
+		cfg := forwardCfg{server: c, hops: hops, proxy: proxy, caFile: caFile, poolSize: poolSize, mux: mux}
+		configs[c.Name] = cfg
+		if fc, ok := old[c.Name]; ok && reflect.DeepEqual(f.configs[c.Name], cfg) {
+			clients[c.Name] = fc
 			continue
 		}
-		forwardCli := NewForwardClient(ctx, c.Net, c.Addr, poolSize, tlsCfg)
-		f.forwardClients[c.Name] = forwardCli
+
+		fc, err := NewForwardClient(f.ctx, c, hops, proxy, f.tlsCfg, caFile, poolSize, mux)
+		if err != nil {
+			for _, fc := range created {
+				fc.Close()
+			}
+			return fmt.Errorf("server %v: %w", c.Name, err)
+		}
+		created = append(created, fc)
+		clients[c.Name] = fc
+	}
+
+	// members of a group are servers or groups before it, so there is no loop
+	groupCfgs := map[string]config.ProxyGroup{}
+	var createdGroups []*ProxyGroup
+	for _, c := range groups {
+		g, err := f.newGroup(c, clients, old)
+		if err != nil {
+			for _, fc := range created {
+				fc.Close()
+			}
+			return fmt.Errorf("group %v: %w", c.Name, err)
+		}
+		if g != old[c.Name] {
+			createdGroups = append(createdGroups, g)
+		}
+		groupCfgs[c.Name] = c
+		clients[c.Name] = g
+	}
+
+	f.forwardClients.Store(&clients)
+	f.configs = configs
+	f.groupCfgs = groupCfgs
+	for _, g := range createdGroups {
+		g.start(f.ctx)
+	}
+
+	for name, fc := range old {
+		if clients[name] != fc {
+			switch fc := fc.(type) {
+			case *ForwardClient:
+				log.Infof("server %v is removed or changed, drain it", name)
+				fc.Drain()
+			case *ProxyGroup, *UpstreamClient:
+				fc.Close()
+			}
+		}
 	}
 	return
 }
 
+// newGroup check members of group c and create it, the old group is kept if config is unchanged
+func (f *ForwardManger) newGroup(c config.ProxyGroup, clients, old map[string]Forward) (*ProxyGroup, error) {
+	if c.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	if _, ok := clients[c.Name]; ok {
+		return nil, errors.New("name is used by another server or group")
+	}
+	for _, name := range c.Servers {
+		if _, ok := clients[name]; !ok {
+			return nil, fmt.Errorf("unknown server %q, groups must be defined before used", name)
+		}
+	}
+	if g, ok := old[c.Name].(*ProxyGroup); ok && reflect.DeepEqual(f.groupCfgs[c.Name], c) {
+		return g, nil
+	}
+	return NewProxyGroup(c, f.GetForward)
+}
+
+// serverTlsConfig build tls config which verify the server
+func serverTlsConfig(ctx context.Context, tlsCfg *tls.Config, c config.ProxyServer, caFile string) (*tls.Config, error) {
+	v := util.ServerVerify{CAFile: c.CAFile, Pins: c.Pins, ServerName: c.ServerName, Insecure: c.Insecure}
+	if v.CAFile == "" && len(v.Pins) == 0 {
+		v.CAFile = caFile
+	}
+	if v.Insecure {
+		log.Warnf("certificate of server %v is not verified", c.Name)
+	}
+	return util.WithServerVerify(ctx, tlsCfg, c.Addr, v)
+}
+
 func (f *ForwardManger) GetForward(name string) (forward Forward, ok bool) {
-	forward, ok = f.forwardClients[name]
+	forward, ok = (*f.forwardClients.Load())[name]
 	return
 }
 
+// ServerState return health state of server, empty if name is not a server
+func (f *ForwardManger) ServerState(name string) HealthState {
+	if fc, ok := (*f.forwardClients.Load())[name].(*ForwardClient); ok {
+		return fc.pool.health.State()
+	}
+	return ""
+}
+
 func (f *ForwardManger) Close() {
 	log.Info("close forward manager")
-	for _, v := range f.forwardClients {
+	for _, v := range *f.forwardClients.Load() {
 		v.Close()
 	}
 }
 
 // DirectClient no proxy, direct call request
-type DirectClient struct{}
+type DirectClient struct {
+	active atomic.Int64 // connections in use
+}
 
 func (d *DirectClient) Http(writer http.ResponseWriter, request *http.Request) {
 	removeProxyHeaders(request)
 	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
-		http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+		http.Error(writer, err.Error(), httpStatus(err))
 		return
 	}
 	defer resp.Body.Close()
 	copyHTTPResponse(writer, resp)
 }
 
-func (d *DirectClient) Connect(conn net.Conn, meta *proto.Meta) {
-	defer conn.Close()
-	remote, err := net.Dial(meta.GetNet(), meta.GetAddress())
+func (d *DirectClient) Dial(ctx context.Context, meta *proto.Meta) (remote net.Conn, err error) {
+	dialer := &net.Dialer{Timeout: directDialTimeout}
+	if remote, err = dialer.DialContext(ctx, meta.GetNet(), meta.GetAddress()); err != nil {
+		log.Errorf("dial remote %v error: %v", meta.GetAddress(), err)
+		return
+	}
+	return countActive(remote, &d.active), nil
+}
+
+func (d *DirectClient) Relay(meta *proto.Meta) (relay UdpRelay, err error) {
+	pc, err := net.ListenPacket("udp", ":0")
 	if err != nil {
-		log.Errorf("dial remote %v error", meta.GetAddress())
 		return
 	}
+	return &directRelay{pc: pc}, nil
+}
+
+func (d *DirectClient) Bind(meta *proto.Meta) (binding Binding, err error) {
+	return newDirectBinding(meta.GetAddress())
+}
 
-	util.CopyLoopWait(conn, remote)
+// Active return number of connections in use
+func (d *DirectClient) Active() int64 {
+	return d.active.Load()
 }
 
 func (d *DirectClient) Close() {}
@@ -92,10 +280,17 @@ func (r *RejectClient) Http(writer http.ResponseWriter, request *http.Request) {
 	http.Error(writer, "reject", http.StatusForbidden)
 }
 
-func (r *RejectClient) Connect(conn net.Conn, meta *proto.Meta) {
-	defer conn.Close()
-	_, _ = conn.Write([]byte("reject"))
+func (r *RejectClient) Dial(ctx context.Context, meta *proto.Meta) (remote net.Conn, err error) {
 	log.Infof("reject connect")
+	return nil, RejectError
+}
+
+func (r *RejectClient) Relay(meta *proto.Meta) (relay UdpRelay, err error) {
+	return nil, RejectError
+}
+
+func (r *RejectClient) Bind(meta *proto.Meta) (binding Binding, err error) {
+	return nil, RejectError
 }
 
 func (r *RejectClient) Close() {}
@@ -104,18 +299,49 @@ func (r *RejectClient) Close() {}
 type ForwardClient struct {
 	net    string
 	addr   string
+	cancel context.CancelFunc
 	pool   *ConnectionPool
+	mux    *MuxPool
 	client *http.Client
 	logger *log.Logger
 }
 
-func NewForwardClient(ctx context.Context, network, addr string, poolSize int, tlsCfg *tls.Config) (f *ForwardClient) {
+// NewForwardClient new client of server c, it runs until ctx is done or it's closed.
+// connections pass through hops in order if c is chained, and through the http or socks5 proxy if it's set
+func NewForwardClient(ctx context.Context, c config.ProxyServer, hops []config.ProxyServer, proxy *config.ProxyServer, tlsCfg *tls.Config, caFile string, poolSize int, mux config.MuxCfg) (f *ForwardClient, err error) {
+	var up *upstream
+	if proxy != nil {
+		if up, err = newUpstream(*proxy); err != nil {
+			return
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	serverTls, err := serverTlsConfig(ctx, tlsCfg, c, caFile)
+	if err != nil {
+		cancel()
+		return
+	}
+	var chain []hop
+	for _, h := range hops {
+		hopTls, err := serverTlsConfig(ctx, tlsCfg, h, caFile)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("hop %v: %w", h.Name, err)
+		}
+		chain = append(chain, hop{name: h.Name, net: h.Net, addr: h.Addr, tlsCfg: hopTls})
+	}
+
+	network, addr := c.Net, c.Addr
 	f = &ForwardClient{
 		net:    network,
 		addr:   addr,
-		pool:   NewConnectionPool(ctx, poolSize, network, addr, tlsCfg),
+		cancel: cancel,
+		pool:   NewConnectionPool(ctx, poolSize, network, addr, serverTls, chain, up),
 		logger: log.NewLogger(zap.AddCallerSkip(1)).With("type", "forwardClient").With("network", network).With("address", addr),
 	}
+	if mux.Enable {
+		f.mux = NewMuxPool(f.pool, mux)
+	}
 	f.client = &http.Client{
 		Transport: &http.Transport{
 			DialContext: f.dialContext,
@@ -130,51 +356,228 @@ func (f *ForwardClient) Http(writer http.ResponseWriter, request *http.Request)
 	resp, err := f.client.Do(request)
 	if err != nil {
 		f.logger.Errorf("do http request error: %v", err)
-		http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+		http.Error(writer, err.Error(), httpStatus(err))
 		return
 	}
 	defer resp.Body.Close()
 	copyHTTPResponse(writer, resp)
 }
 
-func (f *ForwardClient) Connect(conn net.Conn, meta *proto.Meta) {
-	remote, err := f.dialContext(context.Background(), meta.GetNet(), meta.GetAddress())
+func (f *ForwardClient) Dial(ctx context.Context, meta *proto.Meta) (remote net.Conn, err error) {
+	conn, err := f.open(ctx, meta)
 	if err != nil {
 		f.logger.Errorf("dial server error: %v", err)
-		_ = conn.Close()
 		return
 	}
-
-	util.CopyLoopWait(conn, remote)
+	return conn, nil
 }
 
-func (f *ForwardClient) dialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
-	timeout, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
+func (f *ForwardClient) Relay(meta *proto.Meta) (relay UdpRelay, err error) {
+	conn, err := f.open(context.Background(), &proto.Meta{Net: proto.NetUDP})
+	if err != nil {
+		f.logger.Errorf("dial server error: %v", err)
+		return
+	}
+	return &tunnelRelay{conn: conn}, nil
+}
 
-	conn, err = f.pool.Get(timeout)
+func (f *ForwardClient) Bind(meta *proto.Meta) (binding Binding, err error) {
+	conn, err := f.open(context.Background(), &proto.Meta{Net: proto.NetBind, Address: meta.GetAddress()})
 	if err != nil {
-		log.Errorf("%v get connection error %v", addr, err)
+		f.logger.Errorf("dial server error: %v", err)
 		return
 	}
+	return newTunnelBinding(conn), nil
+}
 
+func (f *ForwardClient) dialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
 	meta := &proto.Meta{
 		Net:     "tcp",
 		Address: addr,
 	}
+	tc, err := f.open(ctx, meta)
+	if err != nil {
+		return
+	}
+	return tc, nil
+}
+
+// open get a tunnel connection, send meta on it and wait for server response.
+// it fails fast while server is down, handshake and transport errors of server are recorded to health
+func (f *ForwardClient) open(ctx context.Context, meta *proto.Meta) (tc *tunnelConn, err error) {
+	if err = f.supports(meta); err != nil {
+		return
+	}
+	if f.pool.health.State() == HealthDown {
+		return nil, fmt.Errorf("%w: %v", ServerDown, f.pool.health.LastError())
+	}
+	defer func() {
+		var dialErr *proto.DialError
+		switch {
+		case err == nil, errors.As(err, &dialErr):
+			// server is working even if it can't reach the remote
+			f.pool.health.success(0)
+		case errors.Is(err, PoolTimeout), errors.Is(err, PoolClosed):
+			// waiting for a pooled connection is local, failed dials are recorded by pool itself
+		case ctx.Err() == nil:
+			f.pool.health.failure(err)
+		}
+	}()
+
+	timeout, cancel := context.WithTimeout(ctx, getConnTimeout)
+	defer cancel()
+
+	conn, err := f.getConn(timeout)
+	if err != nil {
+		log.Errorf("%v get connection error %v", meta.GetAddress(), err)
+		return
+	}
+	// server is known after the first connection
+	if err = f.supports(meta); err != nil {
+		_ = conn.Close()
+		return
+	}
+
 	if err = proto.WriteMeta(conn, meta); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	// legacy server don't response
+	if f.pool.Server().Legacy() {
+		return &tunnelConn{Conn: conn}, nil
+	}
+
+	deadline := time.Now().Add(responseTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetReadDeadline(deadline)
+	resp, err := proto.ReadResponse(conn)
+	if err == nil {
+		err = resp.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	return &tunnelConn{Conn: conn, bound: resp.GetBoundAddress()}, nil
+}
+
+// supports check whether server support the net of meta, it is unknown before first connection
+func (f *ForwardClient) supports(meta *proto.Meta) error {
+	hello := f.pool.Server()
+	if hello == nil {
+		return nil
+	}
+
+	var capability string
+	switch meta.GetNet() {
+	case proto.NetUDP:
+		capability = proto.CapUDP
+	case proto.NetBind:
+		capability = proto.CapBind
+	default:
+		return nil
+	}
+	if !hello.Has(capability) {
+		return &proto.DialError{Status: proto.Status_UNSUPPORTED, Msg: "server not support " + capability}
+	}
+	return nil
+}
+
+// tunnelConn tunnel connection which server has responded
+type tunnelConn struct {
+	net.Conn
+	bound string
+}
+
+// BoundAddr return the local address of server dialing to remote
+func (t *tunnelConn) BoundAddr() string {
+	return t.bound
+}
+
+// getConn open a mux stream if enabled, otherwise take a whole connection from pool.
+// the connection is counted as active until it's closed
+func (f *ForwardClient) getConn(ctx context.Context) (conn net.Conn, err error) {
+	if f.mux != nil && f.mux.Supported() {
+		conn, err = f.mux.Get(ctx)
+		if !errors.Is(err, MuxUnsupported) {
+			if err == nil {
+				conn = f.pool.track(conn)
+			}
+			return
+		}
+	}
+	if conn, err = f.pool.Get(ctx); err != nil {
 		return
 	}
+	return f.pool.track(conn), nil
+}
+
+// Health return health of server
+func (f *ForwardClient) Health() HealthStats {
+	return f.pool.Health()
+}
 
-	return conn, err
+// Active return number of tunnels in use
+func (f *ForwardClient) Active() int64 {
+	return f.pool.Active()
+}
+
+// Failing return true if server can't be connected now, or it's down
+func (f *ForwardClient) Failing() bool {
+	return f.pool.Failing() || f.pool.health.State() == HealthDown
+}
+
+// failer forward which know whether it's failing, servers, proxies and groups
+type failer interface {
+	Failing() bool
+}
+
+// isFailing return true if forward is failing to connect or down, direct and reject never fail
+func isFailing(forward Forward) bool {
+	f, ok := forward.(failer)
+	return ok && f.Failing()
+}
+
+// activer forward which count tunnels or connections in use
+type activer interface {
+	Active() int64
+}
+
+// activeOf return number of tunnels or connections in use of forward, 0 for reject
+func activeOf(forward Forward) int64 {
+	if a, ok := forward.(activer); ok {
+		return a.Active()
+	}
+	return 0
 }
 
 func (f *ForwardClient) Close() {
+	f.cancel()
+	if f.mux != nil {
+		f.mux.Close()
+	}
 	if f.pool != nil {
 		f.pool.Close()
 	}
 }
 
+// Drain stop producing connections, idle connections are closed and mux sessions are closed
+// after their streams finish, connections already taken are closed by their users
+func (f *ForwardClient) Drain() {
+	f.cancel()
+	if f.mux != nil {
+		f.mux.Drain()
+	}
+	if f.pool != nil {
+		go f.pool.Close()
+	}
+}
+
 func copyHTTPResponse(w http.ResponseWriter, resp *http.Response) {
 	for k, v := range resp.Header {
 		w.Header().Set(k, v[0])
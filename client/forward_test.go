@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+	"through/config"
+)
+
+func TestForwardManger_Update(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// servers are never dialed successfully, producers keep retrying until ctx is done
+	a := config.ProxyServer{Name: "a", Net: "tcp", Addr: "127.0.0.1:1", Insecure: true}
+	b := config.ProxyServer{Name: "b", Net: "tcp", Addr: "127.0.0.1:2", Insecure: true}
+	f, err := NewForwardManger(ctx, []config.ProxyServer{a, b}, nil, &tls.Config{}, "", 1, config.MuxCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldA, _ := f.GetForward("a")
+	oldB, _ := f.GetForward("b")
+
+	// a is changed, b is kept, c is added
+	a.Addr = "127.0.0.1:3"
+	c := config.ProxyServer{Name: "c", Net: "tcp", Addr: "127.0.0.1:4", Insecure: true}
+	if err = f.Update([]config.ProxyServer{a, b, c}, nil, "", 1, config.MuxCfg{}); err != nil {
+		t.Fatal(err)
+	}
+	if fa, _ := f.GetForward("a"); fa == oldA || fa.(*ForwardClient).addr != a.Addr {
+		t.Error("changed server a is not recreated")
+	}
+	if fb, _ := f.GetForward("b"); fb != oldB {
+		t.Error("unchanged server b is recreated")
+	}
+	if _, ok := f.GetForward("c"); !ok {
+		t.Error("new server c not found")
+	}
+	if _, ok := f.GetForward("direct"); !ok {
+		t.Error("direct not found after update")
+	}
+
+	// invalid server fail the whole update
+	bad := config.ProxyServer{Name: "bad", Net: "tcp", Addr: "127.0.0.1:5", CAFile: "/not/exist/ca.crt"}
+	if err = f.Update([]config.ProxyServer{b, bad}, nil, "", 1, config.MuxCfg{}); err == nil {
+		t.Fatal("Update() want error for missing ca")
+	}
+	if _, ok := f.GetForward("c"); !ok {
+		t.Error("server c is removed by failed update")
+	}
+	if err = f.Update(nil, nil, "", 1, config.MuxCfg{}); err == nil {
+		t.Error("Update() want error for no server")
+	}
+}
+
+func TestCheckRules(t *testing.T) {
+	servers := []config.ProxyServer{{Name: "local"}}
+	tests := []struct {
+		rules   []string
+		hasASN  bool
+		wantErr bool
+	}{
+		{[]string{"host-suffix: ad.com, reject", "match-all, forward: local"}, false, false},
+		{[]string{"geo: CN, direct", "match-all, forward: remote"}, false, true},
+		{[]string{"ip-asn: AS4134|4837, direct"}, false, true}, // no asn database
+		{[]string{"ip-asn: AS4134|4837, direct"}, true, false},
+		{[]string{"server-state: local=down, direct"}, false, false},
+		{[]string{"server-state: remote=down, direct"}, false, true},
+	}
+	for _, tt := range tests {
+		rules, err := ParseRules(tt.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = checkRules(rules, servers, nil, tt.hasASN); (err != nil) != tt.wantErr {
+			t.Errorf("checkRules(%v) error = %v, wantErr %v", tt.rules, err, tt.wantErr)
+		}
+	}
+}
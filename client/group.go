@@ -0,0 +1,451 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"through/config"
+	"through/log"
+	"through/proto"
+	"time"
+)
+
+const (
+	GroupTypeUrlTest     = "url-test"     // member with the lowest latency
+	GroupTypeFallback    = "fallback"     // the first alive member
+	GroupTypeSelect      = "select"       // member chosen manually
+	GroupTypeLoadBalance = "load-balance" // connections spread across servers by strategy
+)
+
+const (
+	BalanceRoundRobin        = "round-robin"        // members in turn
+	BalanceLeastActive       = "least-active"       // member with the fewest tunnels in use
+	BalanceConsistentHashing = "consistent-hashing" // same host to the same member
+)
+
+// hashReplicas virtual nodes of each member on hash ring
+const hashReplicas = 100
+
+const (
+	defaultProbeURL      = "http://www.gstatic.com/generate_204"
+	defaultProbeInterval = 300 * time.Second
+	probeTimeout         = 5 * time.Second
+)
+
+// ProxyGroup forward requests to one of its members, members are servers, direct, reject or other groups.
+// members are looked up by name on every request, so a group is kept if only its members change
+type ProxyGroup struct {
+	cfg       config.ProxyGroup
+	lookup    func(name string) (Forward, bool)
+	interval  time.Duration
+	tolerance time.Duration
+	cancel    context.CancelFunc
+
+	current atomic.Value  // name of member in use
+	next    atomic.Uint32 // start of next round-robin
+	ring    []ringNode    // hash ring of consistent-hashing, sorted by hash
+
+	lc     sync.Mutex
+	probes map[string]probeResult // result of the last probe of each member
+}
+
+// probeResult latency of a member, alive is false if the probe failed
+type probeResult struct {
+	delay time.Duration
+	alive bool
+}
+
+// ringNode a virtual node of member on hash ring
+type ringNode struct {
+	hash   uint32
+	member int
+}
+
+// NewProxyGroup check config and new group, lookup find members by name.
+// members are probed after start is called
+func NewProxyGroup(c config.ProxyGroup, lookup func(name string) (Forward, bool)) (g *ProxyGroup, err error) {
+	switch c.Type {
+	case GroupTypeUrlTest, GroupTypeFallback, GroupTypeSelect, GroupTypeLoadBalance:
+	default:
+		return nil, fmt.Errorf("unknown group type %q", c.Type)
+	}
+	if c.Strategy != "" && c.Type != GroupTypeLoadBalance {
+		return nil, errors.New("strategy is only for load-balance group")
+	}
+	if len(c.Servers) == 0 {
+		return nil, errors.New("servers of group is required")
+	}
+	members := map[string]bool{}
+	for _, name := range c.Servers {
+		if members[name] {
+			return nil, fmt.Errorf("server %v is duplicated", name)
+		}
+		members[name] = true
+	}
+
+	g = &ProxyGroup{
+		cfg:       c,
+		lookup:    lookup,
+		interval:  time.Duration(c.Interval) * time.Second,
+		tolerance: time.Duration(c.Tolerance) * time.Millisecond,
+		probes:    map[string]probeResult{},
+	}
+	if g.cfg.URL == "" {
+		g.cfg.URL = defaultProbeURL
+	}
+	if g.interval <= 0 {
+		g.interval = defaultProbeInterval
+	}
+	if c.Type == GroupTypeLoadBalance {
+		switch g.cfg.Strategy {
+		case "":
+			g.cfg.Strategy = BalanceRoundRobin
+		case BalanceRoundRobin, BalanceLeastActive:
+		case BalanceConsistentHashing:
+			g.ring = newHashRing(c.Servers)
+		default:
+			return nil, fmt.Errorf("unknown load-balance strategy %q", c.Strategy)
+		}
+	}
+
+	current := c.Servers[0]
+	if c.Selected != "" {
+		if c.Type != GroupTypeSelect {
+			return nil, errors.New("selected is only for select group")
+		}
+		if !members[c.Selected] {
+			return nil, fmt.Errorf("selected %v is not a member", c.Selected)
+		}
+		current = c.Selected
+	}
+	g.current.Store(current)
+	return
+}
+
+// start probe members until ctx is done or group is closed,
+// select group is never probed, load-balance group use the state of connection pools
+func (g *ProxyGroup) start(ctx context.Context) {
+	if g.cfg.Type == GroupTypeSelect || g.cfg.Type == GroupTypeLoadBalance {
+		return
+	}
+	ctx, g.cancel = context.WithCancel(ctx)
+	go g.run(ctx)
+}
+
+func (g *ProxyGroup) run(ctx context.Context) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		g.probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe measure latency of all members concurrently, and choose the member to use
+func (g *ProxyGroup) probe(ctx context.Context) {
+	results := make([]probeResult, len(g.cfg.Servers))
+	var wg sync.WaitGroup
+	for i, name := range g.cfg.Servers {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i] = g.probeMember(ctx, name)
+		}(i, name)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	g.lc.Lock()
+	defer g.lc.Unlock()
+	for i, name := range g.cfg.Servers {
+		g.probes[name] = results[i]
+	}
+	if next := g.choose(); next != g.Current() {
+		log.Infof("group %v switch from %v to %v", g.cfg.Name, g.Current(), next)
+		g.current.Store(next)
+	}
+}
+
+// probeMember request url through member, the latency is the time until response header is received
+func (g *ProxyGroup) probeMember(ctx context.Context, name string) (r probeResult) {
+	forward, ok := g.lookup(name)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return forward.Dial(ctx, &proto.Meta{Net: "tcp", Address: addr})
+		},
+		DisableKeepAlives: true,
+	}}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.cfg.URL, nil)
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Debugf("group %v probe %v error: %v", g.cfg.Name, name, err)
+		return
+	}
+	_ = resp.Body.Close()
+	return probeResult{delay: time.Since(start), alive: true}
+}
+
+// choose member by probe results, the current one is kept if all members are dead
+func (g *ProxyGroup) choose() string {
+	current := g.Current()
+	switch g.cfg.Type {
+	case GroupTypeUrlTest:
+		best := ""
+		for _, name := range g.cfg.Servers {
+			if r := g.probes[name]; r.alive && (best == "" || r.delay < g.probes[best].delay) {
+				best = name
+			}
+		}
+		if best == "" {
+			return current
+		}
+		if r := g.probes[current]; r.alive && r.delay <= g.probes[best].delay+g.tolerance {
+			return current
+		}
+		return best
+	case GroupTypeFallback:
+		for _, name := range g.cfg.Servers {
+			if g.probes[name].alive {
+				return name
+			}
+		}
+	}
+	return current
+}
+
+// Current return name of member in use
+func (g *ProxyGroup) Current() string {
+	return g.current.Load().(string)
+}
+
+// Info return state of group
+func (g *ProxyGroup) Info() GroupInfo {
+	info := GroupInfo{Name: g.cfg.Name, Type: g.cfg.Type, Strategy: g.cfg.Strategy, Servers: g.cfg.Servers}
+	if g.cfg.Type != GroupTypeLoadBalance {
+		info.Current = g.Current()
+	}
+	return info
+}
+
+// Select change the member of select group
+func (g *ProxyGroup) Select(name string) error {
+	if g.cfg.Type != GroupTypeSelect {
+		return fmt.Errorf("group %v is not a select group", g.cfg.Name)
+	}
+	for _, s := range g.cfg.Servers {
+		if s == name {
+			log.Infof("group %v select %v", g.cfg.Name, name)
+			g.current.Store(name)
+			return nil
+		}
+	}
+	return fmt.Errorf("%v is not a member of group %v", name, g.cfg.Name)
+}
+
+// pick return forward of member for address
+func (g *ProxyGroup) pick(addr string) (Forward, error) {
+	if g.cfg.Type == GroupTypeLoadBalance {
+		return g.balance(addr)
+	}
+	name := g.Current()
+	forward, ok := g.lookup(name)
+	if ok && g.cfg.Type != GroupTypeSelect && isFailing(forward) {
+		if name = g.failover(name); name != "" {
+			forward, ok = g.lookup(name)
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("member %v of group %v not found", name, g.cfg.Name)
+	}
+	return forward, nil
+}
+
+// Active return number of tunnels in use of the member in use, or of all members for load-balance group
+func (g *ProxyGroup) Active() (n int64) {
+	if g.cfg.Type == GroupTypeLoadBalance {
+		for _, name := range g.cfg.Servers {
+			if forward, ok := g.lookup(name); ok {
+				n += activeOf(forward)
+			}
+		}
+		return
+	}
+	if forward, err := g.pick(""); err == nil {
+		n = activeOf(forward)
+	}
+	return
+}
+
+// Failing return true if the member in use is failing after failover,
+// or all members are failing for load-balance group
+func (g *ProxyGroup) Failing() bool {
+	if g.cfg.Type == GroupTypeLoadBalance {
+		for _, name := range g.cfg.Servers {
+			if forward, ok := g.lookup(name); ok && !isFailing(forward) {
+				return false
+			}
+		}
+		return true
+	}
+	forward, err := g.pick("")
+	return err != nil || isFailing(forward)
+}
+
+// failover switch away from member which is failing or down without waiting for next probe,
+// the first member not failing and not failed in last probe is used. return the member in use
+func (g *ProxyGroup) failover(down string) string {
+	g.lc.Lock()
+	defer g.lc.Unlock()
+	if current := g.Current(); current != down {
+		return current
+	}
+	for _, name := range g.cfg.Servers {
+		if r, probed := g.probes[name]; name == down || (probed && !r.alive) {
+			continue
+		}
+		if forward, ok := g.lookup(name); ok && !isFailing(forward) {
+			log.Infof("group %v switch from %v to %v, %v is failing", g.cfg.Name, down, name, down)
+			g.current.Store(name)
+			return name
+		}
+	}
+	return down
+}
+
+// balance choose a member of load-balance group by strategy, members failing to connect are skipped,
+// unless all of them are failing
+func (g *ProxyGroup) balance(addr string) (Forward, error) {
+	n := len(g.cfg.Servers)
+	members := make([]Forward, n)
+	alive := make([]bool, n)
+	anyAlive := false
+	for i, name := range g.cfg.Servers {
+		if forward, ok := g.lookup(name); ok {
+			members[i] = forward
+			alive[i] = !isFailing(forward)
+			anyAlive = anyAlive || alive[i]
+		}
+	}
+	if !anyAlive {
+		for i := range alive {
+			alive[i] = members[i] != nil
+		}
+	}
+
+	best := -1
+	switch g.cfg.Strategy {
+	case BalanceConsistentHashing:
+		host := addr
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			host = h
+		}
+		best = g.hashMember(host, alive)
+	case BalanceLeastActive:
+		start := int(g.next.Add(1)) % n
+		for k := 0; k < n; k++ {
+			if i := (start + k) % n; alive[i] && (best < 0 || activeOf(members[i]) < activeOf(members[best])) {
+				best = i
+			}
+		}
+	default:
+		start := int(g.next.Add(1)) % n
+		for k := 0; k < n && best < 0; k++ {
+			if i := (start + k) % n; alive[i] {
+				best = i
+			}
+		}
+	}
+	if best < 0 {
+		return nil, fmt.Errorf("no server of group %v found", g.cfg.Name)
+	}
+	return members[best], nil
+}
+
+func newHashRing(members []string) (ring []ringNode) {
+	for i, name := range members {
+		for r := 0; r < hashReplicas; r++ {
+			ring = append(ring, ringNode{hash: crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(r))), member: i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return
+}
+
+// hashMember return the first alive member clockwise from hash of host on ring, -1 if none
+func (g *ProxyGroup) hashMember(host string, alive []bool) int {
+	h := crc32.ChecksumIEEE([]byte(host))
+	start := sort.Search(len(g.ring), func(i int) bool {
+		return g.ring[i].hash >= h
+	})
+	for k := 0; k < len(g.ring); k++ {
+		if node := g.ring[(start+k)%len(g.ring)]; alive[node.member] {
+			return node.member
+		}
+	}
+	return -1
+}
+
+func (g *ProxyGroup) Http(writer http.ResponseWriter, request *http.Request) {
+	forward, err := g.pick(request.Host)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadGateway)
+		return
+	}
+	forward.Http(writer, request)
+}
+
+func (g *ProxyGroup) Dial(ctx context.Context, meta *proto.Meta) (remote net.Conn, err error) {
+	forward, err := g.pick(meta.GetAddress())
+	if err != nil {
+		return
+	}
+	return forward.Dial(ctx, meta)
+}
+
+func (g *ProxyGroup) Relay(meta *proto.Meta) (relay UdpRelay, err error) {
+	forward, err := g.pick(meta.GetAddress())
+	if err != nil {
+		return
+	}
+	return forward.Relay(meta)
+}
+
+func (g *ProxyGroup) Bind(meta *proto.Meta) (binding Binding, err error) {
+	forward, err := g.pick(meta.GetAddress())
+	if err != nil {
+		return
+	}
+	return forward.Bind(meta)
+}
+
+// Close stop probing, members are closed by ForwardManger
+func (g *ProxyGroup) Close() {
+	if g.cancel != nil {
+		g.cancel()
+	}
+}
@@ -0,0 +1,389 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"through/config"
+	"through/proto"
+	"time"
+)
+
+// delayForward dial directly after delay, or fail if dead
+type delayForward struct {
+	DirectClient
+	delay time.Duration
+	dead  bool
+}
+
+func (d *delayForward) Dial(ctx context.Context, meta *proto.Meta) (net.Conn, error) {
+	if d.dead {
+		return nil, errors.New("dead")
+	}
+	time.Sleep(d.delay)
+	return d.DirectClient.Dial(ctx, meta)
+}
+
+func TestProxyGroup_Probe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	members := map[string]Forward{
+		"dead": &delayForward{dead: true},
+		"slow": &delayForward{delay: 200 * time.Millisecond},
+		"fast": &delayForward{},
+	}
+	lookup := func(name string) (f Forward, ok bool) {
+		f, ok = members[name]
+		return
+	}
+	servers := []string{"dead", "slow", "fast"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	urlTest, err := NewProxyGroup(config.ProxyGroup{Name: "auto", Type: GroupTypeUrlTest, Servers: servers, URL: ts.URL}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := urlTest.Current(); got != "dead" {
+		t.Errorf("Current() before probe = %v, want the first member", got)
+	}
+	urlTest.probe(ctx)
+	if got := urlTest.Current(); got != "fast" {
+		t.Errorf("url-test Current() = %v, want fast", got)
+	}
+	// slow is kept while it's within tolerance
+	urlTest.current.Store("slow")
+	urlTest.tolerance = time.Second
+	urlTest.probe(ctx)
+	if got := urlTest.Current(); got != "slow" {
+		t.Errorf("url-test Current() with tolerance = %v, want slow", got)
+	}
+
+	fallback, err := NewProxyGroup(config.ProxyGroup{Name: "fb", Type: GroupTypeFallback, Servers: servers, URL: ts.URL}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback.probe(ctx)
+	if got := fallback.Current(); got != "slow" {
+		t.Errorf("fallback Current() = %v, want slow", got)
+	}
+	members["slow"].(*delayForward).dead = true
+	fallback.probe(ctx)
+	if got := fallback.Current(); got != "fast" {
+		t.Errorf("fallback Current() = %v, want fast", got)
+	}
+	if err = fallback.Select("dead"); err == nil {
+		t.Error("Select() want error for fallback group")
+	}
+}
+
+func TestProxyGroup_Select(t *testing.T) {
+	members := map[string]Forward{"direct": &DirectClient{}, "reject": &RejectClient{}}
+	lookup := func(name string) (f Forward, ok bool) {
+		f, ok = members[name]
+		return
+	}
+	g, err := NewProxyGroup(config.ProxyGroup{Name: "s", Type: GroupTypeSelect, Servers: []string{"direct", "reject"}, Selected: "reject"}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = g.Dial(context.Background(), &proto.Meta{Net: "tcp", Address: "127.0.0.1:1"}); !errors.Is(err, RejectError) {
+		t.Errorf("Dial() error = %v, want RejectError", err)
+	}
+	if err = g.Select("other"); err == nil {
+		t.Error("Select() want error for unknown member")
+	}
+	if err = g.Select("direct"); err != nil || g.Current() != "direct" {
+		t.Errorf("Select() = %v, Current() = %v", err, g.Current())
+	}
+
+	bad := []config.ProxyGroup{
+		{Name: "type", Type: "round-robin", Servers: []string{"direct"}},
+		{Name: "empty", Type: GroupTypeSelect},
+		{Name: "dup", Type: GroupTypeSelect, Servers: []string{"direct", "direct"}},
+		{Name: "selected", Type: GroupTypeSelect, Servers: []string{"direct"}, Selected: "reject"},
+		{Name: "url-test", Type: GroupTypeUrlTest, Servers: []string{"direct"}, Selected: "direct"},
+	}
+	for _, c := range bad {
+		if _, err = NewProxyGroup(c, lookup); err == nil {
+			t.Errorf("NewProxyGroup(%v) want error", c.Name)
+		}
+	}
+}
+
+func TestForwardManger_UpdateGroups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := config.ProxyServer{Name: "a", Net: "tcp", Addr: "127.0.0.1:1", Insecure: true}
+	sel := config.ProxyGroup{Name: "sel", Type: GroupTypeSelect, Servers: []string{"a", "direct"}}
+	outer := config.ProxyGroup{Name: "outer", Type: GroupTypeFallback, Servers: []string{"sel", "reject"}, URL: "http://127.0.0.1:1/"}
+	f, err := NewForwardManger(ctx, []config.ProxyServer{a}, []config.ProxyGroup{sel, outer}, &tls.Config{}, "", 1, config.MuxCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, ok := f.GetForward("sel")
+	if !ok {
+		t.Fatal("group sel not found")
+	}
+	if err = g.(*ProxyGroup).Select("direct"); err != nil {
+		t.Fatal(err)
+	}
+
+	// unchanged group keep its selection
+	if err = f.Update([]config.ProxyServer{a}, []config.ProxyGroup{sel, outer}, "", 1, config.MuxCfg{}); err != nil {
+		t.Fatal(err)
+	}
+	if g2, _ := f.GetForward("sel"); g2 != g || g2.(*ProxyGroup).Current() != "direct" {
+		t.Error("unchanged group is recreated")
+	}
+
+	bad := [][]config.ProxyGroup{
+		{outer, sel}, // used before defined
+		{{Name: "a", Type: GroupTypeSelect, Servers: []string{"direct"}}},
+		{{Name: "direct", Type: GroupTypeSelect, Servers: []string{"a"}}},
+		{{Name: "x", Type: GroupTypeSelect, Servers: []string{"missing"}}},
+		{{Name: "x", Type: GroupTypeSelect, Servers: []string{"x"}}},
+	}
+	for _, groups := range bad {
+		if err = f.Update([]config.ProxyServer{a}, groups, "", 1, config.MuxCfg{}); err == nil {
+			t.Errorf("Update(%+v) want error", groups)
+		}
+	}
+	if g2, _ := f.GetForward("sel"); g2 != g {
+		t.Error("group is replaced by failed update")
+	}
+
+	// members of load-balance group can be any forward
+	lb := config.ProxyGroup{Name: "lb", Type: GroupTypeLoadBalance, Servers: []string{"a", "direct", "sel"}}
+	if err = f.Update([]config.ProxyServer{a}, []config.ProxyGroup{sel, lb}, "", 1, config.MuxCfg{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Update([]config.ProxyServer{a}, nil, "", 1, config.MuxCfg{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = f.GetForward("sel"); ok {
+		t.Error("removed group still found")
+	}
+}
+
+func TestProxyGroup_LoadBalance(t *testing.T) {
+	members := map[string]Forward{}
+	var names []string
+	for _, name := range []string{"a", "b", "c"} {
+		members[name] = &ForwardClient{addr: name, pool: &ConnectionPool{pool: make(chan net.Conn, 1)}}
+		names = append(names, name)
+	}
+	lookup := func(name string) (f Forward, ok bool) {
+		f, ok = members[name]
+		return
+	}
+	pool := func(name string) *ConnectionPool {
+		return members[name].(*ForwardClient).pool
+	}
+	pickName := func(g *ProxyGroup, addr string) string {
+		f, err := g.pick(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f.(*ForwardClient).addr
+	}
+
+	rr, err := NewProxyGroup(config.ProxyGroup{Name: "rr", Type: GroupTypeLoadBalance, Servers: names}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := map[string]int{}
+	for i := 0; i < 30; i++ {
+		count[pickName(rr, "example.com:443")]++
+	}
+	if count["a"] != 10 || count["b"] != 10 || count["c"] != 10 {
+		t.Errorf("round-robin picks %v, want 10 each", count)
+	}
+	pool("b").failures.Store(1)
+	for i := 0; i < 10; i++ {
+		if got := pickName(rr, "example.com:443"); got == "b" {
+			t.Fatal("round-robin picks failing member b")
+		}
+	}
+	pool("a").failures.Store(1)
+	pool("c").failures.Store(1)
+	if _, err = rr.pick("example.com:443"); err != nil {
+		t.Errorf("pick() = %v, want a member when all are failing", err)
+	}
+	for _, name := range names {
+		pool(name).failures.Store(0)
+	}
+
+	least, err := NewProxyGroup(config.ProxyGroup{Name: "least", Type: GroupTypeLoadBalance, Servers: names, Strategy: BalanceLeastActive}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool("a").active.Store(3)
+	pool("b").active.Store(1)
+	pool("c").active.Store(2)
+	for i := 0; i < 5; i++ {
+		if got := pickName(least, "example.com:443"); got != "b" {
+			t.Errorf("least-active picks %v, want b", got)
+		}
+	}
+	conn := pool("b").track(&net.TCPConn{})
+	_ = conn.Close()
+	_ = conn.Close()
+	if got := pool("b").Active(); got != 1 {
+		t.Errorf("Active() after close = %v, want 1", got)
+	}
+
+	hash, err := NewProxyGroup(config.ProxyGroup{Name: "hash", Type: GroupTypeLoadBalance, Servers: names, Strategy: BalanceConsistentHashing}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	picked := map[string]string{}
+	count = map[string]int{}
+	for i := 0; i < 300; i++ {
+		host := fmt.Sprintf("site%d.example.com", i)
+		picked[host] = pickName(hash, host+":443")
+		count[picked[host]]++
+		if got := pickName(hash, host+":80"); got != picked[host] {
+			t.Fatalf("host %v picks %v and %v", host, picked[host], got)
+		}
+	}
+	if len(count) != 3 {
+		t.Errorf("consistent-hashing picks %v, want all members", count)
+	}
+	// only hosts of the failing member move
+	pool("c").failures.Store(1)
+	for host, was := range picked {
+		if got := pickName(hash, host); got == "c" || (was != "c" && got != was) {
+			t.Fatalf("host %v moves from %v to %v", host, was, got)
+		}
+	}
+
+	bad := []config.ProxyGroup{
+		{Name: "strategy", Type: GroupTypeLoadBalance, Servers: names, Strategy: "random"},
+		{Name: "not-lb", Type: GroupTypeSelect, Servers: names, Strategy: BalanceRoundRobin},
+	}
+	for _, c := range bad {
+		if _, err = NewProxyGroup(c, lookup); err == nil {
+			t.Errorf("NewProxyGroup(%v) want error", c.Name)
+		}
+	}
+}
+
+func TestProxyGroup_LoadBalanceMembers(t *testing.T) {
+	corp, err := NewUpstreamClient(config.ProxyServer{Name: "corp", Net: UpstreamHttp, Addr: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := &countRelayForward{}, &countRelayForward{}
+	members := map[string]Forward{"x": x, "y": y, "corp": corp}
+	lookup := func(name string) (f Forward, ok bool) {
+		f, ok = members[name]
+		return
+	}
+	if members["inner"], err = NewProxyGroup(config.ProxyGroup{Name: "inner", Type: GroupTypeSelect, Servers: []string{"y"}}, lookup); err != nil {
+		t.Fatal(err)
+	}
+
+	least, err := NewProxyGroup(config.ProxyGroup{Name: "least", Type: GroupTypeLoadBalance, Servers: []string{"x", "inner", "corp"}, Strategy: BalanceLeastActive}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.active.Store(2)
+	y.active.Store(1)
+	corp.active.Store(3)
+	if f, err := least.pick("example.com:443"); err != nil || f != members["inner"] {
+		t.Errorf("least-active picks %v, %v, want inner", f, err)
+	}
+	if got := least.Active(); got != 6 {
+		t.Errorf("Active() = %v, want 6", got)
+	}
+	// failing proxy is skipped even if it's the least active
+	corp.active.Store(0)
+	for i := 0; i < downFailures; i++ {
+		_, _ = corp.Dial(context.Background(), &proto.Meta{Net: "tcp", Address: "example.com:443"})
+	}
+	if f, err := least.pick("example.com:443"); err != nil || f == corp {
+		t.Errorf("least-active picks %v, %v, want a member not failing", f, err)
+	}
+
+	// udp associations are hashed by their first destination
+	hash, err := NewProxyGroup(config.ProxyGroup{Name: "hash", Type: GroupTypeLoadBalance, Servers: []string{"x", "inner"}, Strategy: BalanceConsistentHashing}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		meta := &proto.Meta{Net: proto.NetUDP, Address: fmt.Sprintf("site%d.example.com:53", i)}
+		before := x.relays.Load()
+		relay, err := hash.Relay(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = relay.Close()
+		if f, _ := hash.pick(meta.GetAddress()); (f == x) != (x.relays.Load() > before) {
+			t.Fatalf("relay of %v is not created by the member of its host", meta.GetAddress())
+		}
+	}
+	if x.relays.Load() == 0 || y.relays.Load() == 0 {
+		t.Errorf("relays created by x %d, y %d, want both members", x.relays.Load(), y.relays.Load())
+	}
+}
+
+func TestProxyGroup_NestedFailing(t *testing.T) {
+	corp, err := NewUpstreamClient(config.ProxyServer{Name: "corp", Net: UpstreamHttp, Addr: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < downFailures; i++ {
+		_, _ = corp.Dial(context.Background(), &proto.Meta{Net: "tcp", Address: "example.com:443"})
+	}
+	if !corp.Failing() {
+		t.Error("Failing() = false while proxy can't be connected")
+	}
+
+	members := map[string]Forward{
+		"a":    &ForwardClient{addr: "a", pool: &ConnectionPool{pool: make(chan net.Conn, 1)}},
+		"b":    &ForwardClient{addr: "b", pool: &ConnectionPool{pool: make(chan net.Conn, 1)}},
+		"corp": corp,
+	}
+	lookup := func(name string) (f Forward, ok bool) {
+		f, ok = members[name]
+		return
+	}
+	members["a"].(*ForwardClient).pool.failures.Store(1)
+	for _, c := range []config.ProxyGroup{
+		{Name: "inner", Type: GroupTypeFallback, Servers: []string{"a"}},
+		{Name: "lb", Type: GroupTypeLoadBalance, Servers: []string{"a"}},
+		{Name: "outer", Type: GroupTypeFallback, Servers: []string{"inner", "lb", "corp", "b"}},
+	} {
+		if members[c.Name], err = NewProxyGroup(c, lookup); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// failing group and proxy members are skipped
+	outer := members["outer"].(*ProxyGroup)
+	if f, err := outer.pick(""); err != nil || f != members["b"] {
+		t.Errorf("pick() = %v, %v, want b", f, err)
+	}
+	if outer.Failing() {
+		t.Error("Failing() = true while b is alive")
+	}
+	members["b"].(*ForwardClient).pool.failures.Store(1)
+	if !outer.Failing() {
+		t.Error("Failing() = false while all members are failing")
+	}
+	members["a"].(*ForwardClient).pool.failures.Store(0)
+	if members["inner"].(*ProxyGroup).Failing() || members["lb"].(*ProxyGroup).Failing() {
+		t.Error("Failing() of group = true after a recovered")
+	}
+}
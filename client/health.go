@@ -0,0 +1,165 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"through/log"
+	"time"
+)
+
+var (
+	ServerDown = errors.New("server is down")
+)
+
+type HealthState string
+
+const (
+	HealthHealthy  HealthState = "healthy"  // handshakes and tunnels succeed
+	HealthDegraded HealthState = "degraded" // some tunnels fail, or probe is slow
+	HealthDown     HealthState = "down"     // consecutive failures, tunnels fail fast until a probe succeed
+)
+
+const (
+	// healthWindow number of recent results the error rate is computed from
+	healthWindow = 20
+	// healthMinSamples results needed before error rate count
+	healthMinSamples = 5
+	// degradedErrorRate error rate in window to mark server degraded
+	degradedErrorRate = 0.2
+	// downFailures consecutive failures to mark server down and open the circuit
+	downFailures = 3
+	// degradedRTT probe round trip slower than this mark server degraded
+	degradedRTT = time.Second
+	// healthCheckInterval how often server is probed, downCheckInterval while it's down
+	healthCheckInterval = 10 * time.Second
+	downCheckInterval   = 2 * time.Second
+)
+
+// health state of a server, driven by handshakes, probes and tunnel opens
+type health struct {
+	logger *log.Logger
+	state  atomic.Value // HealthState
+
+	lc       sync.Mutex
+	results  [healthWindow]bool // ring of recent results, true is failure
+	count    int                // results in ring
+	pos      int                // next position of ring
+	failures int                // consecutive failures
+	rtt      time.Duration      // round trip of the last probe
+	lastErr  error
+	since    time.Time // when state changed
+}
+
+// HealthStats snapshot of server health
+type HealthStats struct {
+	State     HealthState `json:"state"`
+	Since     time.Time   `json:"since"`
+	RTT       int64       `json:"rttMs"`
+	ErrorRate float64     `json:"errorRate"`
+	Failures  int         `json:"failures"`
+	LastError string      `json:"lastError,omitempty"`
+}
+
+func newHealth(logger *log.Logger) *health {
+	h := &health{logger: logger, since: time.Now()}
+	h.state.Store(HealthHealthy)
+	return h
+}
+
+// State return current state, nil health is always healthy
+func (h *health) State() HealthState {
+	if h == nil {
+		return HealthHealthy
+	}
+	return h.state.Load().(HealthState)
+}
+
+// success record a handshake, probe or tunnel succeeded, rtt is 0 if not measured
+func (h *health) success(rtt time.Duration) {
+	h.lc.Lock()
+	defer h.lc.Unlock()
+	h.add(false)
+	h.failures = 0
+	if rtt > 0 {
+		h.rtt = rtt
+	}
+	h.update()
+}
+
+// failure record a handshake, probe or tunnel failed
+func (h *health) failure(err error) {
+	h.lc.Lock()
+	defer h.lc.Unlock()
+	h.add(true)
+	h.failures++
+	h.lastErr = err
+	h.update()
+}
+
+func (h *health) add(failed bool) {
+	h.results[h.pos] = failed
+	h.pos = (h.pos + 1) % healthWindow
+	if h.count < healthWindow {
+		h.count++
+	}
+}
+
+func (h *health) errorRate() float64 {
+	if h.count == 0 {
+		return 0
+	}
+	failed := 0
+	for i := 0; i < h.count; i++ {
+		if h.results[i] {
+			failed++
+		}
+	}
+	return float64(failed) / float64(h.count)
+}
+
+// update compute state from results, lock must be held
+func (h *health) update() {
+	state := HealthHealthy
+	if h.failures >= downFailures {
+		state = HealthDown
+	} else if (h.count >= healthMinSamples && h.errorRate() >= degradedErrorRate) || h.rtt > degradedRTT {
+		state = HealthDegraded
+	}
+	if old := h.State(); old != state {
+		h.since = time.Now()
+		h.state.Store(state)
+		if state == HealthDown {
+			h.logger.Warnf("server is down after %d failures, last error: %v", h.failures, h.lastErr)
+		} else {
+			h.logger.Infof("server health change from %v to %v", old, state)
+		}
+	}
+}
+
+// Stats return a snapshot of health
+func (h *health) Stats() (s HealthStats) {
+	if h == nil {
+		return HealthStats{State: HealthHealthy}
+	}
+	h.lc.Lock()
+	defer h.lc.Unlock()
+	s = HealthStats{
+		State:     h.State(),
+		Since:     h.since,
+		RTT:       h.rtt.Milliseconds(),
+		ErrorRate: h.errorRate(),
+		Failures:  h.failures,
+	}
+	if h.lastErr != nil {
+		s.LastError = h.lastErr.Error()
+	}
+	return
+}
+
+// LastError return the last failure, nil if none
+func (h *health) LastError() error {
+	h.lc.Lock()
+	defer h.lc.Unlock()
+	return h.lastErr
+}
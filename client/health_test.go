@@ -0,0 +1,134 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"through/config"
+	"through/log"
+	"through/proto"
+	"time"
+)
+
+func TestHealth_State(t *testing.T) {
+	h := newHealth(log.NewLogger())
+	failed := errors.New("failed")
+
+	for i := 0; i < healthMinSamples; i++ {
+		h.success(10 * time.Millisecond)
+	}
+	if got := h.State(); got != HealthHealthy {
+		t.Fatalf("State() = %v, want healthy", got)
+	}
+	h.failure(failed)
+	h.failure(failed)
+	if got := h.State(); got != HealthDegraded {
+		t.Errorf("State() with 2 of 7 failed = %v, want degraded", got)
+	}
+	h.failure(failed)
+	if got := h.State(); got != HealthDown {
+		t.Errorf("State() after %d failures = %v, want down", downFailures, got)
+	}
+	if s := h.Stats(); s.Failures != downFailures || s.LastError != "failed" {
+		t.Errorf("Stats() = %+v", s)
+	}
+
+	// recovered, but still degraded until failures leave the window
+	h.success(10 * time.Millisecond)
+	if got := h.State(); got != HealthDegraded {
+		t.Errorf("State() after recovery = %v, want degraded", got)
+	}
+	for i := 0; i < healthWindow; i++ {
+		h.success(10 * time.Millisecond)
+	}
+	if got := h.State(); got != HealthHealthy {
+		t.Errorf("State() = %v, want healthy", got)
+	}
+	h.success(2 * degradedRTT)
+	if got := h.State(); got != HealthDegraded {
+		t.Errorf("State() with slow probe = %v, want degraded", got)
+	}
+}
+
+func TestForwardClient_CircuitBreaker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f, err := NewForwardClient(ctx, config.ProxyServer{Name: "a", Net: "tcp", Addr: "127.0.0.1:1", Insecure: true}, nil, nil, &tls.Config{}, "", 1, config.MuxCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for i := 0; i < downFailures; i++ {
+		f.pool.health.failure(errors.New("refused"))
+	}
+	start := time.Now()
+	if _, err = f.Dial(ctx, &proto.Meta{Net: "tcp", Address: "example.com:80"}); !errors.Is(err, ServerDown) {
+		t.Errorf("Dial() error = %v, want ServerDown", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("Dial() does not fail fast while server is down")
+	}
+	if !f.Failing() {
+		t.Error("Failing() = false while server is down")
+	}
+
+	// fallback group switch away from the down server at once
+	forwards := &ForwardManger{}
+	forwards.forwardClients.Store(&map[string]Forward{"a": f, "direct": &DirectClient{}})
+	g, err := NewProxyGroup(config.ProxyGroup{Name: "fb", Type: GroupTypeFallback, Servers: []string{"a", "direct"}}, forwards.GetForward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forward, err := g.pick(""); err != nil || forward != (*forwards.forwardClients.Load())["direct"] {
+		t.Errorf("pick() = %v, %v, want direct", forward, err)
+	}
+
+	rules, err := ParseRules([]string{"server-state: a=down|degraded, direct", "match-all, forward: a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindForwards(rules, forwards)
+	r := &RuleManager{}
+	r.Update(nil, rules)
+	if got := r.Get(&Metadata{Host: "example.com:80"}); got != "direct" {
+		t.Errorf("Get() = %v, want direct while a is down", got)
+	}
+	for i := 0; i < healthWindow; i++ {
+		f.pool.health.success(0)
+	}
+	if got := r.Get(&Metadata{Host: "example.com:80"}); got != "a" {
+		t.Errorf("Get() = %v, want a after recovery", got)
+	}
+
+	for _, bad := range []string{"server-state: a=up, direct", "server-state: =down, direct", "server-state: a, direct"} {
+		if _, err = NewRule(bad); err == nil {
+			t.Errorf("NewRule(%q) want error", bad)
+		}
+	}
+}
+
+func TestForwardClient_PoolTimeout(t *testing.T) {
+	// server accept but never finish tls handshake, so no dial result is known in time
+	release := make(chan struct{})
+	addr := serveTcp(t, "127.0.0.1:0", func(conn net.Conn) { <-release })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f, err := NewForwardClient(ctx, config.ProxyServer{Name: "a", Net: "tcp", Addr: addr, Insecure: true}, nil, nil, &tls.Config{}, "", 1, config.MuxCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// release producers before closing
+	defer close(release)
+
+	if _, err = f.Dial(ctx, &proto.Meta{Net: "tcp", Address: "example.com:80"}); !errors.Is(err, PoolTimeout) {
+		t.Fatalf("Dial() error = %v, want PoolTimeout", err)
+	}
+	if s := f.Health(); s.Failures != 0 || s.State != HealthHealthy {
+		t.Errorf("Health() = %+v, waiting for pool must not count as failure", s)
+	}
+}
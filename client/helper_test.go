@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"through/config"
+	"through/log"
+	"through/proto"
+	"through/server"
+	"through/util"
+	"time"
+)
+
+// serveTcp accept connections on addr and handle each of them, the connection is closed after handle return.
+// the test is skipped if addr can't be listened, like ipv6 is not available
+func serveTcp(t *testing.T, addr string, handle func(conn net.Conn)) string {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("listen %v error: %v", addr, err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+// echoConn echo data of conn until it's closed
+func echoConn(conn net.Conn) {
+	_, _ = io.Copy(conn, conn)
+}
+
+// echoServer echo data of every connection on addr
+func echoServer(t *testing.T, addr string) string {
+	return serveTcp(t, addr, echoConn)
+}
+
+// portOf return port of addr in host:port
+func portOf(t *testing.T, addr string) uint16 {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint16(p)
+}
+
+// udpEchoServer echo every datagram on 127.0.0.1
+func udpEchoServer(t *testing.T) net.Addr {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], from)
+		}
+	}()
+	return pc.LocalAddr()
+}
+
+// testCertificate self signed certificate of 127.0.0.1
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "through"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serveTls handle every tls connection after tls handshake
+func serveTls(t *testing.T, cert tls.Certificate, handle func(conn *tls.Conn)) string {
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	return serveTcp(t, "127.0.0.1:0", func(conn net.Conn) {
+		tc := tls.Server(conn, cfg)
+		if err := tc.Handshake(); err == nil {
+			handle(tc)
+		}
+	})
+}
+
+// serveHello accept tls connections, reply hello to client, then call handle
+func serveHello(t *testing.T, cert tls.Certificate, hello *proto.Hello, handle func(conn net.Conn)) string {
+	return serveTls(t, cert, func(conn *tls.Conn) {
+		if _, err := proto.ReadHello(conn); err != nil {
+			return
+		}
+		if err := proto.WriteHello(conn, hello); err != nil {
+			return
+		}
+		handle(conn)
+	})
+}
+
+// helloWithout hello of server not advertising capability
+func helloWithout(capability string) *proto.Hello {
+	var caps []string
+	for _, c := range proto.Capabilities {
+		if c != capability {
+			caps = append(caps, c)
+		}
+	}
+	return &proto.Hello{Version: proto.ProtocolVersion, Capabilities: caps}
+}
+
+// fakeHop dial the address in meta like server, and copy data
+func fakeHop(conn net.Conn) {
+	meta, err := proto.ReadMeta(conn)
+	if err != nil {
+		return
+	}
+	remote, err := net.Dial(meta.GetNet(), meta.GetAddress())
+	if err != nil {
+		_ = proto.WriteResponse(conn, proto.NewResponse(err))
+		return
+	}
+	if err = proto.WriteResponse(conn, proto.NewResponse(nil)); err != nil {
+		_ = remote.Close()
+		return
+	}
+	util.CopyLoopWait(remote, conn)
+}
+
+// serveThrough run through server connections with acl on a tls listener
+func serveThrough(t *testing.T, ctx context.Context, aclCfg config.AclCfg) string {
+	if config.Server == nil {
+		config.Server = &config.ServerCfg{}
+	}
+	acl, err := server.NewACL(aclCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveTls(t, testCertificate(t), func(conn *tls.Conn) {
+		server.NewConnection(ctx, conn, acl, nil, log.NewLogger()).Process()
+	})
+}
+
+// waitUntil wait at most 3 seconds for cond
+func waitUntil(cond func() bool) bool {
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
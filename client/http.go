@@ -2,35 +2,53 @@ package client
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
 	"through/log"
 	"through/proto"
+	"through/util"
 )
 
 // HttpProxy http/https proxy
 type HttpProxy struct {
 	forwardManager *ForwardManger
 	ruleManager    *RuleManager
+	auth           *ProxyAuth // nil if auth is disabled
 }
 
-func NewHttpProxy(ctx context.Context, forwards *ForwardManger, rules *RuleManager) (p *HttpProxy) {
+func NewHttpProxy(ctx context.Context, forwards *ForwardManger, rules *RuleManager, users UserStore) (p *HttpProxy) {
 	p = &HttpProxy{
 		forwardManager: forwards,
 		ruleManager:    rules,
 	}
+	if users != nil {
+		p.auth = NewProxyAuth(users)
+	}
 
 	return
 }
 
 func (h *HttpProxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	var user string
+	if h.auth != nil {
+		var ok bool
+		if user, ok = h.auth.Authenticate(request); !ok {
+			log.Infof("http proxy auth failed from %v", request.RemoteAddr)
+			h.auth.Challenge(writer)
+			return
+		}
+	}
+
 	if request.Method == http.MethodConnect {
-		h.https(writer, request)
+		h.https(writer, request, user)
 	} else {
-		h.http(writer, request)
+		h.http(writer, request, user)
 	}
 }
 
-func (h *HttpProxy) https(writer http.ResponseWriter, request *http.Request) {
+func (h *HttpProxy) https(writer http.ResponseWriter, request *http.Request, user string) {
 	hij, ok := writer.(http.Hijacker)
 	if !ok {
 		log.Errorf("httpserver does not support hijacking")
@@ -39,42 +57,74 @@ func (h *HttpProxy) https(writer http.ResponseWriter, request *http.Request) {
 	}
 
 	host := request.URL.Host
-	server := h.ruleManager.Get(host)
+	server := h.ruleManager.Get(&Metadata{Host: host, Source: request.RemoteAddr, Inbound: InboundHttp, User: user})
 	f, ok := h.forwardManager.GetForward(server)
 	if !ok {
-		log.Infof("host %v math no server", host)
+		log.Infof("host %v user %v math no server", host, user)
 		http.Error(writer, "rule match no server", http.StatusServiceUnavailable)
 		return
 	}
-	log.Infof("https host %v math server %v", host, server)
+	log.Infof("https host %v user %v math server %v", host, user, server)
+
+	remote, err := f.Dial(request.Context(), &proto.Meta{Net: "tcp", Address: request.URL.Host})
+	if err != nil {
+		http.Error(writer, err.Error(), httpStatus(err))
+		return
+	}
 
 	proxyClient, _, e := hij.Hijack()
 	if e != nil {
 		log.Infof("cannot hijack connection %v", e)
+		_ = remote.Close()
 		http.Error(writer, "cannot hijack connection "+e.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
 	_, _ = proxyClient.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n"))
 
-	f.Connect(proxyClient, &proto.Meta{Net: "tcp", Address: request.URL.Host})
+	util.CopyLoopWait(proxyClient, remote)
 	return
 }
 
-func (h *HttpProxy) http(writer http.ResponseWriter, request *http.Request) {
+func (h *HttpProxy) http(writer http.ResponseWriter, request *http.Request, user string) {
 	if !request.URL.IsAbs() {
 		http.Error(writer, "This is a proxy server. Does not respond to non-proxy requests.", http.StatusBadRequest)
 		return
 	}
 	host := request.URL.Host
-	server := h.ruleManager.Get(host)
+	server := h.ruleManager.Get(&Metadata{Host: host, Port: urlPort(request.URL), Source: request.RemoteAddr, Inbound: InboundHttp, User: user})
 	f, ok := h.forwardManager.GetForward(server)
 	if !ok {
-		log.Infof("host %v math no server", host)
+		log.Infof("host %v user %v math no server", host, user)
 		http.Error(writer, "rule match no server", http.StatusServiceUnavailable)
 		return
 	}
-	log.Infof("http host %v math server %v", host, server)
+	log.Infof("http host %v user %v math server %v", host, user, server)
 
 	f.Http(writer, request)
 }
+
+// httpStatus map dial error to http status code
+func httpStatus(err error) int {
+	if errors.Is(err, RejectError) {
+		return http.StatusForbidden
+	}
+	switch proto.StatusOf(err) {
+	case proto.Status_NOT_ALLOWED:
+		return http.StatusForbidden
+	case proto.Status_TIMEOUT:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// urlPort return port of url, or the default port of scheme
+func urlPort(u *url.URL) int {
+	if port, err := strconv.Atoi(u.Port()); err == nil {
+		return port
+	}
+	if u.Scheme == "https" {
+		return 443
+	}
+	return 80
+}
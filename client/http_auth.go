@@ -0,0 +1,218 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyAuthRealm = "through"
+	nonceExpire    = 5 * time.Minute
+)
+
+// ProxyAuth verify Proxy-Authorization header with basic or digest scheme,
+// digest is offered only if the user store know plain passwords of all users
+type ProxyAuth struct {
+	users  UserStore
+	digest PasswordStore // nil if plain password of some users is unknown
+	secret []byte
+
+	lc        sync.Mutex
+	counts    map[string]uint64 // last nc of each nonce in use, against replay
+	lastPrune time.Time
+}
+
+func NewProxyAuth(users UserStore) (p *ProxyAuth) {
+	p = &ProxyAuth{users: users, secret: make([]byte, 32), counts: make(map[string]uint64), lastPrune: time.Now()}
+	if allPasswords(users) {
+		p.digest = users.(PasswordStore)
+	}
+	_, _ = rand.Read(p.secret)
+	return
+}
+
+// allPasswords return true if every store know plain passwords, otherwise clients choosing digest
+// can't log in as users of stores with hashed passwords
+func allPasswords(users UserStore) bool {
+	switch s := users.(type) {
+	case MultiUserStore:
+		for _, u := range s {
+			if !allPasswords(u) {
+				return false
+			}
+		}
+		return len(s) > 0
+	case PasswordStore:
+		return true
+	}
+	return false
+}
+
+// Authenticate return the username if request carry valid credentials
+func (p *ProxyAuth) Authenticate(request *http.Request) (user string, ok bool) {
+	scheme, credentials, _ := strings.Cut(request.Header.Get("Proxy-Authorization"), " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		return p.basic(credentials)
+	case "digest":
+		return p.digestAuth(request, credentials)
+	}
+	return "", false
+}
+
+// Challenge write 407 response with supported schemes
+func (p *ProxyAuth) Challenge(writer http.ResponseWriter) {
+	writer.Header().Add("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", proxyAuthRealm))
+	if p.digest != nil {
+		writer.Header().Add("Proxy-Authenticate", fmt.Sprintf("Digest realm=%q, qop=\"auth\", algorithm=MD5, nonce=%q", proxyAuthRealm, p.nonce(time.Now())))
+	}
+	http.Error(writer, "proxy authentication required", http.StatusProxyAuthRequired)
+}
+
+func (p *ProxyAuth) basic(credentials string) (user string, ok bool) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return
+	}
+	user, password, found := strings.Cut(string(raw), ":")
+	if !found || !p.users.Authenticate(user, password) {
+		return "", false
+	}
+	return user, true
+}
+
+func (p *ProxyAuth) digestAuth(request *http.Request, credentials string) (user string, ok bool) {
+	if p.digest == nil {
+		return
+	}
+
+	params := parseDigestParams(credentials)
+	if params["realm"] != proxyAuthRealm || !p.validNonce(params["nonce"]) || !digestURI(request, params["uri"]) {
+		return
+	}
+	if alg := params["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return
+	}
+	password, found := p.digest.Password(params["username"])
+	if !found {
+		return
+	}
+
+	ha1 := md5Hex(params["username"] + ":" + proxyAuthRealm + ":" + password)
+	ha2 := md5Hex(request.Method + ":" + params["uri"])
+	var expect string
+	var nc uint64
+	switch params["qop"] {
+	case "auth":
+		var err error
+		if nc, err = strconv.ParseUint(params["nc"], 16, 64); err != nil || nc == 0 {
+			return
+		}
+		expect = md5Hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":"))
+	case "":
+		expect = md5Hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+	default:
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(expect), []byte(params["response"])) != 1 || !p.count(params["nonce"], nc) {
+		return
+	}
+	return params["username"], true
+}
+
+// digestURI return true if uri of digest is the request target, in absolute or origin form
+func digestURI(request *http.Request, uri string) bool {
+	target := request.RequestURI
+	if target == "" {
+		target = request.URL.String()
+		if request.Method == http.MethodConnect {
+			target = request.Host
+		}
+	}
+	return uri != "" && (uri == target || (request.Method != http.MethodConnect && uri == request.URL.RequestURI()))
+}
+
+// count record nc of nonce, return false if it's not greater than the last one.
+// without qop nc is 0, then the nonce can be used only once
+func (p *ProxyAuth) count(nonce string, nc uint64) bool {
+	p.lc.Lock()
+	defer p.lc.Unlock()
+	if time.Since(p.lastPrune) > nonceExpire {
+		p.lastPrune = time.Now()
+		for n := range p.counts {
+			if !p.validNonce(n) {
+				delete(p.counts, n)
+			}
+		}
+	}
+	if last, ok := p.counts[nonce]; ok && nc <= last {
+		return false
+	}
+	p.counts[nonce] = nc
+	return true
+}
+
+// nonce is issue time signed by secret, so it is verified without being stored
+func (p *ProxyAuth) nonce(t time.Time) string {
+	b := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(b, uint64(t.Unix()))
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b))
+}
+
+func (p *ProxyAuth) validNonce(nonce string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	if time.Since(issued) > nonceExpire {
+		return false
+	}
+	return hmac.Equal([]byte(p.nonce(issued)), []byte(nonce))
+}
+
+// parseDigestParams parse key=value pairs of digest credentials, value may be quoted
+func parseDigestParams(s string) (params map[string]string) {
+	params = make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimLeft(s, " ,") {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return
+			}
+			value, s = rest[1:end+1], rest[end+2:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+	return
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"through/config"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestProxyAuth_Authenticate(t *testing.T) {
+	p := NewProxyAuth(NewStaticUserStore([]config.User{{Username: "alice", Password: "alice-pwd"}}))
+
+	digestUri := func(password, nonce, nc, uri string) string {
+		ha1 := md5Hex("alice:" + proxyAuthRealm + ":" + password)
+		ha2 := md5Hex("CONNECT:" + uri)
+		resp := md5Hex(ha1 + ":" + nonce + ":" + nc + ":0a4f113b:auth:" + ha2)
+		return fmt.Sprintf(`Digest username="alice", realm="%s", nonce="%s", uri="%s", qop=auth, nc=%s, cnonce="0a4f113b", response="%s"`,
+			proxyAuthRealm, nonce, uri, nc, resp)
+	}
+	digest := func(password, nonce string) string {
+		return digestUri(password, nonce, "00000001", "example.com:443")
+	}
+	nonce := p.nonce(time.Now())
+
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{"empty", "", false},
+		{"basic", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:alice-pwd")), true},
+		{"basic wrong", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wrong")), false},
+		{"digest", digest("alice-pwd", nonce), true},
+		{"digest wrong", digest("wrong", nonce), false},
+		{"digest forged nonce", digest("alice-pwd", "AAAAAAAAAAA"), false},
+		{"digest replay", digest("alice-pwd", nonce), false},
+		{"digest next nc", digestUri("alice-pwd", nonce, "00000002", "example.com:443"), true},
+		{"digest old nc", digestUri("alice-pwd", nonce, "00000002", "example.com:443"), false},
+		{"digest other uri", digestUri("alice-pwd", nonce, "00000003", "other.com:443"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+			request.Header.Set("Proxy-Authorization", tt.header)
+			user, ok := p.Authenticate(request)
+			if ok != tt.want || (ok && user != "alice") {
+				t.Errorf("Authenticate() = %v, %v, want %v", user, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyAuth_Challenge(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	hash, err := bcrypt.GenerateFromPassword([]byte("bob-pwd"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(file, []byte("bob:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	htpasswd, err := NewHtpasswdUserStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	static := NewStaticUserStore([]config.User{{Username: "alice", Password: "alice-pwd"}})
+
+	tests := []struct {
+		name  string
+		users UserStore
+		want  int
+	}{
+		{"static", static, 2},
+		{"htpasswd", htpasswd, 1},
+		{"htpasswd only multi", MultiUserStore{htpasswd}, 1},
+		{"mixed multi", MultiUserStore{static, htpasswd}, 1},
+		{"static only multi", MultiUserStore{static}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			NewProxyAuth(tt.users).Challenge(w)
+			if got := len(w.Header().Values("Proxy-Authenticate")); got != tt.want {
+				t.Errorf("Proxy-Authenticate = %v, want %d schemes", w.Header().Values("Proxy-Authenticate"), tt.want)
+			}
+		})
+	}
+
+	// htpasswd users of mixed store log in with basic
+	request, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	request.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("bob:bob-pwd")))
+	if user, ok := NewProxyAuth(MultiUserStore{static, htpasswd}).Authenticate(request); !ok || user != "bob" {
+		t.Errorf("Authenticate() = %v, %v, want bob", user, ok)
+	}
+}
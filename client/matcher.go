@@ -0,0 +1,282 @@
+package client
+
+import (
+	"math/bits"
+	"net"
+)
+
+// noRule index returned when nothing match
+const noRule = -1
+
+// stringTree radix tree of strings, lookup return the smallest index of keys which are prefixes of a string.
+// keys and lookups are reversed if rev is set, so it finds suffixes
+type stringTree struct {
+	rev  bool
+	root *stringNode
+	size int
+}
+
+type stringNode struct {
+	label    string // in tree order, reversed for suffix tree
+	idx      int
+	children []*stringNode
+}
+
+func newStringTree(rev bool) *stringTree {
+	return &stringTree{rev: rev, root: &stringNode{idx: noRule}}
+}
+
+func reverseString(s string) string {
+	b := make([]byte, len(s))
+	for i := range s {
+		b[len(s)-1-i] = s[i]
+	}
+	return string(b)
+}
+
+// Insert key with index, the smallest index is kept for duplicated keys
+func (t *stringTree) Insert(key string, idx int) {
+	if t.rev {
+		key = reverseString(key)
+	}
+	t.size++
+	n := t.root
+	for {
+		if key == "" {
+			n.idx = minIndex(n.idx, idx)
+			return
+		}
+		var child *stringNode
+		ci := 0
+		for i, c := range n.children {
+			if c.label[0] == key[0] {
+				child, ci = c, i
+				break
+			}
+		}
+		if child == nil {
+			n.children = append(n.children, &stringNode{label: key, idx: idx})
+			return
+		}
+
+		common := 0
+		for common < len(key) && common < len(child.label) && key[common] == child.label[common] {
+			common++
+		}
+		if common == len(child.label) {
+			n, key = child, key[common:]
+			continue
+		}
+		// split child at common
+		mid := &stringNode{label: child.label[:common], idx: noRule}
+		child.label = child.label[common:]
+		mid.children = []*stringNode{child}
+		n.children[ci] = mid
+		n, key = mid, key[common:]
+	}
+}
+
+// Lookup return the smallest index of keys matching s
+func (t *stringTree) Lookup(s string) int {
+	best := t.root.idx
+	n, pos := t.root, 0
+	for pos < len(s) {
+		c := t.at(s, pos)
+		var child *stringNode
+		for _, ch := range n.children {
+			if ch.label[0] == c {
+				child = ch
+				break
+			}
+		}
+		if child == nil || len(child.label) > len(s)-pos {
+			break
+		}
+		for i := 1; i < len(child.label); i++ {
+			if child.label[i] != t.at(s, pos+i) {
+				return best
+			}
+		}
+		best = minIndex(best, child.idx)
+		n, pos = child, pos+len(child.label)
+	}
+	return best
+}
+
+// at return the i-th byte of s in tree order
+func (t *stringTree) at(s string, i int) byte {
+	if t.rev {
+		return s[len(s)-1-i]
+	}
+	return s[i]
+}
+
+// cidrTree path compressed binary radix tree of ip networks, ipv4 is stored as ipv4-mapped ipv6
+type cidrTree struct {
+	root *cidrNode
+	size int
+}
+
+type cidrNode struct {
+	key   [16]byte // bits after ones are zero
+	ones  int
+	idx   int
+	child [2]*cidrNode
+}
+
+func newCIDRTree() *cidrTree {
+	return &cidrTree{root: &cidrNode{idx: noRule}}
+}
+
+func ipKey(ip net.IP) (key [16]byte, ok bool) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return key, false
+	}
+	copy(key[:], ip16)
+	return key, true
+}
+
+// maskKey keep the first ones bits of key
+func maskKey(key [16]byte, ones int) (k [16]byte) {
+	for i := 0; i < 16 && ones > 0; i++ {
+		if ones >= 8 {
+			k[i] = key[i]
+			ones -= 8
+			continue
+		}
+		k[i] = key[i] & ^byte(0xff>>ones)
+		ones = 0
+	}
+	return
+}
+
+func keyBit(key [16]byte, i int) int {
+	return int(key[i/8]>>(7-i%8)) & 1
+}
+
+// commonBits count the same leading bits of a and b, at most limit
+func commonBits(a, b [16]byte, limit int) int {
+	n := 0
+	for i := 0; i < 16 && n < limit; i++ {
+		x := a[i] ^ b[i]
+		if x != 0 {
+			n += bits.LeadingZeros8(x)
+			break
+		}
+		n += 8
+	}
+	if n > limit {
+		n = limit
+	}
+	return n
+}
+
+// Insert network with index, the smallest index is kept for duplicated networks
+func (t *cidrTree) Insert(ipnet *net.IPNet, idx int) {
+	key, ok := ipKey(ipnet.IP)
+	if !ok {
+		return
+	}
+	ones, size := ipnet.Mask.Size()
+	if size == 32 {
+		ones += 96
+	}
+	key = maskKey(key, ones)
+	t.size++
+
+	n := t.root
+	for {
+		if ones == n.ones {
+			n.idx = minIndex(n.idx, idx)
+			return
+		}
+		b := keyBit(key, n.ones)
+		c := n.child[b]
+		if c == nil {
+			n.child[b] = &cidrNode{key: key, ones: ones, idx: idx}
+			return
+		}
+		limit := ones
+		if c.ones < limit {
+			limit = c.ones
+		}
+		common := commonBits(key, c.key, limit)
+		if common == c.ones {
+			n = c
+			continue
+		}
+		// split c at common bits
+		mid := &cidrNode{key: maskKey(key, common), ones: common, idx: noRule}
+		mid.child[keyBit(c.key, common)] = c
+		n.child[b] = mid
+		if common == ones {
+			mid.idx = idx
+		} else {
+			mid.child[keyBit(key, common)] = &cidrNode{key: key, ones: ones, idx: idx}
+		}
+		return
+	}
+}
+
+// Lookup return the smallest index of networks containing ip
+func (t *cidrTree) Lookup(ip net.IP) int {
+	key, ok := ipKey(ip)
+	if !ok {
+		return noRule
+	}
+	best := noRule
+	for n := t.root; n != nil; {
+		if commonBits(key, n.key, n.ones) < n.ones {
+			break
+		}
+		best = minIndex(best, n.idx)
+		if n.ones == 128 {
+			break
+		}
+		n = n.child[keyBit(key, n.ones)]
+	}
+	return best
+}
+
+// minIndex return the smaller index, noRule is ignored
+func minIndex(a, b int) int {
+	if a == noRule || (b != noRule && b < a) {
+		return b
+	}
+	return a
+}
+
+// matchCtx request being matched, ip of host is looked up once when first needed
+type matchCtx struct {
+	rs       *ResolverManager
+	md       *Metadata
+	ip       net.IP
+	resolved bool
+	src      net.IP
+	srcDone  bool
+}
+
+// IP return ip of host, nil if it can't be resolved
+func (m *matchCtx) IP() net.IP {
+	if !m.resolved {
+		m.resolved = true
+		if m.ip = net.ParseIP(m.md.Host); m.ip == nil && m.rs != nil {
+			m.ip = m.rs.Lookup(m.md.Host)
+		}
+	}
+	return m.ip
+}
+
+// SourceIP return ip of client, nil if source is unknown
+func (m *matchCtx) SourceIP() net.IP {
+	if !m.srcDone {
+		m.srcDone = true
+		host := m.md.Source
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		m.src = net.ParseIP(host)
+	}
+	return m.src
+}
@@ -0,0 +1,245 @@
+package client
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestStringTree(t *testing.T) {
+	suffix := newStringTree(true)
+	for i, k := range []string{"example.com", "ample.com", "www.example.com", "com", "example.com", "org"} {
+		suffix.Insert(k, i)
+	}
+	tests := map[string]int{
+		"example.com":      0,
+		"xample.com":       1,
+		"www.example.com":  0,
+		"a.b.c.com":        3,
+		"example.org":      5,
+		"example.net":      noRule,
+		"om":               noRule,
+		"wwww.example.com": 0,
+	}
+	for host, want := range tests {
+		if got := suffix.Lookup(host); got != want {
+			t.Errorf("suffix Lookup(%v) = %v, want %v", host, got, want)
+		}
+	}
+
+	prefix := newStringTree(false)
+	prefix.Insert("api.", 2)
+	prefix.Insert("a", 5)
+	prefix.Insert("api.internal", 1)
+	for host, want := range map[string]int{"api.internal.com": 1, "api.example": 2, "abc": 5, "b": noRule} {
+		if got := prefix.Lookup(host); got != want {
+			t.Errorf("prefix Lookup(%v) = %v, want %v", host, got, want)
+		}
+	}
+
+	empty := newStringTree(true)
+	empty.Insert("", 7)
+	if got := empty.Lookup("anything"); got != 7 {
+		t.Errorf("empty key Lookup() = %v, want 7", got)
+	}
+}
+
+func TestCIDRTree(t *testing.T) {
+	tree := newCIDRTree()
+	for i, c := range []string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "0.0.0.0/0", "2001:db8::/32", "10.1.2.3/32", "10.0.0.0/8"} {
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.Insert(ipnet, i+1)
+	}
+	tests := map[string]int{
+		"10.1.2.3":    1,
+		"10.200.0.1":  1,
+		"11.0.0.1":    4,
+		"2001:db8::1": 5,
+		"2001:db9::1": noRule,
+	}
+	for ip, want := range tests {
+		if got := tree.Lookup(net.ParseIP(ip)); got != want {
+			t.Errorf("Lookup(%v) = %v, want %v", ip, got, want)
+		}
+	}
+
+	// more specific network inserted first
+	tree = newCIDRTree()
+	for i, c := range []string{"192.168.1.0/24", "192.168.0.0/16", "192.168.1.128/25"} {
+		_, ipnet, _ := net.ParseCIDR(c)
+		tree.Insert(ipnet, i)
+	}
+	for ip, want := range map[string]int{"192.168.1.200": 0, "192.168.2.1": 1, "192.169.0.1": noRule} {
+		if got := tree.Lookup(net.ParseIP(ip)); got != want {
+			t.Errorf("Lookup(%v) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+// linearMatch check rules one by one, the result compiled rule set must agree with
+func linearMatch(rules []Rule, md *Metadata) int {
+	for i := range rules {
+		if rules[i].Match(nil, md) {
+			return i
+		}
+	}
+	return noRule
+}
+
+func TestRuleSet_MatchLikeLinear(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"a", "b", "ab", "ex", "com", "net", "x", "."}
+	randHost := func() string {
+		s := ""
+		for n := rnd.Intn(5); n >= 0; n-- {
+			s += words[rnd.Intn(len(words))]
+		}
+		return s
+	}
+	randIP := func() string {
+		return fmt.Sprintf("10.%d.%d.%d", rnd.Intn(4), rnd.Intn(4), rnd.Intn(256))
+	}
+
+	for round := 0; round < 50; round++ {
+		var strs []string
+		for i := 0; i < 30; i++ {
+			switch rnd.Intn(6) {
+			case 0:
+				strs = append(strs, fmt.Sprintf("host-suffix: %v, forward: s%d", randHost(), i))
+			case 1:
+				strs = append(strs, fmt.Sprintf("host-prefix: %v, forward: s%d", randHost(), i))
+			case 2:
+				strs = append(strs, fmt.Sprintf("host-match: %v, forward: s%d", randHost(), i))
+			case 3:
+				strs = append(strs, fmt.Sprintf("ip-cidr: %v/%d, forward: s%d", randIP(), 8+rnd.Intn(25), i))
+			case 4:
+				strs = append(strs, fmt.Sprintf("host-regexp: ^%v$, forward: s%d", randHost(), i))
+			case 5:
+				strs = append(strs, fmt.Sprintf("user: u%d, forward: s%d", rnd.Intn(3), i))
+			}
+		}
+		rules, err := ParseRules(strs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := newRuleSet(nil, rules)
+		for i := 0; i < 200; i++ {
+			md := &Metadata{Host: randHost(), User: fmt.Sprintf("u%d", rnd.Intn(3))}
+			if rnd.Intn(2) == 0 {
+				md.Host = randIP()
+			}
+			want := linearMatch(rules, md)
+			if got := set.match(&matchCtx{md: md}); got != want {
+				t.Fatalf("match(%+v) = %v, want %v, rules %q", md, got, want, strs)
+			}
+		}
+	}
+}
+
+func TestRuleSet_LazyLookup(t *testing.T) {
+	rules, err := ParseRules([]string{
+		"host-suffix: example.com, direct",
+		"ip-cidr: 10.0.0.0/8, reject",
+		"match-all, forward: local",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := newRuleSet(nil, rules)
+
+	mc := &matchCtx{md: &Metadata{Host: "www.example.com"}}
+	if got := set.match(mc); got != 0 || mc.resolved {
+		t.Errorf("match() = %v, resolved %v, want 0 without lookup", got, mc.resolved)
+	}
+	mc = &matchCtx{md: &Metadata{Host: "10.1.1.1"}}
+	if got := set.match(mc); got != 1 || !mc.resolved {
+		t.Errorf("match() = %v, resolved %v, want 1 with lookup", got, mc.resolved)
+	}
+}
+
+const benchRules = 100000
+
+func benchRuleStrings(rnd *rand.Rand) (strs []string, hosts []string, ips []string) {
+	for i := 0; i < benchRules/2; i++ {
+		host := fmt.Sprintf("d%d-%d.example%d.com", i, rnd.Intn(1000), rnd.Intn(100))
+		hosts = append(hosts, "www."+host)
+		strs = append(strs, fmt.Sprintf("host-suffix: %v, reject", host))
+	}
+	for i := 0; i < benchRules/2; i++ {
+		ip := fmt.Sprintf("%d.%d.%d.0", 1+rnd.Intn(223), rnd.Intn(256), rnd.Intn(256))
+		ips = append(ips, ip[:len(ip)-1]+"1")
+		strs = append(strs, fmt.Sprintf("ip-cidr: %v/24, direct", ip))
+	}
+	rnd.Shuffle(len(strs), func(i, j int) { strs[i], strs[j] = strs[j], strs[i] })
+	strs = append(strs, "match-all, forward: local")
+	return
+}
+
+func BenchmarkRuleManager_Get(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	strs, hosts, ips := benchRuleStrings(rnd)
+	r, err := NewRuleManager(nil, strs)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		hosts []string
+	}{
+		{"domain-hit", hosts},
+		{"ip-hit", ips},
+		{"miss", []string{"no.such.host.org", "192.0.2.1"}},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.Get(&Metadata{Host: c.hosts[i%len(c.hosts)]})
+			}
+		})
+	}
+}
+
+// BenchmarkRuleManager_GetLinear the cost of checking 100k rules one by one, for comparison
+func BenchmarkRuleManager_GetLinear(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	strs, hosts, _ := benchRuleStrings(rnd)
+	rules, err := ParseRules(strs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		linearMatch(rules, &Metadata{Host: hosts[i%len(hosts)]})
+	}
+}
+
+func BenchmarkRuleProvider_Match(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	var data []byte
+	var hosts []string
+	for i := 0; i < benchRules; i++ {
+		host := fmt.Sprintf("d%d.example%d.com", i, rnd.Intn(100))
+		hosts = append(hosts, "www."+host)
+		data = append(data, "+."+host+"\n"...)
+		data = append(data, fmt.Sprintf("%d.%d.%d.0/24\n", 1+rnd.Intn(223), rnd.Intn(256), rnd.Intn(256))...)
+	}
+	set, err := parseDomainCIDRSet(data)
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := &RuleProvider{}
+	p.set.Store(set)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Match(nil, &Metadata{Host: hosts[i%len(hosts)]})
+	}
+}
@@ -0,0 +1,222 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"through/config"
+	"through/log"
+	"through/proto"
+	"time"
+
+	"github.com/xtaci/smux"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	DefaultMuxSessions   = 4
+	DefaultMuxMaxStreams = 128
+	// muxDrainInterval how often draining sessions are checked for streams
+	muxDrainInterval = time.Second
+)
+
+var (
+	MuxUnsupported = errors.New("server does not support mux")
+)
+
+// MuxPool open streams on a few long-lived multiplexed sessions,
+// sessions are negotiated on the connections produced by ConnectionPool
+type MuxPool struct {
+	pool       *ConnectionPool
+	maxSession int
+	maxStreams int
+	logger     *log.Logger
+
+	lc          sync.Mutex
+	sessions    []*smux.Session
+	unsupported atomic.Bool
+	creating    singleflight.Group // one session is created at a time, out of lock
+}
+
+func NewMuxPool(pool *ConnectionPool, cfg config.MuxCfg) (m *MuxPool) {
+	m = &MuxPool{
+		pool:       pool,
+		maxSession: cfg.Sessions,
+		maxStreams: cfg.MaxStreams,
+		logger:     log.NewLogger().With("type", "muxPool").With("network", pool.network).With("address", pool.addr),
+		lc:         sync.Mutex{},
+	}
+	if m.maxSession <= 0 {
+		m.maxSession = DefaultMuxSessions
+	}
+	if m.maxStreams <= 0 {
+		m.maxStreams = DefaultMuxMaxStreams
+	}
+	return
+}
+
+// Supported return false once the server refused mux
+func (m *MuxPool) Supported() bool {
+	return !m.unsupported.Load()
+}
+
+// Get open a new stream, a new session is created if all sessions are busy.
+// callers wanting a new session at the same time wait for the same one
+func (m *MuxPool) Get(ctx context.Context) (conn net.Conn, err error) {
+	m.lc.Lock()
+	session := m.pick()
+	m.lc.Unlock()
+
+	if session == nil {
+		// shared by all waiters, so it must not end with the caller who started it
+		ch := m.creating.DoChan("session", func() (interface{}, error) {
+			sessionCtx, cancel := context.WithTimeout(m.pool.ctx, getConnTimeout)
+			defer cancel()
+			return m.addSession(sessionCtx)
+		})
+		select {
+		case <-ctx.Done():
+			return nil, PoolTimeout
+		case r := <-ch:
+			if r.Err != nil {
+				return nil, r.Err
+			}
+			session = r.Val.(*smux.Session)
+		}
+	}
+
+	return session.OpenStream()
+}
+
+// addSession create a session unless one become available meanwhile
+func (m *MuxPool) addSession(ctx context.Context) (*smux.Session, error) {
+	m.lc.Lock()
+	session := m.pick()
+	m.lc.Unlock()
+	if session != nil {
+		return session, nil
+	}
+
+	session, err := m.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.lc.Lock()
+	defer m.lc.Unlock()
+	if m.pool.ctx.Err() != nil {
+		// closed while negotiating
+		_ = session.Close()
+		return nil, PoolClosed
+	}
+	m.sessions = append(m.sessions, session)
+	m.logger.Infof("new mux session, now is %d", len(m.sessions))
+	return session, nil
+}
+
+// pick the least busy session, return nil if a new session should be created
+func (m *MuxPool) pick() (session *smux.Session) {
+	alive := m.sessions[:0]
+	for _, s := range m.sessions {
+		if s.IsClosed() {
+			continue
+		}
+		alive = append(alive, s)
+		if session == nil || s.NumStreams() < session.NumStreams() {
+			session = s
+		}
+	}
+	m.sessions = alive
+
+	if session != nil && session.NumStreams() >= m.maxStreams && len(m.sessions) < m.maxSession {
+		session = nil
+	}
+	return
+}
+
+// newSession take one connection from pool and negotiate mux with server
+func (m *MuxPool) newSession(ctx context.Context) (session *smux.Session, err error) {
+	if hello := m.pool.Server(); hello != nil && !hello.Has(proto.CapMux) {
+		m.logger.Warnf("server not advertise mux, fallback to connection pool")
+		m.unsupported.Store(true)
+		return nil, MuxUnsupported
+	}
+
+	conn, err := m.pool.Get(ctx)
+	if err != nil {
+		return
+	}
+	// the first connection tell us what server support
+	if !m.pool.Server().Has(proto.CapMux) {
+		m.logger.Warnf("server not advertise mux, fallback to connection pool")
+		m.unsupported.Store(true)
+		_ = conn.Close()
+		return nil, MuxUnsupported
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err = proto.WriteMeta(conn, &proto.Meta{Net: proto.NetMux}); err != nil {
+		_ = conn.Close()
+		return
+	}
+	// server not support mux will close the connection
+	meta, err := proto.ReadMeta(conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		_ = conn.Close()
+		return
+	}
+	if err != nil || meta.GetNet() != proto.NetMux {
+		m.logger.Warnf("negotiate mux failed: %v, fallback to connection pool", err)
+		m.unsupported.Store(true)
+		_ = conn.Close()
+		return nil, MuxUnsupported
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	if session, err = smux.Client(conn, proto.MuxConfig()); err != nil {
+		_ = conn.Close()
+	}
+	return
+}
+
+func (m *MuxPool) Close() {
+	m.lc.Lock()
+	defer m.lc.Unlock()
+	m.logger.Info("close mux sessions")
+	for _, s := range m.sessions {
+		_ = s.Close()
+	}
+	m.sessions = nil
+}
+
+// Drain close each session once it has no stream, so streams in use are not broken
+func (m *MuxPool) Drain() {
+	go func() {
+		for {
+			m.lc.Lock()
+			alive := m.sessions[:0]
+			for _, s := range m.sessions {
+				if s.IsClosed() {
+					continue
+				}
+				if s.NumStreams() == 0 {
+					_ = s.Close()
+					continue
+				}
+				alive = append(alive, s)
+			}
+			m.sessions = alive
+			m.lc.Unlock()
+
+			if len(alive) == 0 {
+				m.logger.Info("mux sessions drained")
+				return
+			}
+			time.Sleep(muxDrainInterval)
+		}
+	}()
+}
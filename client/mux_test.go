@@ -0,0 +1,106 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"through/config"
+	"through/proto"
+	"through/util"
+	"time"
+)
+
+// echoStreams dial n tunnels at the same time, and check data is echoed on each
+func echoStreams(t *testing.T, f *ForwardClient, echo string, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := f.Dial(context.Background(), &proto.Meta{Net: "tcp", Address: echo})
+			if err != nil {
+				t.Errorf("Dial() error: %v", err)
+				return
+			}
+			defer conn.Close()
+			msg := fmt.Sprintf("stream %d", i)
+			if _, err = conn.Write([]byte(msg)); err != nil {
+				t.Errorf("write error: %v", err)
+				return
+			}
+			buf := make([]byte, len(msg))
+			if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+				t.Errorf("read %q, %v, want %q", buf, err, msg)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMuxPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echo := echoServer(t, "127.0.0.1:0")
+	mux := config.MuxCfg{Enable: true, Sessions: 2, MaxStreams: 4}
+
+	f, err := NewForwardClient(ctx, config.ProxyServer{Name: "mux", Net: "tcp", Addr: serveThrough(t, ctx, config.AclCfg{AllowPrivate: true}), Insecure: true}, nil, nil, &tls.Config{}, "", 2, mux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	echoStreams(t, f, echo, 20)
+	if !f.mux.Supported() {
+		t.Error("Supported() = false with mux server")
+	}
+	f.mux.lc.Lock()
+	sessions := len(f.mux.sessions)
+	f.mux.lc.Unlock()
+	if sessions < 1 || sessions > mux.Sessions {
+		t.Errorf("sessions = %d, want 1 to %d", sessions, mux.Sessions)
+	}
+
+	// server without mux is used by whole connections
+	legacy, err := NewForwardClient(ctx, config.ProxyServer{Name: "nomux", Net: "tcp", Addr: serveHello(t, testCertificate(t), helloWithout(proto.CapMux), fakeHop), Insecure: true}, nil, nil, &tls.Config{}, "", 2, mux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+	echoStreams(t, legacy, echo, 5)
+	if legacy.mux.Supported() {
+		t.Error("Supported() = true with server not advertising mux")
+	}
+}
+
+func TestMuxPool_CancelledCaller(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// connections to server are slow, so the second caller wait for the session started by the first
+	addr := serveThrough(t, ctx, config.AclCfg{AllowPrivate: true})
+	delayed := serveTcp(t, "127.0.0.1:0", func(conn net.Conn) {
+		time.Sleep(300 * time.Millisecond)
+		if remote, err := net.Dial("tcp", addr); err == nil {
+			util.CopyLoopWait(conn, remote)
+		}
+	})
+	f, err := NewForwardClient(ctx, config.ProxyServer{Name: "mux", Net: "tcp", Addr: delayed, Insecure: true}, nil, nil, &tls.Config{}, "", 1, config.MuxCfg{Enable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	first, cancelFirst := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelFirst()
+	go func() { _, _ = f.mux.Get(first) }()
+	time.Sleep(10 * time.Millisecond)
+	waiting, cancelWaiting := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelWaiting()
+	conn, err := f.mux.Get(waiting)
+	if err != nil {
+		t.Fatalf("Get() error = %v, want stream of the session started by a caller timed out", err)
+	}
+	_ = conn.Close()
+}
@@ -0,0 +1,447 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"through/config"
+	"through/log"
+	"through/proto"
+	"through/util"
+	"time"
+)
+
+const (
+	ProviderTypeFile = "file"
+	ProviderTypeHttp = "http"
+
+	defaultProviderInterval = 24 * time.Hour
+	// providerRetryInterval wait before downloading again after a failure
+	providerRetryInterval   = time.Minute
+	providerDownloadTimeout = time.Minute
+	// maxProviderSize limit the size of a rule set
+	maxProviderSize = 32 << 20
+)
+
+// RuleProvider a rule set of domains and cidrs, refreshed from file or url in background
+type RuleProvider struct {
+	cfg      config.RuleProvider
+	interval time.Duration
+	forwards *ForwardManger
+	cancel   context.CancelFunc
+	set      atomic.Pointer[domainCIDRSet]
+	logger   *log.Logger
+}
+
+// NewRuleProvider check config and load the file or cache, refreshing starts by run
+func NewRuleProvider(cfg config.RuleProvider, forwards *ForwardManger) (p *RuleProvider, err error) {
+	p = &RuleProvider{
+		cfg:      cfg,
+		interval: time.Duration(cfg.Interval) * time.Second,
+		forwards: forwards,
+		logger:   log.NewLogger().With("type", "ruleProvider").With("name", cfg.Name),
+	}
+	p.set.Store(newDomainCIDRSet())
+
+	switch cfg.Type {
+	case ProviderTypeFile:
+		if cfg.Path == "" {
+			return nil, errors.New("path is required")
+		}
+		if err = p.load(); err != nil {
+			return nil, err
+		}
+	case ProviderTypeHttp:
+		if cfg.URL == "" {
+			return nil, errors.New("url is required")
+		}
+		if p.interval <= 0 {
+			p.interval = defaultProviderInterval
+		}
+		// cache let rules work before download, it's fine to have none
+		if cfg.Path != "" {
+			if err = p.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+				p.logger.Warnf("load cache error: %v", err)
+			}
+			err = nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %q, use %v or %v", cfg.Type, ProviderTypeFile, ProviderTypeHttp)
+	}
+	return
+}
+
+// Match return true if host of md is in the set, ip of host is looked up only if set has cidrs without no-resolve
+func (p *RuleProvider) Match(rs *ResolverManager, md *Metadata) bool {
+	return p.match(&matchCtx{rs: rs, md: md})
+}
+
+func (p *RuleProvider) match(mc *matchCtx) bool {
+	set := p.set.Load()
+	if set.matchDomain(mc.md.Host) {
+		return true
+	}
+	if ip := net.ParseIP(mc.md.Host); ip != nil {
+		return set.matchIP(ip)
+	}
+	if set.cidrs.size == 0 {
+		return false
+	}
+	ip := mc.IP()
+	return ip != nil && set.cidrs.Lookup(ip) != noRule
+}
+
+// run refresh rules until ctx is done
+func (p *RuleProvider) run(ctx context.Context) {
+	if p.cfg.Type == ProviderTypeFile {
+		util.WatchFiles(ctx, util.WatchInterval, []string{p.cfg.Path}, func() error {
+			if err := p.load(); err != nil {
+				p.logger.Errorf("reload %v error, keep the old rules: %v", p.cfg.Path, err)
+				return err
+			}
+			return nil
+		})
+		return
+	}
+
+	// download now unless cache is fresh
+	wait := time.Duration(0)
+	if info, err := os.Stat(p.cfg.Path); err == nil && p.cfg.Path != "" {
+		if age := time.Since(info.ModTime()); age < p.interval {
+			wait = p.interval - age
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait = p.interval
+		if err := p.download(ctx); err != nil {
+			p.logger.Errorf("download %v error: %v", p.cfg.URL, err)
+			if providerRetryInterval < wait {
+				wait = providerRetryInterval
+			}
+		}
+	}
+}
+
+// load rules from path
+func (p *RuleProvider) load() (err error) {
+	data, err := os.ReadFile(p.cfg.Path)
+	if err != nil {
+		return
+	}
+	set, err := parseDomainCIDRSet(data)
+	if err != nil {
+		return fmt.Errorf("parse %v: %w", p.cfg.Path, err)
+	}
+	p.set.Store(set)
+	p.logger.Infof("load %d domains and %d cidrs from %v", set.size(), set.cidrs.size+set.noResolve.size, p.cfg.Path)
+	return
+}
+
+// download rules through the forward of provider, and save them to cache
+func (p *RuleProvider) download(ctx context.Context) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, providerDownloadTimeout)
+	defer cancel()
+
+	name := p.cfg.Forward
+	if name == "" {
+		name = string(RuleActionTypeDirect)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			forward, ok := p.forwards.GetForward(name)
+			if !ok {
+				return nil, fmt.Errorf("forward %v not found", name)
+			}
+			return forward.Dial(ctx, &proto.Meta{Net: "tcp", Address: addr})
+		},
+	}}
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.URL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxProviderSize+1))
+	if err != nil {
+		return
+	}
+	if len(data) > maxProviderSize {
+		return fmt.Errorf("rule set is larger than %d bytes", maxProviderSize)
+	}
+
+	set, err := parseDomainCIDRSet(data)
+	if err != nil {
+		return
+	}
+	p.set.Store(set)
+	p.logger.Infof("download %d domains and %d cidrs from %v", set.size(), set.cidrs.size+set.noResolve.size, p.cfg.URL)
+
+	if p.cfg.Path != "" {
+		if err = writeCache(p.cfg.Path, data); err != nil {
+			p.logger.Warnf("write cache error: %v", err)
+		}
+	}
+	return nil
+}
+
+// writeCache write to a temp file then rename, so reader never see a partial file
+func writeCache(file string, data []byte) (err error) {
+	if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return
+	}
+	tmp := file + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, file)
+}
+
+// ProviderManager hold rule providers by name, unchanged providers are kept across reloads
+type ProviderManager struct {
+	ctx       context.Context
+	forwards  *ForwardManger
+	lc        sync.Mutex
+	providers map[string]*RuleProvider
+}
+
+// providerUpdate providers prepared for a new config, nothing runs until Commit, so it can be dropped
+type providerUpdate struct {
+	providers map[string]*RuleProvider
+	created   []*RuleProvider
+}
+
+func NewProviderManager(ctx context.Context, forwards *ForwardManger) *ProviderManager {
+	return &ProviderManager{ctx: ctx, forwards: forwards, providers: map[string]*RuleProvider{}}
+}
+
+// Prepare check config and load new or changed providers, servers and groups are the ones they can download through
+func (m *ProviderManager) Prepare(cfgs []config.RuleProvider, servers []config.ProxyServer, groups []config.ProxyGroup) (u *providerUpdate, err error) {
+	names := forwardNames(servers, groups)
+	names[string(RuleActionTypeDirect)] = true
+
+	m.lc.Lock()
+	defer m.lc.Unlock()
+	u = &providerUpdate{providers: map[string]*RuleProvider{}}
+	for _, c := range cfgs {
+		if c.Name == "" {
+			return nil, errors.New("name of rule provider is required")
+		}
+		if _, ok := u.providers[c.Name]; ok {
+			return nil, fmt.Errorf("rule provider %v is duplicated", c.Name)
+		}
+		if c.Forward != "" && !names[c.Forward] {
+			return nil, fmt.Errorf("rule provider %v: unknown forward %q", c.Name, c.Forward)
+		}
+		if p, ok := m.providers[c.Name]; ok && reflect.DeepEqual(p.cfg, c) {
+			u.providers[c.Name] = p
+			continue
+		}
+		p, err := NewRuleProvider(c, m.forwards)
+		if err != nil {
+			return nil, fmt.Errorf("rule provider %v: %w", c.Name, err)
+		}
+		u.providers[c.Name] = p
+		u.created = append(u.created, p)
+	}
+	return
+}
+
+// Commit start created providers and stop the ones not in use
+func (m *ProviderManager) Commit(u *providerUpdate) {
+	m.lc.Lock()
+	defer m.lc.Unlock()
+	for _, p := range u.created {
+		var ctx context.Context
+		ctx, p.cancel = context.WithCancel(m.ctx)
+		go p.run(ctx)
+	}
+	for name, p := range m.providers {
+		if u.providers[name] != p {
+			p.cancel()
+		}
+	}
+	m.providers = u.providers
+}
+
+// bindProviders set provider of rule-set rules
+func bindProviders(rules []Rule, providers map[string]*RuleProvider) error {
+	for i := range rules {
+		err := rules[i].walk(func(r *Rule) error {
+			if r.CondType != RuleCondTypeRuleSet {
+				return nil
+			}
+			p, ok := providers[r.CondParam]
+			if !ok {
+				return fmt.Errorf("rule set %q is not in ruleProviders", r.CondParam)
+			}
+			r.provider = p
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// domainCIDRSet domains and cidrs of a rule set
+type domainCIDRSet struct {
+	domains    map[string]struct{} // match exactly
+	suffixes   map[string]struct{} // match the domain and its subdomains
+	subdomains map[string]struct{} // match subdomains only
+	keywords   []string
+	cidrs      *cidrTree
+	noResolve  *cidrTree // cidrs only matching ip hosts, domains are not looked up for them
+}
+
+func newDomainCIDRSet() *domainCIDRSet {
+	return &domainCIDRSet{
+		domains:    map[string]struct{}{},
+		suffixes:   map[string]struct{}{},
+		subdomains: map[string]struct{}{},
+		cidrs:      newCIDRTree(),
+		noResolve:  newCIDRTree(),
+	}
+}
+
+func (s *domainCIDRSet) size() int {
+	return len(s.domains) + len(s.suffixes) + len(s.subdomains) + len(s.keywords)
+}
+
+func (s *domainCIDRSet) matchDomain(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if _, ok := s.domains[host]; ok {
+		return true
+	}
+	for d, sub := host, false; ; sub = true {
+		if _, ok := s.suffixes[d]; ok {
+			return true
+		}
+		if _, ok := s.subdomains[d]; ok && sub {
+			return true
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	for _, k := range s.keywords {
+		if strings.Contains(host, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *domainCIDRSet) matchIP(ip net.IP) bool {
+	return s.cidrs.Lookup(ip) != noRule || s.noResolve.Lookup(ip) != noRule
+}
+
+// parseDomainCIDRSet parse one entry per line, formats are
+//
+//	plain:   example.com, +.example.com or .example.com (with subdomains), *.example.com (subdomains), 10.0.0.0/8
+//	clash:   the same entries in a "payload:" yaml list
+//	classic: DOMAIN,example.com DOMAIN-SUFFIX,example.com DOMAIN-KEYWORD,example IP-CIDR,10.0.0.0/8,no-resolve
+//
+// lines starting with # or // are comments, unknown classic types are skipped
+func parseDomainCIDRSet(data []byte) (s *domainCIDRSet, err error) {
+	s = newDomainCIDRSet()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") || line == "payload:" {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "- "))
+		line = strings.Trim(line, `'"`)
+
+		typ, value, classic := strings.Cut(line, ",")
+		if !classic {
+			if err = s.add(line); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			continue
+		}
+		value, option, _ := strings.Cut(strings.TrimSpace(value), ",")
+		value = strings.ToLower(strings.TrimSpace(value))
+		switch strings.ToUpper(strings.TrimSpace(typ)) {
+		case "DOMAIN":
+			s.domains[value] = struct{}{}
+		case "DOMAIN-SUFFIX":
+			s.suffixes[strings.TrimPrefix(value, ".")] = struct{}{}
+		case "DOMAIN-KEYWORD":
+			s.keywords = append(s.keywords, value)
+		case "IP-CIDR", "IP-CIDR6":
+			cidrs := s.cidrs
+			if strings.EqualFold(strings.TrimSpace(option), "no-resolve") {
+				cidrs = s.noResolve
+			}
+			if err = addCIDR(cidrs, value); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+		}
+	}
+	return s, scanner.Err()
+}
+
+// add a plain entry
+func (s *domainCIDRSet) add(entry string) error {
+	if strings.Contains(entry, "/") || net.ParseIP(entry) != nil {
+		return addCIDR(s.cidrs, entry)
+	}
+	entry = strings.ToLower(strings.TrimSuffix(entry, "."))
+	switch {
+	case strings.HasPrefix(entry, "+."):
+		s.suffixes[entry[2:]] = struct{}{}
+	case strings.HasPrefix(entry, "."):
+		s.suffixes[entry[1:]] = struct{}{}
+	case strings.HasPrefix(entry, "*."):
+		s.subdomains[entry[2:]] = struct{}{}
+	default:
+		s.domains[entry] = struct{}{}
+	}
+	return nil
+}
+
+// addCIDR add a cidr to tree, a single ip is also accepted
+func addCIDR(tree *cidrTree, entry string) error {
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		tree.Insert(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, 0)
+		return nil
+	}
+	_, ipnet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return fmt.Errorf("invalid cidr %q", entry)
+	}
+	tree.Insert(ipnet, 0)
+	return nil
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"through/config"
+)
+
+func TestParseDomainCIDRSet(t *testing.T) {
+	data := `# plain
+example.com
++.suffix.com
+.dot.com
+*.sub.com
+10.0.0.0/8
+192.168.1.1
+payload:
+  - 'clash.com'
+  - "+.clash-suffix.com"
+DOMAIN,classic.com
+DOMAIN-SUFFIX,classic-suffix.com
+DOMAIN-KEYWORD,tracker
+IP-CIDR,172.16.0.0/12,no-resolve
+IP-CIDR6,2001:db8::/32
+PROCESS-NAME,curl
+`
+	set, err := parseDomainCIDRSet([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	domains := map[string]bool{
+		"example.com":             true,
+		"www.example.com":         false,
+		"suffix.com":              true,
+		"a.b.suffix.com":          true,
+		"dot.com":                 true,
+		"www.dot.com":             true,
+		"sub.com":                 false,
+		"a.sub.com":               true,
+		"clash.com":               true,
+		"www.clash-suffix.com":    true,
+		"classic.com":             true,
+		"x.classic-suffix.com":    true,
+		"ads.tracker.net":         true,
+		"EXAMPLE.COM.":            true,
+		"notexample.com":          false,
+		"classic-suffix.com.evil": false,
+	}
+	for host, want := range domains {
+		if got := set.matchDomain(host); got != want {
+			t.Errorf("matchDomain(%v) = %v, want %v", host, got, want)
+		}
+	}
+
+	ips := map[string]bool{
+		"10.1.2.3":     true,
+		"192.168.1.1":  true,
+		"192.168.1.2":  false,
+		"172.20.0.1":   true,
+		"2001:db8::1":  true,
+		"2001:db9::1":  false,
+		"8.8.8.8":      false,
+		"::ffff:a00:1": true,
+	}
+	for ip, want := range ips {
+		if got := set.matchIP(net.ParseIP(ip)); got != want {
+			t.Errorf("matchIP(%v) = %v, want %v", ip, got, want)
+		}
+	}
+
+	if _, err = parseDomainCIDRSet([]byte("10.0.0.0/33")); err == nil {
+		t.Error("parseDomainCIDRSet() want error for bad cidr")
+	}
+
+	// ip of domain is matched with cidrs except no-resolve ones
+	p := &RuleProvider{}
+	p.set.Store(set)
+	resolved := map[string]bool{
+		"10.1.2.3":   true,
+		"172.20.0.1": false,
+	}
+	for ip, want := range resolved {
+		mc := &matchCtx{md: &Metadata{Host: "internal.corp"}, ip: net.ParseIP(ip), resolved: true}
+		if got := p.match(mc); got != want {
+			t.Errorf("match(internal.corp resolved to %v) = %v, want %v", ip, got, want)
+		}
+	}
+	if !p.match(&matchCtx{md: &Metadata{Host: "172.20.0.1"}}) {
+		t.Error("match(172.20.0.1) = false, want no-resolve cidr match ip host")
+	}
+}
+
+func TestRuleProvider_Http(t *testing.T) {
+	var rules atomic.Value
+	rules.Store("+.ads.com\n")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(rules.Load().(string)))
+	}))
+	defer ts.Close()
+
+	forwards := &ForwardManger{}
+	forwards.forwardClients.Store(&map[string]Forward{"direct": &DirectClient{}})
+	cache := filepath.Join(t.TempDir(), "providers", "ads.txt")
+	cfg := config.RuleProvider{Name: "ads", Type: ProviderTypeHttp, URL: ts.URL, Path: cache, Interval: 1}
+
+	p, err := NewRuleProvider(cfg, forwards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := &Metadata{Host: "www.ads.com"}
+	if p.Match(nil, md) {
+		t.Error("Match() = true before download")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.run(ctx)
+	if !waitUntil(func() bool { return p.Match(nil, md) }) {
+		t.Fatal("rules are not downloaded")
+	}
+	if data, err := os.ReadFile(cache); err != nil || string(data) != "+.ads.com\n" {
+		t.Errorf("cache = %q, %v, want the downloaded rules", data, err)
+	}
+
+	// a new provider work with cache before downloading
+	p2, err := NewRuleProvider(cfg, forwards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p2.Match(nil, md) {
+		t.Error("Match() = false with cache")
+	}
+
+	// rules are refreshed on interval
+	rules.Store("+.tracker.com\n")
+	if !waitUntil(func() bool { return p.Match(nil, &Metadata{Host: "tracker.com"}) }) {
+		t.Error("rules are not refreshed")
+	}
+}
+
+func TestProviderManager_Prepare(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cn.txt")
+	if err := os.WriteFile(file, []byte("10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := NewProviderManager(ctx, &ForwardManger{})
+	servers := []config.ProxyServer{{Name: "local"}}
+
+	cfgs := []config.RuleProvider{{Name: "cn", Type: ProviderTypeFile, Path: file}}
+	u, err := m.Prepare(cfgs, servers, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Commit(u)
+	u2, err := m.Prepare(cfgs, servers, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.providers["cn"] != u.providers["cn"] || len(u2.created) != 0 {
+		t.Error("unchanged provider is recreated")
+	}
+
+	rules, err := ParseRules([]string{"rule-set: cn, direct", "rule-set: other, reject"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bindProviders(rules[:1], u.providers); err != nil {
+		t.Error(err)
+	}
+	if !rules[0].Match(nil, &Metadata{Host: "10.1.1.1"}) {
+		t.Error("rule-set rule not match")
+	}
+	if err = bindProviders(rules, u.providers); err == nil {
+		t.Error("bindProviders() want error for unknown rule set")
+	}
+
+	bad := []config.RuleProvider{
+		{Name: "missing", Type: ProviderTypeFile, Path: filepath.Join(t.TempDir(), "missing.txt")},
+		{Name: "type", Type: "ftp"},
+		{Name: "url", Type: ProviderTypeHttp},
+		{Name: "forward", Type: ProviderTypeHttp, URL: "http://127.0.0.1/", Forward: "remote"},
+	}
+	for _, c := range bad {
+		if _, err = m.Prepare([]config.RuleProvider{c}, servers, nil); err == nil {
+			t.Errorf("Prepare(%v) want error", c.Name)
+		}
+	}
+}
@@ -2,9 +2,14 @@ package client
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"through/config"
+	"through/util"
 )
 
 var (
@@ -20,9 +25,33 @@ const (
 	RuleCondTypeHostRegexp RuleCondType = "host-regexp" // 正则匹配
 	RuleCondTypeGEO        RuleCondType = "geo"         // geo地址匹配
 	RuleCondTypeIPCIDR     RuleCondType = "ip-cidr"     // cidr匹配
+	RuleCondTypeUser       RuleCondType = "user"        // 认证用户匹配
+	RuleCondTypeRuleSet    RuleCondType = "rule-set"    // rule provider匹配
 	RuleCondTypeMatchAll   RuleCondType = "match-all"   // always return true
+
+	// conditions below accept a list separated by "|", any item matching is enough
+	RuleCondTypeDstPort       RuleCondType = "dst-port"       // 目标端口, 443 或 8000-9000
+	RuleCondTypeSrcIPCIDR     RuleCondType = "src-ip-cidr"    // 来源地址cidr匹配
+	RuleCondTypeNetwork       RuleCondType = "network"        // tcp 或 udp
+	RuleCondTypeInbound       RuleCondType = "inbound"        // 入口, http 或 socks
+	RuleCondTypeIPASN         RuleCondType = "ip-asn"         // 目标地址ASN, 需要配置 asnFile
+	RuleCondTypeDomainKeyword RuleCondType = "domain-keyword" // 域名关键字, 忽略大小写
+	RuleCondTypeServerState   RuleCondType = "server-state"   // 服务端健康状态, local=degraded|down
+
+	// composite conditions, only in the object form of rules
+	RuleCondTypeAnd RuleCondType = "and" // 全部子条件匹配
+	RuleCondTypeOr  RuleCondType = "or"  // 任一子条件匹配
+	RuleCondTypeNot RuleCondType = "not" // 子条件不匹配
+)
+
+const (
+	InboundHttp  = "http"
+	InboundSocks = "socks"
 )
 
+// ruleParamSep separate items of a list param
+const ruleParamSep = "|"
+
 type RuleActionType string
 
 const (
@@ -31,38 +60,156 @@ const (
 	RuleActionTypeForward RuleActionType = "forward" // forward to through server
 )
 
+// RuleManager match request with rules, rules can be replaced at runtime
 type RuleManager struct {
+	set atomic.Pointer[ruleSet]
+}
+
+// ruleSet rules and the resolvers they use, replaced together on update.
+// suffix, prefix and cidr rules are indexed by trees, others are checked one by one,
+// the matched rule with the smallest index win as if all rules are checked in order
+type ruleSet struct {
 	rules     []Rule
 	resolvers *ResolverManager
+
+	suffixes  *stringTree // host-suffix
+	prefixes  *stringTree // host-prefix
+	cidrs     *cidrTree   // ip-cidr
+	firstCIDR int         // index of the first ip-cidr rule, len(rules) if none
+	linear    []int       // index of other rules
 }
 
-func NewRuleManager(resolvers *ResolverManager, rules []string) (r *RuleManager, err error) {
-	r = &RuleManager{
-		rules:     make([]Rule, 0, len(rules)),
+func newRuleSet(resolvers *ResolverManager, rules []Rule) *ruleSet {
+	s := &ruleSet{
+		rules:     rules,
 		resolvers: resolvers,
+		suffixes:  newStringTree(true),
+		prefixes:  newStringTree(false),
+		cidrs:     newCIDRTree(),
+		firstCIDR: len(rules),
+	}
+	for i := range rules {
+		switch rules[i].CondType {
+		case RuleCondTypeHostSuffix:
+			s.suffixes.Insert(rules[i].CondParam, i)
+		case RuleCondTypeHostPrefix:
+			s.prefixes.Insert(rules[i].CondParam, i)
+		case RuleCondTypeIPCIDR:
+			s.cidrs.Insert(rules[i].ipnet, i)
+			if i < s.firstCIDR {
+				s.firstCIDR = i
+			}
+		default:
+			s.linear = append(s.linear, i)
+		}
+	}
+	return s
+}
+
+// match return index of the first matched rule, noRule if none.
+// ip is looked up only when an ip based rule before the matched one is reached
+func (s *ruleSet) match(mc *matchCtx) int {
+	best := minIndex(s.suffixes.Lookup(mc.md.Host), s.prefixes.Lookup(mc.md.Host))
+	before := func(i int) bool {
+		return best == noRule || i < best
 	}
+
+	cidrChecked := false
+	checkCIDR := func() {
+		cidrChecked = true
+		if ip := mc.IP(); ip != nil {
+			best = minIndex(best, s.cidrs.Lookup(ip))
+		}
+	}
+	for _, i := range s.linear {
+		if !before(i) {
+			break
+		}
+		if !cidrChecked && s.firstCIDR < i {
+			if checkCIDR(); !before(i) {
+				break
+			}
+		}
+		if s.rules[i].match(mc) {
+			best = i
+			break
+		}
+	}
+	if !cidrChecked && before(s.firstCIDR) && s.firstCIDR < len(s.rules) {
+		checkCIDR()
+	}
+	return best
+}
+
+func NewRuleManager(resolvers *ResolverManager, rules []string) (r *RuleManager, err error) {
+	parsed, err := ParseRules(rules)
+	if err != nil {
+		return
+	}
+	r = &RuleManager{}
+	r.Update(resolvers, parsed)
+	return
+}
+
+// ParseRules parse rules in string form, return error of the first bad rule
+func ParseRules(rules []string) (parsed []Rule, err error) {
+	parsed = make([]Rule, 0, len(rules))
 	for _, str := range rules {
 		ru, err := NewRule(str)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %q", err, str)
 		}
-		r.rules = append(r.rules, ru)
+		parsed = append(parsed, ru)
 	}
-
 	return
 }
 
-func (r *RuleManager) Get(host string) (server string) {
-	if strings.Contains(host, ":") {
-		ary := strings.Split(host, ":")
-		host = ary[0]
+// ParseRuleCfgs parse rules of config in string or object form, return error of the first bad rule
+func ParseRuleCfgs(cfgs []config.Rule) (parsed []Rule, err error) {
+	parsed = make([]Rule, 0, len(cfgs))
+	for i, c := range cfgs {
+		ru, err := NewRuleFromCfg(c)
+		if err != nil {
+			if c.Action == "" {
+				return nil, fmt.Errorf("%w: %q", err, c.Cond)
+			}
+			return nil, fmt.Errorf("%w: rule %d", err, i+1)
+		}
+		parsed = append(parsed, ru)
 	}
-	for _, ru := range r.rules {
-		if ru.Match(r.resolvers, host) {
-			server = ru.Server
-			return
+	return
+}
+
+// Update replace rules and resolvers atomically, matching requests use the old ones
+func (r *RuleManager) Update(resolvers *ResolverManager, rules []Rule) {
+	r.set.Store(newRuleSet(resolvers, rules))
+}
+
+// Metadata of request used to match rules
+type Metadata struct {
+	Host    string // host or host:port
+	Port    int    // destination port, taken from Host if not set
+	Network string // tcp or udp, default is tcp
+	Source  string // address of client, ip or ip:port
+	Inbound string // listener accepting the request, http or socks
+	User    string // authenticated user, empty if auth is disabled
+}
+
+func (r *RuleManager) Get(md *Metadata) (server string) {
+	m := *md
+	if host, port, err := net.SplitHostPort(m.Host); err == nil {
+		m.Host = host
+		if m.Port == 0 {
+			m.Port, _ = strconv.Atoi(port)
 		}
 	}
+	if m.Network == "" {
+		m.Network = "tcp"
+	}
+	set := r.set.Load()
+	if i := set.match(&matchCtx{rs: set.resolvers, md: &m}); i != noRule {
+		server = set.rules[i].Server
+	}
 	return
 }
 
@@ -71,28 +218,107 @@ type Rule struct {
 	Action    RuleActionType
 	CondParam string
 	Server    string
+
+	re       *regexp.Regexp // compiled host-regexp
+	ipnet    *net.IPNet     // parsed ip-cidr
+	cidrs    *cidrTree      // src-ip-cidr
+	ports    [][2]int       // dst-port
+	values   []string       // network, inbound and domain-keyword in lower case
+	asns     []uint         // ip-asn
+	provider *RuleProvider  // set by bindProviders for rule-set
+	conds    []Rule         // conditions of and, or, not
+	target   string         // server of server-state
+	forwards *ForwardManger // set by bindForwards for server-state
 }
 
+// NewRule parse a rule in string form "cond: param, action"
 func NewRule(s string) (r Rule, err error) {
-	ary := strings.Split(s, ",")
-	if len(ary) != 2 {
+	// action never contains comma, so param may have one, like a{1,3} in host-regexp
+	i := strings.LastIndex(s, ",")
+	if i < 0 {
 		err = RuleFormatError
 		return
 	}
+	if r, err = newCond(s[:i]); err != nil {
+		return
+	}
+	err = r.setAction(s[i+1:])
+	return
+}
 
-	ru := strings.TrimSpace(ary[0])
-	action := strings.TrimSpace(ary[1])
-
-	ruAry := strings.Split(ru, ":")
-	r.CondType = RuleCondType(ruAry[0])
-	if len(ruAry) == 2 {
-		r.CondParam = strings.TrimSpace(ruAry[1])
+// NewRuleFromCfg parse a rule of config, the string form if action is empty
+func NewRuleFromCfg(c config.Rule) (r Rule, err error) {
+	if c.Action == "" {
+		if c.And != nil || c.Or != nil || c.Not != nil {
+			return r, fmt.Errorf("%w: action is required", RuleFormatError)
+		}
+		return NewRule(c.Cond)
+	}
+	if r, err = newCondFromCfg(c); err != nil {
+		return
 	}
+	err = r.setAction(c.Action)
+	return
+}
+
+// newCond parse a condition "cond: param"
+func newCond(s string) (r Rule, err error) {
+	// only split at the first colon, param may be an ipv6 cidr
+	cond, param, _ := strings.Cut(s, ":")
+	r.CondType = RuleCondType(strings.TrimSpace(cond))
+	r.CondParam = strings.TrimSpace(param)
 	if !isLegalRuleCondType(r.CondType) {
 		err = RuleFormatError
 		return
 	}
+	if err = r.compile(); err != nil {
+		return r, fmt.Errorf("%w: %v", RuleFormatError, err)
+	}
+	return
+}
+
+// newCondFromCfg parse a condition of config, exactly one of cond, and, or, not is set
+func newCondFromCfg(c config.Rule) (r Rule, err error) {
+	set := 0
+	for _, ok := range []bool{c.Cond != "", c.And != nil, c.Or != nil, c.Not != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return r, fmt.Errorf("%w: need exactly one of cond, and, or, not", RuleFormatError)
+	}
 
+	var subs []config.Rule
+	switch {
+	case c.Cond != "":
+		return newCond(c.Cond)
+	case c.And != nil:
+		r.CondType, subs = RuleCondTypeAnd, c.And
+	case c.Or != nil:
+		r.CondType, subs = RuleCondTypeOr, c.Or
+	case c.Not != nil:
+		r.CondType, subs = RuleCondTypeNot, []config.Rule{*c.Not}
+	}
+	if len(subs) == 0 {
+		return r, fmt.Errorf("%w: %v without condition", RuleFormatError, r.CondType)
+	}
+	for _, sub := range subs {
+		if sub.Action != "" {
+			return r, fmt.Errorf("%w: action %q in %v condition", RuleFormatError, sub.Action, r.CondType)
+		}
+		var cond Rule
+		if cond, err = newCondFromCfg(sub); err != nil {
+			return
+		}
+		r.conds = append(r.conds, cond)
+	}
+	return
+}
+
+// setAction parse action "reject", "direct" or "forward: name"
+func (r *Rule) setAction(action string) (err error) {
+	action = strings.TrimSpace(action)
 	if strings.HasPrefix(action, string(RuleActionTypeReject)) {
 		r.Action = RuleActionTypeReject
 		r.Server = string(RuleActionTypeReject)
@@ -103,19 +329,122 @@ func NewRule(s string) (r Rule, err error) {
 		r.Action = RuleActionTypeForward
 		acts := strings.Split(action, ":")
 		if len(acts) != 2 {
-			err = RuleFormatError
-			return
+			return RuleFormatError
 		}
 		r.Server = strings.TrimSpace(acts[1])
 	} else {
-		err = RuleFormatError
+		return RuleFormatError
+	}
+	return
+}
+
+// walk call f with the rule and all conditions in it
+func (r *Rule) walk(f func(*Rule) error) error {
+	if err := f(r); err != nil {
+		return err
+	}
+	for i := range r.conds {
+		if err := r.conds[i].walk(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String return the condition, like "and(geo: CN, not(host-suffix: corp.com))"
+func (r *Rule) String() string {
+	if len(r.conds) == 0 {
+		if r.CondParam == "" {
+			return string(r.CondType)
+		}
+		return fmt.Sprintf("%v: %v", r.CondType, r.CondParam)
+	}
+	subs := make([]string, 0, len(r.conds))
+	for i := range r.conds {
+		subs = append(subs, r.conds[i].String())
+	}
+	return fmt.Sprintf("%v(%v)", r.CondType, strings.Join(subs, ", "))
+}
+
+// compile parse param of condition, so matching need not parse it again
+func (r *Rule) compile() (err error) {
+	param := r.CondParam
+	var items []string
+	for _, item := range strings.Split(param, ruleParamSep) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	switch r.CondType {
+	case RuleCondTypeHostRegexp:
+		r.re, err = regexp.Compile(param)
+	case RuleCondTypeIPCIDR:
+		_, r.ipnet, err = net.ParseCIDR(param)
+	case RuleCondTypeSrcIPCIDR:
+		r.cidrs = newCIDRTree()
+		for _, item := range items {
+			var ipnet *net.IPNet
+			if _, ipnet, err = net.ParseCIDR(item); err != nil {
+				return
+			}
+			r.cidrs.Insert(ipnet, 0)
+		}
+	case RuleCondTypeDstPort:
+		for _, item := range items {
+			var pr [2]int
+			if pr, err = util.ParsePortRange(item); err != nil {
+				return
+			}
+			r.ports = append(r.ports, pr)
+		}
+	case RuleCondTypeNetwork, RuleCondTypeInbound, RuleCondTypeDomainKeyword:
+		for _, item := range items {
+			r.values = append(r.values, strings.ToLower(item))
+		}
+	case RuleCondTypeServerState:
+		name, states, _ := strings.Cut(param, "=")
+		if r.target = strings.TrimSpace(name); r.target == "" {
+			return errors.New("server of server-state is required")
+		}
+		for _, state := range strings.Split(states, ruleParamSep) {
+			switch st := HealthState(strings.ToLower(strings.TrimSpace(state))); st {
+			case HealthHealthy, HealthDegraded, HealthDown:
+				r.values = append(r.values, string(st))
+			default:
+				return fmt.Errorf("unknown server state %q", state)
+			}
+		}
+	case RuleCondTypeIPASN:
+		for _, item := range items {
+			var asn uint64
+			if asn, err = strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(item), "AS"), 10, 32); err != nil {
+				return fmt.Errorf("asn %q format error", item)
+			}
+			r.asns = append(r.asns, uint(asn))
+		}
+	}
+	if err != nil {
 		return
 	}
 
+	switch r.CondType {
+	case RuleCondTypeHostRegexp, RuleCondTypeIPCIDR, RuleCondTypeMatchAll, RuleCondTypeUser,
+		RuleCondTypeHostMatch, RuleCondTypeHostPrefix, RuleCondTypeHostSuffix, RuleCondTypeGEO:
+	default:
+		if len(items) == 0 {
+			return fmt.Errorf("param of %v is required", r.CondType)
+		}
+	}
 	return
 }
 
-func (r *Rule) Match(rs *ResolverManager, host string) (ok bool) {
+func (r *Rule) Match(rs *ResolverManager, md *Metadata) (ok bool) {
+	return r.match(&matchCtx{rs: rs, md: md})
+}
+
+func (r *Rule) match(mc *matchCtx) (ok bool) {
+	host := mc.md.Host
 	switch r.CondType {
 	case RuleCondTypeHostMatch:
 		ok = strings.Contains(host, r.CondParam)
@@ -124,27 +453,97 @@ func (r *Rule) Match(rs *ResolverManager, host string) (ok bool) {
 	case RuleCondTypeHostSuffix:
 		ok = strings.HasSuffix(host, r.CondParam)
 	case RuleCondTypeHostRegexp:
-		reg := regexp.MustCompile(r.CondParam)
-		ok = reg.Match([]byte(host))
+		ok = r.re.MatchString(host)
 	case RuleCondTypeGEO:
-		ct := rs.Country(host)
-		if ct == r.CondParam {
-			ok = true
-		}
+		ok = util.Country(mc.IP()) == r.CondParam
 	case RuleCondTypeIPCIDR:
-		_, ipnet, _ := net.ParseCIDR(r.CondParam)
-		ok = ipnet.Contains(rs.Lookup(host))
+		ok = r.ipnet.Contains(mc.IP())
+	case RuleCondTypeUser:
+		ok = mc.md.User == r.CondParam
+	case RuleCondTypeRuleSet:
+		ok = r.provider != nil && r.provider.match(mc)
 	case RuleCondTypeMatchAll:
 		ok = true
+	case RuleCondTypeAnd:
+		for i := range r.conds {
+			if !r.conds[i].match(mc) {
+				return false
+			}
+		}
+		ok = true
+	case RuleCondTypeOr:
+		for i := range r.conds {
+			if r.conds[i].match(mc) {
+				return true
+			}
+		}
+	case RuleCondTypeNot:
+		ok = !r.conds[0].match(mc)
+	case RuleCondTypeDstPort:
+		for _, pr := range r.ports {
+			if mc.md.Port >= pr[0] && mc.md.Port <= pr[1] {
+				return true
+			}
+		}
+	case RuleCondTypeSrcIPCIDR:
+		ip := mc.SourceIP()
+		ok = ip != nil && r.cidrs.Lookup(ip) != noRule
+	case RuleCondTypeNetwork:
+		ok = containsFold(r.values, mc.md.Network)
+	case RuleCondTypeInbound:
+		ok = containsFold(r.values, mc.md.Inbound)
+	case RuleCondTypeDomainKeyword:
+		lower := strings.ToLower(host)
+		for _, k := range r.values {
+			if strings.Contains(lower, k) {
+				return true
+			}
+		}
+	case RuleCondTypeServerState:
+		ok = r.forwards != nil && containsFold(r.values, string(r.forwards.ServerState(r.target)))
+	case RuleCondTypeIPASN:
+		if asn := util.ASN(mc.IP()); asn != 0 {
+			for _, a := range r.asns {
+				if a == asn {
+					return true
+				}
+			}
+		}
 	}
 	return
 }
 
+// bindForwards set forwards of server-state rules
+func bindForwards(rules []Rule, forwards *ForwardManger) {
+	for i := range rules {
+		_ = rules[i].walk(func(r *Rule) error {
+			if r.CondType == RuleCondTypeServerState {
+				r.forwards = forwards
+			}
+			return nil
+		})
+	}
+}
+
+// containsFold return true if lower case values contain s
+func containsFold(values []string, s string) bool {
+	s = strings.ToLower(s)
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 func isLegalRuleCondType(c RuleCondType) (ok bool) {
 	switch c {
 	case RuleCondTypeHostMatch, RuleCondTypeHostPrefix, RuleCondTypeHostSuffix,
 		RuleCondTypeHostRegexp, RuleCondTypeGEO, RuleCondTypeIPCIDR,
-		RuleCondTypeMatchAll:
+		RuleCondTypeUser, RuleCondTypeRuleSet, RuleCondTypeMatchAll,
+		RuleCondTypeDstPort, RuleCondTypeSrcIPCIDR, RuleCondTypeNetwork,
+		RuleCondTypeInbound, RuleCondTypeIPASN, RuleCondTypeDomainKeyword,
+		RuleCondTypeServerState:
 		ok = true
 	}
 
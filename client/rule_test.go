@@ -89,9 +89,139 @@ func TestRuleManager_Get(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if gotServer := r.Get(tt.args.host); gotServer != tt.wantServer {
+			if gotServer := r.Get(&Metadata{Host: tt.args.host}); gotServer != tt.wantServer {
 				t.Errorf("Get() = %v, want %v", gotServer, tt.wantServer)
 			}
 		})
 	}
 }
+
+func TestRuleManager_Update(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resolvers, err := NewResolverManger(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRuleManager(resolvers, []string{"host-suffix: example.com, reject", "match-all, direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Get(&Metadata{Host: "www.example.com:443"}); got != "reject" {
+		t.Errorf("Get() = %v, want reject", got)
+	}
+
+	if _, err = ParseRules([]string{"match-all, direct", "bad rule"}); err == nil {
+		t.Error("ParseRules() want error for bad rule")
+	}
+	rules, err := ParseRules([]string{"host-suffix: example.com, forward: local", "match-all, direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Update(resolvers, rules)
+	if got := r.Get(&Metadata{Host: "www.example.com:443"}); got != "local" {
+		t.Errorf("Get() after update = %v, want local", got)
+	}
+}
+
+func TestRuleManager_GetMetadata(t *testing.T) {
+	r, err := NewRuleManager(nil, []string{
+		"domain-keyword: Tracker|ads, reject",
+		"network: udp, forward: udp",
+		"dst-port: 22|8000-8999, forward: port",
+		"src-ip-cidr: 192.168.1.0/24|fd00::/8, forward: lan",
+		"inbound: http, forward: http",
+		"match-all, direct",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		md   Metadata
+		want string
+	}{
+		{"keyword", Metadata{Host: "www.TRACKER.com:443"}, "reject"},
+		{"udp", Metadata{Host: "8.8.8.8:53", Network: "udp"}, "udp"},
+		{"port from host", Metadata{Host: "example.com:8080"}, "port"},
+		{"port", Metadata{Host: "example.com", Port: 22}, "port"},
+		{"source", Metadata{Host: "example.com:443", Source: "192.168.1.10:50000"}, "lan"},
+		{"source ipv6", Metadata{Host: "example.com:443", Source: "[fd00::1]:50000"}, "lan"},
+		{"inbound", Metadata{Host: "example.com:443", Source: "10.0.0.1:1", Inbound: InboundHttp}, "http"},
+		{"default", Metadata{Host: "example.com:443", Inbound: InboundSocks}, "direct"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.Get(&tt.md); got != tt.want {
+				t.Errorf("Get() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"dst-port: 70000, direct", "src-ip-cidr: 10.0.0.1, direct", "ip-asn: ASx, direct", "network: , direct"} {
+		if _, err = NewRule(bad); err == nil {
+			t.Errorf("NewRule(%q) want error", bad)
+		}
+	}
+}
+
+func TestNewRuleFromCfg(t *testing.T) {
+	// geo CN AND port 443 AND NOT host-suffix corp.com -> direct, without geo database geo is replaced by ip-cidr
+	rules, err := ParseRuleCfgs([]config.Rule{
+		{
+			And: []config.Rule{
+				{Cond: "ip-cidr: 10.0.0.0/8"},
+				{Cond: "dst-port: 443"},
+				{Not: &config.Rule{Cond: "host-suffix: corp.com"}},
+			},
+			Action: "direct",
+		},
+		{
+			Or:     []config.Rule{{Cond: "host-suffix: ads.com"}, {Cond: "domain-keyword: tracker"}},
+			Action: "reject",
+		},
+		{Cond: "host-regexp: ^a{1,3}\\.com$, reject"},
+		{Cond: "match-all, forward: local"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules[0].String(); got != "and(ip-cidr: 10.0.0.0/8, dst-port: 443, not(host-suffix: corp.com))" {
+		t.Errorf("String() = %v", got)
+	}
+	r := &RuleManager{}
+	r.Update(nil, rules)
+	tests := map[string]string{
+		"10.1.1.1:443":      "direct",
+		"10.1.1.1:80":       "local",
+		"www.ads.com:443":   "reject",
+		"tracker.net:80":    "reject",
+		"aa.com:80":         "reject",
+		"aaaa.com:80":       "local",
+		"11.1.1.1:443":      "local",
+		"git.corp.com:443":  "local",
+		"www.example.com:1": "local",
+	}
+	for host, want := range tests {
+		if got := r.Get(&Metadata{Host: host}); got != want {
+			t.Errorf("Get(%v) = %v, want %v", host, got, want)
+		}
+	}
+
+	bad := []config.Rule{
+		{Cond: "host-suffix: a.com"},
+		{And: []config.Rule{{Cond: "geo: CN"}}},
+		{And: []config.Rule{}, Action: "direct"},
+		{Cond: "geo: CN", Not: &config.Rule{Cond: "geo: US"}, Action: "direct"},
+		{Or: []config.Rule{{Cond: "geo: CN", Action: "reject"}}, Action: "direct"},
+		{Not: &config.Rule{Cond: "no-such: x"}, Action: "direct"},
+		{Cond: "and: geo: CN, direct"},
+		{Cond: "geo: CN", Action: "proxy"},
+	}
+	for _, c := range bad {
+		if _, err = NewRuleFromCfg(c); err == nil {
+			t.Errorf("NewRuleFromCfg(%+v) want error", c)
+		}
+	}
+}
@@ -1,23 +1,31 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"sync/atomic"
 	"through/log"
 	"through/proto"
+	"through/util"
+	"time"
 )
 
 const (
 	Socks5Version = 0x05
 
 	SocksNoAuthentication    = 0x00
+	SocksUserPassAuth        = 0x02
 	SocksNoAcceptableMethods = 0xFF
 
+	SocksUserPassVersion = 0x01
+	SocksAuthSuccess     = 0x00
+	SocksAuthFailure     = 0x01
+
 	SocksIPv4Host   = 0x01
 	SocksIPv6Host   = 0x04
 	SocksDomainHost = 0x03
@@ -40,51 +48,114 @@ const (
 var (
 	UnSupportVersion = errors.New("unsupported socks version")
 	UnSupportCommand = errors.New("unsupported command")
+	UnSupportAddress = errors.New("unsupported address type")
+	NoAcceptableAuth = errors.New("no acceptable auth method")
+	AuthFailed       = errors.New("username or password incorrect")
 )
 
 // SocksProxy socks5 proxy
 type SocksProxy struct {
 	forwardManager *ForwardManger
 	ruleManager    *RuleManager
+	users          UserStore // nil if auth is disabled
 }
 
-func NewSocksProxy(ctx context.Context, forwards *ForwardManger, rules *RuleManager) (s *SocksProxy) {
+func NewSocksProxy(ctx context.Context, forwards *ForwardManger, rules *RuleManager, users UserStore) (s *SocksProxy) {
 	return &SocksProxy{
 		forwardManager: forwards,
 		ruleManager:    rules,
+		users:          users,
 	}
 }
 
 func (s *SocksProxy) Serve(conn net.Conn) {
 	go func() {
-		meta, err := s.readMetaFromConn(conn)
+		user, cmd, meta, err := s.readMetaFromConn(conn)
 		if err != nil {
 			log.Errorf("reader meta error: %v", err)
 			_ = conn.Close()
 			return
 		}
 
-		server := s.ruleManager.Get(meta.GetAddress())
+		switch cmd {
+		case SocksCmdUDPAssociate:
+			s.associate(conn, user)
+			return
+		case SocksCmdBind:
+			s.bind(conn, meta, user)
+			return
+		}
+
+		server := s.ruleManager.Get(&Metadata{Host: meta.GetAddress(), Source: conn.RemoteAddr().String(), Inbound: InboundSocks, User: user})
 		f, ok := s.forwardManager.GetForward(server)
 		if !ok {
-			log.Infof("host %v math no server", meta.GetAddress())
+			log.Infof("host %v user %v math no server", meta.GetAddress(), user)
+			_ = s.reply(conn, StatusConnectNotAllow, "")
+			_ = conn.Close()
+			return
+		}
+		log.Infof("socks host %v user %v math server %v", meta.GetAddress(), user, server)
+
+		// reply after dial, so client knows whether the connection is established
+		remote, err := f.Dial(context.Background(), meta)
+		if err != nil {
+			_ = s.reply(conn, replyStatus(err), "")
+			_ = conn.Close()
+			return
+		}
+
+		if err = s.reply(conn, StatusSuccess, boundAddr(remote)); err != nil {
+			log.Errorf("write rsp error: %v", err)
+			_ = remote.Close()
 			_ = conn.Close()
 			return
 		}
-		log.Infof("socks host %v math server %v", meta.GetAddress(), server)
 
-		f.Connect(conn, meta)
+		util.CopyLoopWait(conn, remote)
 	}()
 }
 
-func (s *SocksProxy) readMetaFromConn(conn net.Conn) (meta *proto.Meta, err error) {
-	if err = s.auth(conn); err != nil {
+// replyStatus map dial error to REP code, error responded by server is mapped by its status
+func replyStatus(err error) byte {
+	if errors.Is(err, RejectError) {
+		return StatusConnectNotAllow
+	}
+	switch proto.StatusOf(err) {
+	case proto.Status_NOT_ALLOWED:
+		return StatusConnectNotAllow
+	case proto.Status_CONNECTION_REFUSED:
+		return StatusConnectRefuse
+	case proto.Status_NETWORK_UNREACHABLE:
+		return StatusNetworkUnReachable
+	case proto.Status_HOST_UNREACHABLE:
+		return StatusHostUnReachable
+	case proto.Status_TIMEOUT:
+		// no dedicated code for timeout, TTL expired is the closest one
+		return StatusTTLExpire
+	case proto.Status_UNSUPPORTED:
+		return StatusCommandNotSupport
+	}
+	return StatusGenSocksFail
+}
+
+// boundAddr return the address server bound for remote, fallback to local address
+func boundAddr(remote net.Conn) string {
+	if b, ok := remote.(interface{ BoundAddr() string }); ok && b.BoundAddr() != "" {
+		return b.BoundAddr()
+	}
+	return remote.LocalAddr().String()
+}
+
+func (s *SocksProxy) readMetaFromConn(conn net.Conn) (user string, cmd byte, meta *proto.Meta, err error) {
+	if user, err = s.auth(conn); err != nil {
 		return
 	}
-	return s.connect(conn)
+	cmd, meta, err = s.connect(conn)
+	return
 }
 
-func (s *SocksProxy) auth(conn net.Conn) (err error) {
+// auth negotiate method with client, return the username if auth is enabled
+func (s *SocksProxy) auth(conn net.Conn) (user string, err error) {
 	/*
 		+----+----------+----------+
 		|VER | NMETHODS | METHODS  |
@@ -121,9 +192,19 @@ func (s *SocksProxy) auth(conn net.Conn) (err error) {
 		| 1  |   1    |
 		+----+--------+
 	*/
-	_, err = conn.Write([]byte{Socks5Version, SocksNoAuthentication})
+	if s.users == nil {
+		_, err = conn.Write([]byte{Socks5Version, SocksNoAuthentication})
+		return
+	}
+
+	if bytes.IndexByte(buf[:nMethods], SocksUserPassAuth) < 0 {
+		_, _ = conn.Write([]byte{Socks5Version, SocksNoAcceptableMethods})
+		return "", NoAcceptableAuth
+	}
+	if _, err = conn.Write([]byte{Socks5Version, SocksUserPassAuth}); err != nil {
+		return
+	}
 
-	// todo support auth
 	/*
 		+----+------+----------+------+----------+
 		|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
@@ -131,11 +212,44 @@ func (s *SocksProxy) auth(conn net.Conn) (err error) {
 		| 1  |  1   | 1 to 255 |  1   | 1 to 255 |
 		+----+------+----------+------+----------+
 	*/
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if buf[0] != SocksUserPassVersion {
+		return "", UnSupportVersion
+	}
+	uname := make([]byte, buf[1])
+	if _, err = io.ReadFull(conn, uname); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+		return
+	}
+	passwd := make([]byte, buf[0])
+	if _, err = io.ReadFull(conn, passwd); err != nil {
+		return
+	}
+
+	/*
+		+----+--------+
+		|VER | STATUS |
+		+----+--------+
+		| 1  |   1    |
+		+----+--------+
+	*/
+	if !s.users.Authenticate(string(uname), string(passwd)) {
+		_, _ = conn.Write([]byte{SocksUserPassVersion, SocksAuthFailure})
+		log.Warnf("socks user %q auth failed from %v", uname, conn.RemoteAddr())
+		return "", AuthFailed
+	}
+	if _, err = conn.Write([]byte{SocksUserPassVersion, SocksAuthSuccess}); err != nil {
+		return
+	}
 
-	return
+	return string(uname), nil
 }
 
-func (s *SocksProxy) connect(conn net.Conn) (meta *proto.Meta, err error) {
+func (s *SocksProxy) connect(conn net.Conn) (cmd byte, meta *proto.Meta, err error) {
 	meta = &proto.Meta{
 		Net: "tcp",
 	}
@@ -160,60 +274,34 @@ func (s *SocksProxy) connect(conn net.Conn) (meta *proto.Meta, err error) {
 	*/
 
 	// read header
-	header := make([]byte, 4)
-	if _, err = io.ReadFull(conn, header[:4]); err != nil {
+	header := make([]byte, 3)
+	if _, err = io.ReadFull(conn, header); err != nil {
 		return
 	}
 
-	ver, cmd, _, atyp := header[0], header[1], header[2], header[3]
+	ver, cmd := header[0], header[1]
 	if ver != Socks5Version {
-		return nil, UnSupportVersion
+		return cmd, nil, UnSupportVersion
 	}
 
-	// todo support other command
-	if cmd != SocksCmdConnect {
-		return nil, UnSupportCommand
+	if cmd != SocksCmdConnect && cmd != SocksCmdBind && cmd != SocksCmdUDPAssociate {
+		_ = s.reply(conn, StatusCommandNotSupport, "")
+		return cmd, nil, UnSupportCommand
 	}
 
-	var addr string
-
 	// handle address
-	switch atyp {
-	case SocksIPv4Host:
-		addrByte := make([]byte, 4)
-		if _, err = io.ReadFull(conn, addrByte); err != nil {
-			return
-		}
-		addr = string(addrByte)
-	case SocksIPv6Host:
-		addrByte := make([]byte, 16)
-		if _, err = io.ReadFull(conn, addrByte); err != nil {
-			return
-		}
-		addr = string(addrByte)
-	case SocksDomainHost:
-		addrLen := make([]byte, 1)
-		if _, err = io.ReadFull(conn, addrLen); err != nil {
-			return
+	if meta.Address, err = readAddr(conn); err != nil {
+		if errors.Is(err, UnSupportAddress) {
+			_ = s.reply(conn, StatusAddressNotSupport, "")
 		}
-		addrByte := make([]byte, int(addrLen[0]))
-		if _, err = io.ReadFull(conn, addrByte); err != nil {
-			return
-		}
-		addr = string(addrByte)
-	default:
-		return nil, errors.New("unsupported address type")
+		return cmd, nil, err
 	}
 
-	// read the port
-	portByte := make([]byte, 2)
-	if _, err = io.ReadFull(conn, portByte); err != nil {
-		return nil, err
-	}
-	port := binary.BigEndian.Uint16(portByte)
-
-	meta.Address = fmt.Sprintf("%s:%d", addr, port)
+	return
+}
 
+// reply write the response of request, addr is the bound address
+func (s *SocksProxy) reply(conn net.Conn, status byte, addr string) (err error) {
 	/*
 		+----+-----+-------+------+----------+----------+
 		|VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
@@ -239,18 +327,160 @@ func (s *SocksProxy) connect(conn net.Conn) (meta *proto.Meta, err error) {
 	*/
 
 	// write response
-	resp := []byte{Socks5Version, StatusSuccess, 0x00}
-	resp = append(resp, s.parseAddr(conn.LocalAddr().String())...)
-	_, err = conn.Write(resp)
-	if err != nil {
-		return nil, errors.New("write rsp: " + err.Error())
+	resp := []byte{Socks5Version, status, 0x00}
+	resp = append(resp, parseAddr(addr)...)
+	if _, err = conn.Write(resp); err != nil {
+		return errors.New("write rsp: " + err.Error())
 	}
 
 	return
 }
 
+// associate handle UDP ASSOCIATE, the association lives until the control connection closed
+func (s *SocksProxy) associate(conn net.Conn, user string) {
+	defer conn.Close()
+
+	// listen udp on the same ip which client connected to
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		log.Errorf("listen udp error: %v", err)
+		_ = s.reply(conn, StatusGenSocksFail, "")
+		return
+	}
+	defer pc.Close()
+
+	if err = s.reply(conn, StatusSuccess, pc.LocalAddr().String()); err != nil {
+		log.Errorf("write rsp error: %v", err)
+		return
+	}
+
+	clientIP := net.IPv4zero
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = tcpAddr.IP
+	}
+	log.Infof("socks udp associate at %v for %v", pc.LocalAddr(), conn.RemoteAddr())
+
+	association := newUdpAssociation(s, pc, clientIP, user)
+	go association.serve()
+
+	// the control connection carry no data, wait until it closed
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+// bind handle BIND, reply twice: once listening and once the inbound connection accepted
+func (s *SocksProxy) bind(conn net.Conn, meta *proto.Meta, user string) {
+	server := s.ruleManager.Get(&Metadata{Host: meta.GetAddress(), Source: conn.RemoteAddr().String(), Inbound: InboundSocks, User: user})
+	f, ok := s.forwardManager.GetForward(server)
+	if !ok {
+		log.Infof("host %v user %v math no server", meta.GetAddress(), user)
+		_ = s.reply(conn, StatusConnectNotAllow, "")
+		_ = conn.Close()
+		return
+	}
+	log.Infof("socks bind host %v user %v math server %v", meta.GetAddress(), user, server)
+
+	binding, err := f.Bind(meta)
+	if err != nil {
+		log.Errorf("bind error: %v", err)
+		_ = s.reply(conn, replyStatus(err), "")
+		_ = conn.Close()
+		return
+	}
+	defer binding.Close()
+
+	if err = s.reply(conn, StatusSuccess, bindAddr(binding.Addr(), conn)); err != nil {
+		log.Errorf("write rsp error: %v", err)
+		_ = conn.Close()
+		return
+	}
+
+	// client send nothing until peer accepted, closing the connection cancel the bind
+	var accepted atomic.Bool
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		_, _ = conn.Read(make([]byte, 1))
+		if !accepted.Load() {
+			_ = binding.Close()
+		}
+	}()
+	remote, peer, err := binding.Accept()
+	accepted.Store(true)
+	_ = conn.SetReadDeadline(time.Now())
+	<-watching
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Errorf("bind accept error: %v", err)
+		_ = s.reply(conn, replyStatus(err), "")
+		_ = conn.Close()
+		return
+	}
+
+	if err = s.reply(conn, StatusSuccess, peer); err != nil {
+		log.Errorf("write rsp error: %v", err)
+		_ = remote.Close()
+		_ = conn.Close()
+		return
+	}
+
+	util.CopyLoopWait(conn, remote)
+}
+
+// bindAddr replace unspecified ip of bound address with the local ip client connect to
+func bindAddr(bound string, conn net.Conn) string {
+	host, port, err := net.SplitHostPort(bound)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsUnspecified() {
+		return bound
+	}
+	local, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	return net.JoinHostPort(local, port)
+}
+
+// readAddr read ATYP, DST.ADDR and DST.PORT from reader, return host:port
+func readAddr(reader io.Reader) (addr string, err error) {
+	atyp := make([]byte, 1)
+	if _, err = io.ReadFull(reader, atyp); err != nil {
+		return
+	}
+
+	var host string
+	switch atyp[0] {
+	case SocksIPv4Host, SocksIPv6Host:
+		size := net.IPv4len
+		if atyp[0] == SocksIPv6Host {
+			size = net.IPv6len
+		}
+		addrByte := make([]byte, size)
+		if _, err = io.ReadFull(reader, addrByte); err != nil {
+			return
+		}
+		host = net.IP(addrByte).String()
+	case SocksDomainHost:
+		addrLen := make([]byte, 1)
+		if _, err = io.ReadFull(reader, addrLen); err != nil {
+			return
+		}
+		addrByte := make([]byte, int(addrLen[0]))
+		if _, err = io.ReadFull(reader, addrByte); err != nil {
+			return
+		}
+		host = string(addrByte)
+	default:
+		return "", UnSupportAddress
+	}
+
+	portByte := make([]byte, 2)
+	if _, err = io.ReadFull(reader, portByte); err != nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(portByte)
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
 // parseAddr parses the address in string s. Returns nil if failed.
-func (s *SocksProxy) parseAddr(str string) (addr []byte) {
+func parseAddr(str string) (addr []byte) {
 	def := []byte{SocksIPv4Host, 0, 0, 0, 0, 0, 0}
 	host, port, err := net.SplitHostPort(str)
 	if err != nil {
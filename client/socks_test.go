@@ -0,0 +1,304 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"through/config"
+	"through/proto"
+	"time"
+)
+
+// newTestSocksProxy start a socks proxy with direct and reject forwards only
+func newTestSocksProxy(t *testing.T, rules []string, users UserStore) (addr string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	resolvers, err := NewResolverManger(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ruleManager, err := NewRuleManager(resolvers, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwards := &ForwardManger{}
+	forwards.forwardClients.Store(&map[string]Forward{
+		"direct": &DirectClient{},
+		"reject": &RejectClient{},
+	})
+	proxy := NewSocksProxy(ctx, forwards, ruleManager, users)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			proxy.Serve(conn)
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func dialSocks(t *testing.T, addr string) net.Conn {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// handshake negotiate no auth method
+func handshake(t *testing.T, conn net.Conn) {
+	if _, err := conn.Write([]byte{Socks5Version, 1, SocksNoAuthentication}); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp, []byte{Socks5Version, SocksNoAuthentication}) {
+		t.Fatalf("handshake response = %v", resp)
+	}
+}
+
+func readReply(t *testing.T, conn net.Conn) (rep byte, bound string) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("read reply error: %v", err)
+	}
+	if header[0] != Socks5Version {
+		t.Fatalf("reply version = %v", header[0])
+	}
+	bound, err := readAddr(conn)
+	if err != nil {
+		t.Fatalf("read reply address error: %v", err)
+	}
+	return header[1], bound
+}
+
+func sendRequest(t *testing.T, conn net.Conn, cmd byte, atyp byte, addr []byte, port uint16) {
+	req := []byte{Socks5Version, cmd, 0x00, atyp}
+	req = append(req, addr...)
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	msg := []byte("hello through")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("echo = %q, want %q", got, msg)
+	}
+}
+
+func TestSocksProxy_ConnectAddressTypes(t *testing.T) {
+	proxy := newTestSocksProxy(t, []string{
+		"ip-cidr: 127.0.0.0/8, direct",
+		"ip-cidr: ::1/128, direct",
+		"host-match: localhost, direct",
+		"match-all, reject",
+	}, nil)
+
+	v4Port := portOf(t, echoServer(t, "127.0.0.1:0"))
+
+	t.Run("ipv4", func(t *testing.T) {
+		conn := dialSocks(t, proxy)
+		handshake(t, conn)
+		sendRequest(t, conn, SocksCmdConnect, SocksIPv4Host, net.IPv4(127, 0, 0, 1).To4(), v4Port)
+		if rep, _ := readReply(t, conn); rep != StatusSuccess {
+			t.Fatalf("rep = %v, want %v", rep, StatusSuccess)
+		}
+		assertEcho(t, conn)
+	})
+
+	t.Run("domain", func(t *testing.T) {
+		conn := dialSocks(t, proxy)
+		handshake(t, conn)
+		host := []byte("localhost")
+		sendRequest(t, conn, SocksCmdConnect, SocksDomainHost, append([]byte{byte(len(host))}, host...), v4Port)
+		if rep, _ := readReply(t, conn); rep != StatusSuccess {
+			t.Fatalf("rep = %v, want %v", rep, StatusSuccess)
+		}
+		assertEcho(t, conn)
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		v6Port := portOf(t, echoServer(t, "[::1]:0"))
+		conn := dialSocks(t, proxy)
+		handshake(t, conn)
+		sendRequest(t, conn, SocksCmdConnect, SocksIPv6Host, net.IPv6loopback, v6Port)
+		if rep, _ := readReply(t, conn); rep != StatusSuccess {
+			t.Fatalf("rep = %v, want %v", rep, StatusSuccess)
+		}
+		assertEcho(t, conn)
+	})
+}
+
+func TestSocksProxy_ErrorReplies(t *testing.T) {
+	proxy := newTestSocksProxy(t, []string{
+		"host-suffix: missing.test, forward: missing",
+		"host-suffix: reject.test, reject",
+		"match-all, direct",
+	}, nil)
+
+	// a port nobody listen on
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := uint16(lis.Addr().(*net.TCPAddr).Port)
+	_ = lis.Close()
+
+	tests := []struct {
+		name    string
+		cmd     byte
+		atyp    byte
+		addr    []byte
+		port    uint16
+		wantRep byte
+	}{
+		{"command not supported", 0x09, SocksIPv4Host, []byte{127, 0, 0, 1}, 80, StatusCommandNotSupport},
+		{"address not supported", SocksCmdConnect, 0x05, []byte{127, 0, 0, 1}, 80, StatusAddressNotSupport},
+		{"no server matched", SocksCmdConnect, SocksDomainHost, append([]byte{12}, "missing.test"...), 80, StatusConnectNotAllow},
+		{"rejected by rule", SocksCmdConnect, SocksDomainHost, append([]byte{11}, "reject.test"...), 80, StatusConnectNotAllow},
+		{"connection refused", SocksCmdConnect, SocksIPv4Host, []byte{127, 0, 0, 1}, closedPort, StatusConnectRefuse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialSocks(t, proxy)
+			handshake(t, conn)
+			sendRequest(t, conn, tt.cmd, tt.atyp, tt.addr, tt.port)
+			if rep, _ := readReply(t, conn); rep != tt.wantRep {
+				t.Errorf("rep = %v, want %v", rep, tt.wantRep)
+			}
+		})
+	}
+
+	t.Run("unsupported version", func(t *testing.T) {
+		conn := dialSocks(t, proxy)
+		if _, err := conn.Write([]byte{0x04, 1, SocksNoAuthentication}); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := conn.Read(make([]byte, 2)); err == nil {
+			t.Errorf("read %d bytes, want connection closed", n)
+		}
+	})
+}
+
+func TestSocksProxy_UserPassAuth(t *testing.T) {
+	users := NewStaticUserStore([]config.User{{Username: "alice", Password: "alice-pwd"}})
+	proxy := newTestSocksProxy(t, []string{"match-all, direct"}, users)
+
+	auth := func(t *testing.T, username, password string) (status byte) {
+		conn := dialSocks(t, proxy)
+		if _, err := conn.Write([]byte{Socks5Version, 2, SocksNoAuthentication, SocksUserPassAuth}); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, 2)
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp[1] != SocksUserPassAuth {
+			t.Fatalf("method = %v, want %v", resp[1], SocksUserPassAuth)
+		}
+		req := []byte{SocksUserPassVersion, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp[1]
+	}
+
+	if status := auth(t, "alice", "alice-pwd"); status != SocksAuthSuccess {
+		t.Errorf("auth status = %v, want %v", status, SocksAuthSuccess)
+	}
+	if status := auth(t, "alice", "wrong"); status != SocksAuthFailure {
+		t.Errorf("auth status = %v, want %v", status, SocksAuthFailure)
+	}
+
+	t.Run("no acceptable methods", func(t *testing.T) {
+		conn := dialSocks(t, proxy)
+		if _, err := conn.Write([]byte{Socks5Version, 1, SocksNoAuthentication}); err != nil {
+			t.Fatal(err)
+		}
+		resp := make([]byte, 2)
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp[1] != SocksNoAcceptableMethods {
+			t.Errorf("method = %v, want %v", resp[1], SocksNoAcceptableMethods)
+		}
+	})
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestReplyStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"reject", RejectError, StatusConnectNotAllow},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, StatusConnectRefuse},
+		{"network unreachable", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, StatusNetworkUnReachable},
+		{"host unreachable", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, StatusHostUnReachable},
+		{"no such host", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}, StatusHostUnReachable},
+		{"timeout", &net.OpError{Op: "dial", Err: timeoutError{}}, StatusTTLExpire},
+		{"server refused", &proto.DialError{Status: proto.Status_CONNECTION_REFUSED}, StatusConnectRefuse},
+		{"server timeout", &proto.DialError{Status: proto.Status_TIMEOUT}, StatusTTLExpire},
+		{"server not allowed", &proto.DialError{Status: proto.Status_NOT_ALLOWED}, StatusConnectNotAllow},
+		{"other", errors.New("other"), StatusGenSocksFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replyStatus(tt.err); got != tt.want {
+				t.Errorf("replyStatus() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:80", "[::1]:443", "[2001:db8::1]:8080", "example.com:53"} {
+		got, err := readAddr(bytes.NewReader(parseAddr(addr)))
+		if err != nil {
+			t.Fatalf("readAddr(%v) error: %v", addr, err)
+		}
+		if got != addr {
+			t.Errorf("readAddr() = %v, want %v", got, addr)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"through/log"
+	"through/proto"
+)
+
+const maxDatagramSize = 64 * 1024
+
+// UdpRelay send and receive datagrams, address is in host:port format
+type UdpRelay interface {
+	ReadFrom() (data []byte, addr string, err error)
+	WriteTo(data []byte, addr string) (err error)
+	Close() error
+}
+
+// directRelay send datagrams from local
+type directRelay struct {
+	pc net.PacketConn
+}
+
+func (d *directRelay) ReadFrom() (data []byte, addr string, err error) {
+	buf := make([]byte, maxDatagramSize)
+	n, from, err := d.pc.ReadFrom(buf)
+	if err != nil {
+		return
+	}
+	return buf[:n], from.String(), nil
+}
+
+func (d *directRelay) WriteTo(data []byte, addr string) (err error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+	_, err = d.pc.WriteTo(data, udpAddr)
+	return
+}
+
+func (d *directRelay) Close() error {
+	return d.pc.Close()
+}
+
+// tunnelRelay send datagrams through server, datagrams are framed on the tunnel connection
+type tunnelRelay struct {
+	conn net.Conn
+	lc   sync.Mutex
+}
+
+func (t *tunnelRelay) ReadFrom() (data []byte, addr string, err error) {
+	dg, err := proto.ReadDatagram(t.conn)
+	if err != nil {
+		return
+	}
+	return dg.GetData(), dg.GetAddress(), nil
+}
+
+func (t *tunnelRelay) WriteTo(data []byte, addr string) (err error) {
+	t.lc.Lock()
+	defer t.lc.Unlock()
+	return proto.WriteDatagram(t.conn, &proto.Datagram{Address: addr, Data: data})
+}
+
+func (t *tunnelRelay) Close() error {
+	return t.conn.Close()
+}
+
+// udpAssociation serve one socks5 UDP ASSOCIATE request,
+// every datagram is routed by rule of its destination
+type udpAssociation struct {
+	proxy    *SocksProxy
+	pc       net.PacketConn
+	clientIP net.IP
+	user     string
+
+	lc     sync.Mutex
+	client net.Addr
+	relays map[string]UdpRelay
+}
+
+func newUdpAssociation(proxy *SocksProxy, pc net.PacketConn, clientIP net.IP, user string) *udpAssociation {
+	return &udpAssociation{
+		proxy:    proxy,
+		pc:       pc,
+		clientIP: clientIP,
+		user:     user,
+		relays:   make(map[string]UdpRelay),
+	}
+}
+
+// serve read datagrams from socks client until pc is closed
+func (a *udpAssociation) serve() {
+	defer a.close()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := a.pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Errorf("read socks udp error: %v", err)
+			}
+			return
+		}
+
+		// only accept datagram from the client who request association
+		if udpAddr, ok := from.(*net.UDPAddr); !ok || !udpAddr.IP.Equal(a.clientIP) {
+			log.Debugf("drop datagram from %v", from)
+			continue
+		}
+
+		addr, data, err := parseUdpHeader(buf[:n])
+		if err != nil {
+			log.Debugf("parse socks udp header error: %v", err)
+			continue
+		}
+
+		a.lc.Lock()
+		a.client = from
+		a.lc.Unlock()
+
+		server := a.proxy.ruleManager.Get(&Metadata{Host: addr, Network: proto.NetUDP, Source: from.String(), Inbound: InboundSocks, User: a.user})
+		relay, err := a.getRelay(server, addr)
+		if err != nil {
+			log.Debugf("udp host %v match server %v, drop: %v", addr, server, err)
+			continue
+		}
+		log.Debugf("udp host %v match server %v", addr, server)
+
+		if err = relay.WriteTo(data, addr); err != nil {
+			log.Debugf("write datagram to %v error: %v", addr, err)
+			a.removeRelay(server, relay)
+		}
+	}
+}
+
+// getRelay return the relay of server, create one for the first datagram to addr if not exist
+func (a *udpAssociation) getRelay(server, addr string) (relay UdpRelay, err error) {
+	a.lc.Lock()
+	defer a.lc.Unlock()
+	if relay, ok := a.relays[server]; ok {
+		return relay, nil
+	}
+
+	f, ok := a.proxy.forwardManager.GetForward(server)
+	if !ok {
+		return nil, errors.New("rule match no server")
+	}
+	if relay, err = f.Relay(&proto.Meta{Net: proto.NetUDP, Address: addr}); err != nil {
+		return
+	}
+	a.relays[server] = relay
+	go a.receive(server, relay)
+	return
+}
+
+// removeRelay close the broken relay of server, the next datagram create a new one
+func (a *udpAssociation) removeRelay(server string, relay UdpRelay) {
+	a.lc.Lock()
+	if a.relays[server] == relay {
+		delete(a.relays, server)
+	}
+	a.lc.Unlock()
+	_ = relay.Close()
+}
+
+// receive datagrams from relay and send back to socks client, the relay is removed once it's broken
+func (a *udpAssociation) receive(server string, relay UdpRelay) {
+	for {
+		data, addr, err := relay.ReadFrom()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Debugf("udp relay of server %v is broken: %v", server, err)
+			}
+			a.removeRelay(server, relay)
+			return
+		}
+		a.lc.Lock()
+		client := a.client
+		a.lc.Unlock()
+
+		if _, err = a.pc.WriteTo(buildUdpHeader(parseAddr(addr), data), client); err != nil {
+			log.Debugf("write datagram to client error: %v", err)
+		}
+	}
+}
+
+func (a *udpAssociation) close() {
+	a.lc.Lock()
+	defer a.lc.Unlock()
+	for _, r := range a.relays {
+		_ = r.Close()
+	}
+	a.relays = map[string]UdpRelay{}
+}
+
+/*
+	+----+------+------+----------+----------+----------+
+	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+	+----+------+------+----------+----------+----------+
+	| 2  |  1   |  1   | Variable |    2     | Variable |
+	+----+------+------+----------+----------+----------+
+*/
+
+// parseUdpHeader return destination and payload of a socks5 udp datagram
+func parseUdpHeader(b []byte) (addr string, data []byte, err error) {
+	if len(b) < 4 {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	// fragmentation is not supported
+	if b[2] != 0 {
+		return "", nil, errors.New("fragmented datagram not supported")
+	}
+
+	reader := bytes.NewReader(b[3:])
+	if addr, err = readAddr(reader); err != nil {
+		return
+	}
+	data = b[len(b)-reader.Len():]
+	return
+}
+
+func buildUdpHeader(addr []byte, data []byte) (b []byte) {
+	b = make([]byte, 0, 3+len(addr)+len(data))
+	b = append(b, 0, 0, 0)
+	b = append(b, addr...)
+	return append(b, data...)
+}
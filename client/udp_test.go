@@ -0,0 +1,97 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"through/proto"
+	"time"
+)
+
+func TestSocksProxy_UdpAssociate(t *testing.T) {
+	proxy := newTestSocksProxy(t, []string{
+		"ip-cidr: 127.0.0.0/8, direct",
+		"match-all, reject",
+	}, nil)
+	echo := udpEchoServer(t)
+
+	conn := dialSocks(t, proxy)
+	handshake(t, conn)
+	sendRequest(t, conn, SocksCmdUDPAssociate, SocksIPv4Host, net.IPv4zero.To4(), 0)
+	rep, bound := readReply(t, conn)
+	if rep != StatusSuccess {
+		t.Fatalf("rep = %v, want %v", rep, StatusSuccess)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	relayAddr, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("hello udp")
+	_ = pc.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = pc.WriteTo(buildUdpHeader(parseAddr(echo.String()), msg), relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxDatagramSize)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, data, err := parseUdpHeader(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != echo.String() || !bytes.Equal(data, msg) {
+		t.Errorf("datagram from %v = %q, want %v %q", from, data, echo, msg)
+	}
+}
+
+// countRelayForward direct forward counting relays created
+type countRelayForward struct {
+	DirectClient
+	relays atomic.Int32
+}
+
+func (c *countRelayForward) Relay(meta *proto.Meta) (UdpRelay, error) {
+	c.relays.Add(1)
+	return c.DirectClient.Relay(meta)
+}
+
+func TestUdpAssociation_BrokenRelay(t *testing.T) {
+	forward := &countRelayForward{}
+	forwards := &ForwardManger{}
+	forwards.forwardClients.Store(&map[string]Forward{"direct": forward})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	a := newUdpAssociation(&SocksProxy{forwardManager: forwards}, pc, net.IPv4(127, 0, 0, 1), "")
+	defer a.close()
+
+	relay, err := a.getRelay("direct", "127.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// relay broken, it's removed so the next datagram create a new one
+	_ = relay.Close()
+	if !waitUntil(func() bool {
+		a.lc.Lock()
+		defer a.lc.Unlock()
+		return len(a.relays) == 0
+	}) {
+		t.Fatal("broken relay is not removed")
+	}
+	if _, err = a.getRelay("direct", "127.0.0.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	if got := forward.relays.Load(); got != 2 {
+		t.Errorf("relays created = %d, want 2", got)
+	}
+}
@@ -0,0 +1,291 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"through/config"
+	"through/log"
+	"through/proto"
+	"time"
+)
+
+const (
+	UpstreamHttp   = "http"
+	UpstreamSocks5 = "socks5"
+)
+
+// isUpstream return true if network is an upstream proxy rather than a through server
+func isUpstream(network string) bool {
+	return network == UpstreamHttp || network == UpstreamSocks5
+}
+
+// upstream an http or socks5 proxy, tcp connections to any address can be opened through it
+type upstream struct {
+	net      string
+	addr     string
+	username string
+	password string
+	failures atomic.Int32 // consecutive failures to connect the proxy
+}
+
+func newUpstream(c config.ProxyServer) (*upstream, error) {
+	if !isUpstream(c.Net) {
+		return nil, fmt.Errorf("unsupported proxy net %v", c.Net)
+	}
+	if c.Addr == "" {
+		return nil, errors.New("addr of proxy is required")
+	}
+	return &upstream{net: c.Net, addr: c.Addr, username: c.Username, password: c.Password}, nil
+}
+
+// url of proxy with credentials, for http transport
+func (u *upstream) url() *url.URL {
+	p := &url.URL{Scheme: u.net, Host: u.addr}
+	if u.username != "" {
+		p.User = url.UserPassword(u.username, u.password)
+	}
+	return p
+}
+
+// DialContext connect addr through the proxy, only tcp is supported
+func (u *upstream) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, &proto.DialError{Status: proto.Status_UNSUPPORTED, Msg: network + " is not supported by " + u.net + " proxy"}
+	}
+	dialer := &net.Dialer{Timeout: directDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		u.failures.Add(1)
+		return nil, fmt.Errorf("connect %v proxy: %w", u.net, err)
+	}
+	u.failures.Store(0)
+
+	deadline := time.Now().Add(directDialTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+	remote := conn
+	if u.net == UpstreamHttp {
+		remote, err = u.connectHttp(conn, addr)
+	} else {
+		err = u.connectSocks5(conn, addr)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return remote, nil
+}
+
+// connectHttp send CONNECT request, data the proxy send after response is kept in returned conn
+func (u *upstream) connectHttp(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u.username != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.username+":"+u.password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &proto.DialError{Status: httpProxyStatus(resp.StatusCode), Msg: "http proxy response " + resp.Status}
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// httpProxyStatus map response of http proxy to status
+func httpProxyStatus(code int) proto.Status {
+	switch code {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return proto.Status_NOT_ALLOWED
+	case http.StatusGatewayTimeout:
+		return proto.Status_TIMEOUT
+	}
+	return proto.Status_GENERAL_FAILURE
+}
+
+// connectSocks5 negotiate auth and send CONNECT command
+func (u *upstream) connectSocks5(conn net.Conn, addr string) (err error) {
+	methods := []byte{SocksNoAuthentication}
+	if u.username != "" {
+		methods = append(methods, SocksUserPassAuth)
+	}
+	if _, err = conn.Write(append([]byte{Socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return
+	}
+	if reply[0] != Socks5Version {
+		return fmt.Errorf("socks5 proxy reply version %d", reply[0])
+	}
+	switch reply[1] {
+	case SocksNoAuthentication:
+	case SocksUserPassAuth:
+		if len(u.username) > 255 || len(u.password) > 255 {
+			return errors.New("username or password of socks5 proxy is too long")
+		}
+		auth := []byte{SocksUserPassVersion, byte(len(u.username))}
+		auth = append(auth, u.username...)
+		auth = append(auth, byte(len(u.password)))
+		auth = append(auth, u.password...)
+		if _, err = conn.Write(auth); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return
+		}
+		if reply[1] != SocksAuthSuccess {
+			return &proto.DialError{Status: proto.Status_NOT_ALLOWED, Msg: "socks5 proxy authentication failed"}
+		}
+	default:
+		return &proto.DialError{Status: proto.Status_NOT_ALLOWED, Msg: "no acceptable auth method of socks5 proxy"}
+	}
+
+	if _, err = conn.Write(append([]byte{Socks5Version, SocksCmdConnect, 0x00}, parseAddr(addr)...)); err != nil {
+		return
+	}
+	// VER REP RSV, then the bound address
+	resp := make([]byte, 3)
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return
+	}
+	if _, err = readAddr(conn); err != nil {
+		return
+	}
+	if resp[1] != StatusSuccess {
+		return &proto.DialError{Status: socksProxyStatus(resp[1]), Msg: fmt.Sprintf("socks5 proxy reply %d", resp[1])}
+	}
+	return
+}
+
+// socksProxyStatus map REP code of socks5 proxy to status, the reverse of replyStatus
+func socksProxyStatus(rep byte) proto.Status {
+	switch rep {
+	case StatusConnectNotAllow:
+		return proto.Status_NOT_ALLOWED
+	case StatusNetworkUnReachable:
+		return proto.Status_NETWORK_UNREACHABLE
+	case StatusHostUnReachable:
+		return proto.Status_HOST_UNREACHABLE
+	case StatusConnectRefuse:
+		return proto.Status_CONNECTION_REFUSED
+	case StatusTTLExpire:
+		return proto.Status_TIMEOUT
+	case StatusCommandNotSupport, StatusAddressNotSupport:
+		return proto.Status_UNSUPPORTED
+	}
+	return proto.Status_GENERAL_FAILURE
+}
+
+// producer connect through server by the proxy
+func (u *upstream) producer() Producer {
+	return func(addr string, tlsCfg *tls.Config) (conn net.Conn, err error) {
+		ctx, cancel := context.WithTimeout(context.Background(), serverDialTimeout)
+		defer cancel()
+		if conn, err = u.DialContext(ctx, "tcp", addr); err != nil {
+			return
+		}
+		return tls.Client(conn, tlsCfg), nil
+	}
+}
+
+// bufferedConn conn which data read ahead is kept in reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// UpstreamClient forward through an http or socks5 proxy, udp and bind are not supported
+type UpstreamClient struct {
+	upstream *upstream
+	client   *http.Client
+	logger   *log.Logger
+	active   atomic.Int64 // connections in use
+}
+
+func NewUpstreamClient(c config.ProxyServer) (u *UpstreamClient, err error) {
+	if len(c.Chain) > 0 || c.Proxy != "" {
+		return nil, errors.New("chain and proxy are not supported by http or socks5 proxy")
+	}
+	up, err := newUpstream(c)
+	if err != nil {
+		return
+	}
+	return &UpstreamClient{
+		upstream: up,
+		client:   &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(up.url())}},
+		logger:   log.NewLogger().With("type", "upstreamClient").With("network", c.Net).With("address", c.Addr),
+	}, nil
+}
+
+func (u *UpstreamClient) Http(writer http.ResponseWriter, request *http.Request) {
+	removeProxyHeaders(request)
+	resp, err := u.client.Do(request)
+	if err != nil {
+		u.logger.Errorf("do http request error: %v", err)
+		http.Error(writer, err.Error(), httpStatus(err))
+		return
+	}
+	defer resp.Body.Close()
+	copyHTTPResponse(writer, resp)
+}
+
+func (u *UpstreamClient) Dial(ctx context.Context, meta *proto.Meta) (remote net.Conn, err error) {
+	if remote, err = u.upstream.DialContext(ctx, meta.GetNet(), meta.GetAddress()); err != nil {
+		u.logger.Errorf("dial remote %v error: %v", meta.GetAddress(), err)
+		return
+	}
+	return countActive(remote, &u.active), nil
+}
+
+func (u *UpstreamClient) Relay(meta *proto.Meta) (relay UdpRelay, err error) {
+	return nil, &proto.DialError{Status: proto.Status_UNSUPPORTED, Msg: "udp is not supported by " + u.upstream.net + " proxy"}
+}
+
+func (u *UpstreamClient) Bind(meta *proto.Meta) (binding Binding, err error) {
+	return nil, &proto.DialError{Status: proto.Status_UNSUPPORTED, Msg: "bind is not supported by " + u.upstream.net + " proxy"}
+}
+
+// Active return number of connections in use
+func (u *UpstreamClient) Active() int64 {
+	return u.active.Load()
+}
+
+// Failing return true if the proxy can't be connected several times in a row
+func (u *UpstreamClient) Failing() bool {
+	return u.upstream.failures.Load() >= downFailures
+}
+
+func (u *UpstreamClient) Close() {
+	u.client.CloseIdleConnections()
+}
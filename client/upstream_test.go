@@ -0,0 +1,194 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"through/config"
+	"through/proto"
+	"through/util"
+)
+
+// fakeHttpProxy handle CONNECT with basic auth of user:pass
+func fakeHttpProxy(t *testing.T) string {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := parseBasic(r.Header.Get("Proxy-Authorization")); !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		remote, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = remote.Close()
+			return
+		}
+		util.CopyLoopWait(conn, remote)
+	}))
+	t.Cleanup(ts.Close)
+	return ts.Listener.Addr().String()
+}
+
+func parseBasic(header string) (user, pass string, ok bool) {
+	r := &http.Request{Header: http.Header{"Authorization": {header}}}
+	return r.BasicAuth()
+}
+
+// fakeSocks5Proxy accept user:pass, reply connection refused if remote can't be reached
+func fakeSocks5Proxy(t *testing.T) string {
+	return serveTcp(t, "127.0.0.1:0", func(conn net.Conn) {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return
+		}
+		methods := make([]byte, head[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{Socks5Version, SocksUserPassAuth})
+		// VER ULEN UNAME PLEN PASSWD
+		auth := make([]byte, 2)
+		_, _ = io.ReadFull(conn, auth)
+		user := make([]byte, auth[1])
+		_, _ = io.ReadFull(conn, user)
+		_, _ = io.ReadFull(conn, auth[:1])
+		pass := make([]byte, auth[0])
+		_, _ = io.ReadFull(conn, pass)
+		if string(user) != "user" || string(pass) != "pass" {
+			_, _ = conn.Write([]byte{SocksUserPassVersion, SocksAuthFailure})
+			return
+		}
+		_, _ = conn.Write([]byte{SocksUserPassVersion, SocksAuthSuccess})
+
+		req := make([]byte, 3)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		addr, err := readAddr(conn)
+		if err != nil {
+			return
+		}
+		remote, err := net.Dial("tcp", addr)
+		if err != nil {
+			_, _ = conn.Write(append([]byte{Socks5Version, StatusConnectRefuse, 0x00}, parseAddr("")...))
+			return
+		}
+		_, _ = conn.Write(append([]byte{Socks5Version, StatusSuccess, 0x00}, parseAddr(remote.LocalAddr().String())...))
+		util.CopyLoopWait(conn, remote)
+	})
+}
+
+func TestUpstreamClient_Dial(t *testing.T) {
+	echo := echoServer(t, "127.0.0.1:0")
+	proxies := map[string]string{
+		UpstreamHttp:   fakeHttpProxy(t),
+		UpstreamSocks5: fakeSocks5Proxy(t),
+	}
+	for network, addr := range proxies {
+		t.Run(network, func(t *testing.T) {
+			u, err := NewUpstreamClient(config.ProxyServer{Name: "corp", Net: network, Addr: addr, Username: "user", Password: "pass"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+			conn, err := u.Dial(context.Background(), &proto.Meta{Net: "tcp", Address: echo})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err = conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+				t.Errorf("read %q, %v, want ping", buf, err)
+			}
+
+			if _, err = u.Dial(context.Background(), &proto.Meta{Net: "tcp", Address: "127.0.0.1:1"}); err == nil {
+				t.Error("Dial() want error for unreachable remote")
+			}
+			if _, err = u.Relay(&proto.Meta{Net: proto.NetUDP, Address: "example.com:53"}); proto.StatusOf(err) != proto.Status_UNSUPPORTED {
+				t.Errorf("Relay() error = %v, want unsupported", err)
+			}
+
+			wrong, _ := NewUpstreamClient(config.ProxyServer{Name: "corp", Net: network, Addr: addr, Username: "user", Password: "wrong"})
+			var dialErr *proto.DialError
+			if _, err = wrong.Dial(context.Background(), &proto.Meta{Net: "tcp", Address: echo}); !errors.As(err, &dialErr) || dialErr.Status != proto.Status_NOT_ALLOWED {
+				t.Errorf("Dial() with wrong password error = %v, want not allowed", err)
+			}
+		})
+	}
+}
+
+func TestProxyOf(t *testing.T) {
+	servers := []config.ProxyServer{
+		{Name: "corp", Net: UpstreamHttp, Addr: "10.0.0.1:3128"},
+		{Name: "bastion", Net: "tcp", Addr: "1.2.3.4:8888", Proxy: "corp"},
+		{Name: "exit", Net: "kcp", Addr: "10.0.0.2:8888", Chain: []string{"bastion"}},
+		{Name: "udp", Net: "kcp", Addr: "1.2.3.4:8888"},
+	}
+	proxy, err := proxyOf(servers[1], nil, servers)
+	if err != nil || proxy == nil || proxy.Name != "corp" {
+		t.Errorf("proxyOf(bastion) = %v, %v", proxy, err)
+	}
+	// chained server use proxy of its first hop
+	proxy, err = proxyOf(servers[2], servers[1:2], servers)
+	if err != nil || proxy == nil || proxy.Name != "corp" {
+		t.Errorf("proxyOf(exit) = %v, %v", proxy, err)
+	}
+	if proxy, err = proxyOf(servers[3], nil, servers); err != nil || proxy != nil {
+		t.Errorf("proxyOf(udp) = %v, %v, want none", proxy, err)
+	}
+
+	bad := []struct {
+		c    config.ProxyServer
+		hops []config.ProxyServer
+	}{
+		{config.ProxyServer{Name: "a", Net: "tcp", Proxy: "missing"}, nil},
+		{config.ProxyServer{Name: "a", Net: "tcp", Proxy: "udp"}, nil},
+		{config.ProxyServer{Name: "a", Net: "kcp", Proxy: "corp"}, nil},
+		{config.ProxyServer{Name: "a", Net: "tcp", Proxy: "corp", Chain: []string{"bastion"}}, servers[1:2]},
+	}
+	for _, tt := range bad {
+		if _, err = proxyOf(tt.c, tt.hops, servers); err == nil {
+			t.Errorf("proxyOf(%v) want error", tt.c.Name)
+		}
+	}
+	if _, err = chainOf(config.ProxyServer{Name: "a", Chain: []string{"corp"}}, servers); err == nil {
+		t.Error("chainOf() want error for proxy in chain")
+	}
+}
+
+func TestUpstreamProducer(t *testing.T) {
+	cert := testCertificate(t)
+	final := serveHello(t, cert, proto.NewHello(), echoConn)
+	up, err := newUpstream(config.ProxyServer{Net: UpstreamSocks5, Addr: fakeSocks5Proxy(t), Username: "user", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialProducer("kcp", up) != nil {
+		t.Error("dialProducer() want nil for kcp through proxy")
+	}
+	hopTls := &tls.Config{InsecureSkipVerify: true}
+	hops := []hop{{name: "bastion", net: "tcp", addr: serveHello(t, cert, proto.NewHello(), fakeHop), tlsCfg: hopTls}}
+	conn, err := chainProducer(hops, "tcp", up)(final, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = proto.WriteHello(conn, proto.NewHello()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = proto.ReadHello(conn); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+	"through/ca"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const day = 24 * time.Hour
+
+var (
+	certDir     string
+	certCN      string
+	certKeyType string
+	certDays    int
+	certDNS     []string
+	certIPs     []string
+)
+
+// certCmd manage certificates of server and clients
+var certCmd = &cobra.Command{
+	Use:   "cert",
+	Short: "manage certificates",
+	Long:  `manage the certificate authority, server and client certificates.`,
+	// no config is needed, and usage is not printed for errors after args are checked
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
+}
+
+var initCACmd = &cobra.Command{
+	Use:   "init-ca",
+	Short: "create a certificate authority",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		days := certDays
+		if !cmd.Flags().Changed("days") {
+			days = 3650
+		}
+		if days <= 0 {
+			return errors.New("--days must be positive")
+		}
+		a, err := ca.Init(certDir, certCN, certKeyType, time.Duration(days)*day)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("ca created in %v, crl is %v\n", certDir, a.CRLFile())
+		return nil
+	},
+}
+
+var issueServerCmd = &cobra.Command{
+	Use:   "issue-server NAME",
+	Short: "issue a server certificate",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return issue(ca.CertTypeServer, args[0])
+	},
+}
+
+var issueClientCmd = &cobra.Command{
+	Use:   "issue-client NAME",
+	Short: "issue a client certificate",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return issue(ca.CertTypeClient, args[0])
+	},
+}
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke NAME|SERIAL",
+	Short: "revoke a certificate and regenerate crl",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a, err := ca.Load(certDir)
+		if err != nil {
+			return err
+		}
+		r, err := a.Revoke(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("certificate %v(%v) revoked, crl is %v\n", r.Name, r.Serial, a.CRLFile())
+		return nil
+	},
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list issued certificates",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		a, err := ca.Load(certDir)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "NAME\tTYPE\tCN\tSERIAL\tNOT AFTER\tSTATUS")
+		for _, r := range a.List() {
+			status := "valid"
+			if r.RevokedAt != nil {
+				status = "revoked"
+			} else if r.NotAfter.Before(time.Now()) {
+				status = "expired"
+			}
+			_, _ = fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", r.Name, r.Type, r.CN, r.Serial, r.NotAfter.Format(time.DateOnly), status)
+		}
+		return w.Flush()
+	},
+}
+
+func issue(certType, name string) (err error) {
+	if certDays <= 0 {
+		return errors.New("--days must be positive")
+	}
+	a, err := ca.Load(certDir)
+	if err != nil {
+		return
+	}
+	req := ca.Request{
+		Name:     name,
+		CN:       certCN,
+		DNSNames: certDNS,
+		KeyType:  certKeyType,
+		Validity: time.Duration(certDays) * day,
+	}
+	if req.CN == "" {
+		req.CN = name
+	}
+	for _, s := range certIPs {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid ip %v", s)
+		}
+		req.IPs = append(req.IPs, ip)
+	}
+
+	r, err := a.Issue(certType, req)
+	if err != nil {
+		return
+	}
+	fmt.Printf("%v certificate %v issued, serial %v, files %v/%v.crt and %v/%v.key\n", certType, r.CN, r.Serial, certDir, name, certDir, name)
+	return
+}
+
+func init() {
+	certCmd.PersistentFlags().StringVarP(&certDir, "dir", "d", "./cert", "directory of ca, certificates and index")
+	for _, c := range []*cobra.Command{initCACmd, issueServerCmd, issueClientCmd} {
+		c.Flags().StringVar(&certCN, "cn", "", "common name, default is NAME, or through for ca")
+		c.Flags().StringVar(&certKeyType, "key-type", ca.KeyTypeECDSA, "key type, ecdsa or ed25519")
+		c.Flags().IntVar(&certDays, "days", 365, "validity in days, 3650 for ca")
+	}
+	for _, c := range []*cobra.Command{issueServerCmd, issueClientCmd} {
+		c.Flags().StringSliceVar(&certDNS, "dns", nil, "dns names in SAN")
+		c.Flags().StringSliceVar(&certIPs, "ip", nil, "ip addresses in SAN")
+	}
+	initCACmd.PreRun = func(cmd *cobra.Command, args []string) {
+		if certCN == "" {
+			certCN = "through"
+		}
+	}
+
+	certCmd.AddCommand(initCACmd, issueServerCmd, issueClientCmd, revokeCmd, listCmd)
+	rootCmd.AddCommand(certCmd)
+}
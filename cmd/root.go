@@ -14,6 +14,10 @@ var rootCmd = &cobra.Command{
 	Use:   "through",
 	Short: "A tool for bypass network restrictions",
 	Long:  `A tool for bypass network restrictions.`,
+	// init config before running any sub command, sub command without config override it
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		Init()
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -28,7 +32,6 @@ func Execute() {
 var cfgFile string
 
 func init() {
-	cobra.OnInitialize(Init)
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "./through.yaml", "config file (default is $HOME/.through.yaml)")
 
 	// Cobra also supports local flags, which will only run
@@ -4,12 +4,16 @@ import (
 	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 	"os"
+	"reflect"
 )
 
 var Server *ServerCfg
 var Client *ClientCfg
 var Common *CommonCfg
 
+// file the config is read from
+var file string
+
 type Config struct {
 	ServerCfg `yaml:"server"`
 	ClientCfg `yaml:"client"`
@@ -17,28 +21,124 @@ type Config struct {
 }
 
 type ServerCfg struct {
-	TcpAddr    string `yaml:"tcpAddr"`
-	UdpAddr    string `yaml:"udpAddr"`
-	PrivateKey string `yaml:"privateKey"`
-	CrtFile    string `yaml:"crtFile"`
-	CAFile     string `yaml:"caFile"`
+	TcpAddr    string           `yaml:"tcpAddr"`
+	UdpAddr    string           `yaml:"udpAddr"`
+	PrivateKey string           `yaml:"privateKey"`
+	CrtFile    string           `yaml:"crtFile"`
+	CAFile     string           `yaml:"caFile"`
+	CRLFile    string           `yaml:"crlFile"`  // revoked client certificates, reloaded when changed
+	BindHost   string           `yaml:"bindHost"` // host reported to socks BIND, default is the local ip of tunnel
+	ACL        *AclCfg          `yaml:"acl"`      // nil allow any destination including private ones, as before acl was added
+	Policies   []IdentityPolicy `yaml:"policies"`
+}
+
+// IdentityPolicy limit clients with certificate of identity, the first matched policy take effect
+type IdentityPolicy struct {
+	Identity   string    `yaml:"identity"`   // common name or SAN of client certificate, "*" match any client
+	Rules      []AclRule `yaml:"rules"`      // allowed destinations, checked before acl rules
+	Bandwidth  int64     `yaml:"bandwidth"`  // bytes per second of each direction shared by all connections of one client, 0 is unlimited
+	MaxStreams int       `yaml:"maxStreams"` // max concurrent forwards of one client, 0 is unlimited
+}
+
+// AclCfg destinations client can dial through server
+type AclCfg struct {
+	Default      string    `yaml:"default"`      // allow or deny, action if no rule matched, default is allow
+	AllowPrivate bool      `yaml:"allowPrivate"` // allow loopback, private and link-local destinations not matched by rules
+	Rules        []AclRule `yaml:"rules"`        // first matched rule take effect
+}
+
+// AclRule match when all non-empty fields match, any item of a field matching is enough
+type AclRule struct {
+	Action     string   `yaml:"action"`     // allow or deny
+	CIDRs      []string `yaml:"cidrs"`      // destination ip ranges
+	Ports      []string `yaml:"ports"`      // destination ports, "443" or "8000-9000"
+	Domains    []string `yaml:"domains"`    // destination domains, "example.com" or "*.example.com"
+	Identities []string `yaml:"identities"` // common name of client certificate
 }
 
 type ClientCfg struct {
 	HttpAddr   string           `yaml:"httpAddr"`
 	SocksAddr  string           `yaml:"socksAddr"`
+	AdminAddr  string           `yaml:"adminAddr"` // http api of servers and groups, disabled if empty
 	PrivateKey string           `yaml:"privateKey"`
 	CrtFile    string           `yaml:"crtFile"`
+	CAFile     string           `yaml:"caFile"` // default ca to verify servers
 	PoolSize   int              `yaml:"poolSize"`
+	Mux        MuxCfg           `yaml:"mux"`
 	Resolvers  []ResolverServer `yaml:"resolvers"`
 	Servers    []ProxyServer    `yaml:"servers"`
-	Rules      []string         `yaml:"rules"`
+	Groups     []ProxyGroup     `yaml:"proxyGroups"` // used in rules by name like servers
+	Rules      []Rule           `yaml:"rules"`
+	AsnFile    string           `yaml:"asnFile"`       // GeoLite2-ASN.mmdb used by ip-asn rules
+	Providers  []RuleProvider   `yaml:"ruleProviders"` // rule sets referenced by "rule-set: name, action"
+	Users      []User           `yaml:"users"`
+	UserFile   string           `yaml:"userFile"` // htpasswd-style file
 }
 
 type ProxyServer struct {
-	Name string `yaml:"name"` // name must be unique
-	Net  string `yaml:"net"`
-	Addr string `yaml:"addr"`
+	Name       string   `yaml:"name"` // name must be unique
+	Net        string   `yaml:"net"`  // tcp or kcp for through server, http or socks5 for upstream proxy
+	Addr       string   `yaml:"addr"`
+	CAFile     string   `yaml:"caFile"`     // ca to verify server, default is client caFile
+	Pins       []string `yaml:"pins"`       // base64 sha256 of server public key, trusted without ca
+	ServerName string   `yaml:"serverName"` // name in server certificate, default is host of addr
+	Insecure   bool     `yaml:"insecure"`   // skip verifying server, not recommended
+	Chain      []string `yaml:"chain"`      // servers to pass through in order before this one, they must not be chained
+	Proxy      string   `yaml:"proxy"`      // http or socks5 server to connect this tcp server through
+	Username   string   `yaml:"username"`   // credentials of http or socks5 proxy
+	Password   string   `yaml:"password"`
+}
+
+// ProxyGroup servers used as one, the member in use is chosen by type
+type ProxyGroup struct {
+	Name      string   `yaml:"name"`      // unique among servers and groups
+	Type      string   `yaml:"type"`      // url-test, fallback, select or load-balance
+	Servers   []string `yaml:"servers"`   // servers, direct, reject or groups defined before
+	Strategy  string   `yaml:"strategy"`  // load-balance: round-robin, least-active or consistent-hashing, default is round-robin
+	URL       string   `yaml:"url"`       // probed through members, default http://www.gstatic.com/generate_204
+	Interval  int      `yaml:"interval"`  // seconds between probes, default is 300
+	Tolerance int      `yaml:"tolerance"` // milliseconds, url-test switch only if another member is faster by more
+	Selected  string   `yaml:"selected"`  // member of select group at start, default is the first
+}
+
+// RuleProvider a list of domains and cidrs loaded from a file or url, one entry per line
+type RuleProvider struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`     // file or http
+	Path     string `yaml:"path"`     // rule file, or cache of http provider
+	URL      string `yaml:"url"`      // url of http provider
+	Forward  string `yaml:"forward"`  // server to download through, default is direct
+	Interval int    `yaml:"interval"` // seconds between downloads of http provider, default is 86400
+}
+
+// Rule a routing rule, either a string "cond: param, action",
+// or an object with action and exactly one of cond, and, or, not.
+// conditions in and, or, not are strings "cond: param" or objects without action
+type Rule struct {
+	Cond   string `yaml:"cond"`   // "cond: param", or the whole rule in string form
+	And    []Rule `yaml:"and"`    // match when all conditions match
+	Or     []Rule `yaml:"or"`     // match when any condition match
+	Not    *Rule  `yaml:"not"`    // match when the condition not match
+	Action string `yaml:"action"` // reject, direct or "forward: name"
+}
+
+// stringToRuleHook decode a string rule into Rule.Cond
+func stringToRuleHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String || to != reflect.TypeOf(Rule{}) {
+		return data, nil
+	}
+	return Rule{Cond: data.(string)}, nil
+}
+
+type User struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type MuxCfg struct {
+	Enable     bool `yaml:"enable"`
+	Sessions   int  `yaml:"sessions"`   // max sessions per server
+	MaxStreams int  `yaml:"maxStreams"` // open a new session when streams of all sessions reach this
 }
 
 type ResolverServer struct {
@@ -51,29 +151,50 @@ type CommonCfg struct {
 	LogFile string `yaml:"logFile"`
 }
 
-func Init(file string) (err error) {
-	if _, err = os.Stat(file); os.IsNotExist(err) {
-		file = "~/.through/through.yaml"
+func Init(f string) (err error) {
+	if _, err = os.Stat(f); os.IsNotExist(err) {
+		f = "~/.through/through.yaml"
 	}
 
-	viper.SetConfigFile(file)
+	cfg, err := Load(f)
+	if err != nil {
+		return
+	}
+
+	file = f
+	Server = &cfg.ServerCfg
+	Client = &cfg.ClientCfg
+	Common = &cfg.CommonCfg
+	return
+}
+
+// Load read config from file without changing the global config, used to reload
+func Load(file string) (cfg *Config, err error) {
+	v := viper.New()
+	v.SetConfigFile(file)
 
-	viper.AutomaticEnv() // read in environment variables that match
+	v.AutomaticEnv() // read in environment variables that match
 
-	viper.SetConfigType("yaml")
+	v.SetConfigType("yaml")
 
 	// If a config file is found, read it in.
-	if err = viper.ReadInConfig(); err != nil {
+	if err = v.ReadInConfig(); err != nil {
 		return
 	}
 
-	cfg := &Config{}
-	err = viper.Unmarshal(cfg, func(decoderConfig *mapstructure.DecoderConfig) {
+	cfg = &Config{}
+	err = v.Unmarshal(cfg, func(decoderConfig *mapstructure.DecoderConfig) {
 		decoderConfig.TagName = "yaml"
+		decoderConfig.DecodeHook = mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+			stringToRuleHook,
+		)
 	})
-
-	Server = &cfg.ServerCfg
-	Client = &cfg.ClientCfg
-	Common = &cfg.CommonCfg
 	return
 }
+
+// File return the path of config file
+func File() string {
+	return file
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoad_Acl(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "through.yaml")
+	if err := os.WriteFile(file, []byte("server:\n  tcpAddr: \":8888\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ACL != nil {
+		t.Errorf("ACL = %+v without acl block, want nil", cfg.ACL)
+	}
+
+	if err = os.WriteFile(file, []byte("server:\n  acl:\n    default: deny\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = Load(file); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ACL == nil || cfg.ACL.Default != "deny" || cfg.ACL.AllowPrivate {
+		t.Errorf("ACL = %+v, want deny without private", cfg.ACL)
+	}
+}
+
+func TestLoad_Rules(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "through.yaml")
+	data := `
+client:
+  rules:
+    - "host-suffix: ad.com, reject"
+    - and:
+        - "geo: CN"
+        - cond: "dst-port: 443"
+        - not: "host-suffix: corp.com"
+      action: direct
+    - or: ["network: udp", "inbound: socks"]
+      action: "forward: local"
+`
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{Cond: "host-suffix: ad.com, reject"},
+		{
+			And:    []Rule{{Cond: "geo: CN"}, {Cond: "dst-port: 443"}, {Not: &Rule{Cond: "host-suffix: corp.com"}}},
+			Action: "direct",
+		},
+		{Or: []Rule{{Cond: "network: udp"}, {Cond: "inbound: socks"}}, Action: "forward: local"},
+	}
+	if !reflect.DeepEqual(cfg.Rules, want) {
+		t.Errorf("Rules = %+v, want %+v", cfg.Rules, want)
+	}
+}
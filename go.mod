@@ -1,6 +1,6 @@
 module through
 
-go 1.20
+go 1.21
 
 require (
 	github.com/golang/protobuf v1.5.3
@@ -10,8 +10,12 @@ require (
 	github.com/spf13/cobra v1.8.0
 	github.com/spf13/viper v1.18.2
 	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8
+	github.com/xtaci/kcp-go v5.4.20+incompatible
+	github.com/xtaci/smux v1.5.24
 	go.uber.org/zap v1.26.0
+	golang.org/x/crypto v0.20.0
 	golang.org/x/sync v0.5.0
+	golang.org/x/time v0.5.0
 	google.golang.org/protobuf v1.31.0
 )
 
@@ -35,9 +39,7 @@ require (
 	github.com/templexxx/cpufeat v0.0.0-20180724012125-cef66df7f161 // indirect
 	github.com/templexxx/xor v0.0.0-20191217153810-f85b25db303b // indirect
 	github.com/tjfoc/gmsm v1.4.1 // indirect
-	github.com/xtaci/kcp-go v5.4.20+incompatible // indirect
 	go.uber.org/multierr v1.11.0 // indirect
-	golang.org/x/crypto v0.20.0 // indirect
 	golang.org/x/exp v0.0.0-20240213143201-ec583247a57a // indirect
 	golang.org/x/net v0.21.0 // indirect
 	golang.org/x/sys v0.17.0 // indirect
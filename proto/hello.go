@@ -0,0 +1,115 @@
+package proto
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	// ProtocolVersion is the tunnel protocol version of this build
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest version this build can talk with,
+	// version 0 is the legacy protocol without hello, only plain tcp forwarding is available
+	MinProtocolVersion = 1
+)
+
+// capabilities advertised in hello.
+// client certificate is always required, so there is no auth mode to negotiate,
+// compression is not supported yet, a new capability will be added with it
+const (
+	CapMux  = "mux"
+	CapUDP  = "udp"
+	CapBind = "bind"
+	CapKcp  = "kcp" // server can dial kcp, so it can be a hop before a kcp server
+)
+
+// Capabilities supported by this build
+var Capabilities = []string{CapMux, CapUDP, CapBind, CapKcp}
+
+// VersionError is returned when peer version is incompatible
+type VersionError struct {
+	Version uint32
+	Msg     string
+}
+
+func (e *VersionError) Error() string {
+	if e.Msg != "" {
+		return fmt.Sprintf("incompatible protocol version %d: %v", e.Version, e.Msg)
+	}
+	return fmt.Sprintf("incompatible protocol version %d, require %d to %d", e.Version, MinProtocolVersion, ProtocolVersion)
+}
+
+// NewHello build hello of this build
+func NewHello() *Hello {
+	return &Hello{Version: ProtocolVersion, Capabilities: Capabilities}
+}
+
+// LegacyHello stand for a peer which doesn't send hello
+func LegacyHello() *Hello {
+	return &Hello{Version: 0}
+}
+
+// Has return true if peer advertised the capability
+func (x *Hello) Has(capability string) bool {
+	for _, c := range x.GetCapabilities() {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Legacy return true if peer is the legacy protocol
+func (x *Hello) Legacy() bool {
+	return x.GetVersion() == 0
+}
+
+// Check return error if peer is incompatible, legacy peer is accepted
+func (x *Hello) Check() error {
+	if x.GetError() != "" {
+		return &VersionError{Version: x.GetVersion(), Msg: x.GetError()}
+	}
+	if !x.Legacy() && x.GetVersion() < MinProtocolVersion {
+		return &VersionError{Version: x.GetVersion()}
+	}
+	return nil
+}
+
+// ReadHello read the hello frame from reader
+func ReadHello(reader io.Reader) (hello *Hello, err error) {
+	hello = &Hello{}
+	if err = read(reader, hello, MaxControlFrameSize); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// WriteHello write the hello frame to writer
+func WriteHello(writer io.Writer, hello *Hello) (err error) {
+	return write(writer, hello, MaxControlFrameSize)
+}
+
+// ReadHandshake read the first frame of a connection, it is a hello from versioned client,
+// or a meta from legacy client, in which case hello is LegacyHello
+func ReadHandshake(reader io.Reader) (hello *Hello, meta *Meta, err error) {
+	buf, err := readFrame(reader, MaxControlFrameSize)
+	if err != nil {
+		return
+	}
+
+	hello = &Hello{}
+	if err = proto.Unmarshal(buf, hello); err != nil {
+		return nil, nil, &FrameError{Op: "unmarshal", Err: err}
+	}
+	if !hello.Legacy() {
+		return hello, nil, nil
+	}
+
+	meta = &Meta{}
+	if err = proto.Unmarshal(buf, meta); err != nil {
+		return nil, nil, &FrameError{Op: "unmarshal", Err: err}
+	}
+	return LegacyHello(), meta, nil
+}
@@ -0,0 +1,75 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadHandshake(t *testing.T) {
+	t.Run("hello", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		if err := WriteHello(buf, NewHello()); err != nil {
+			t.Fatal(err)
+		}
+		hello, meta, err := ReadHandshake(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta != nil {
+			t.Errorf("meta = %v, want nil", meta)
+		}
+		if hello.GetVersion() != ProtocolVersion || !hello.Has(CapMux) {
+			t.Errorf("hello = %v", hello)
+		}
+	})
+
+	t.Run("legacy meta", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		if err := WriteMeta(buf, &Meta{Net: "tcp", Address: "example.com:443"}); err != nil {
+			t.Fatal(err)
+		}
+		hello, meta, err := ReadHandshake(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hello.Legacy() {
+			t.Errorf("hello version = %v, want legacy", hello.GetVersion())
+		}
+		if meta.GetNet() != "tcp" || meta.GetAddress() != "example.com:443" {
+			t.Errorf("meta = %v", meta)
+		}
+	})
+
+	t.Run("hello read by legacy server", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		if err := WriteHello(buf, NewHello()); err != nil {
+			t.Fatal(err)
+		}
+		meta, err := ReadMeta(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.GetNet() != "" || meta.GetAddress() != "" {
+			t.Errorf("meta = %v, want empty", meta)
+		}
+	})
+}
+
+func TestHello_Check(t *testing.T) {
+	tests := []struct {
+		name    string
+		hello   *Hello
+		wantErr bool
+	}{
+		{"current", NewHello(), false},
+		{"legacy", LegacyHello(), false},
+		{"rejected by peer", &Hello{Version: ProtocolVersion, Error: "too old"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.hello.Check(); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package proto
+
+import (
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// NetMux is sent as Meta.Net to switch a tunnel connection into multiplexing mode
+const NetMux = "mux"
+
+// MuxConfig smux config shared by client and server, version 2 enables per-stream flow control
+func MuxConfig() *smux.Config {
+	cfg := smux.DefaultConfig()
+	cfg.Version = 2
+	cfg.KeepAliveInterval = 10 * time.Second
+	cfg.KeepAliveTimeout = 30 * time.Second
+	cfg.MaxReceiveBuffer = 4 << 20
+	cfg.MaxStreamBuffer = 256 << 10
+	return cfg
+}
@@ -2,40 +2,116 @@ package proto
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/golang/protobuf/proto"
 	"io"
-	"through/log"
 )
 
+const (
+	// NetUDP is sent as Meta.Net to open a datagram relay, datagrams are framed as Datagram after meta
+	NetUDP = "udp"
+	// NetBind is sent as Meta.Net to ask server listen for one inbound connection,
+	// server reply a Response with the bound address, then another Response with the peer address once accepted
+	NetBind = "bind"
+	// NetKcp is sent as Meta.Net to ask server dial a kcp address, used to reach a kcp server in a chain
+	NetKcp = "kcp"
+)
+
+const (
+	// MaxControlFrameSize limit frames of meta, hello and response
+	MaxControlFrameSize = 16 << 10
+	// MaxDatagramFrameSize limit datagram frames, a udp payload is at most 64KB
+	MaxDatagramFrameSize = 128 << 10
+)
+
+var (
+	FrameTooLarge = errors.New("frame too large")
+)
+
+// FrameError is returned when reading or writing a frame fail, Op is the failed step
+type FrameError struct {
+	Op  string
+	Err error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("frame %v: %v", e.Op, e.Err)
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
 // ReadMeta read data from reader and unmarshal
 func ReadMeta(reader io.Reader) (meta *Meta, err error) {
+	meta = &Meta{}
+	if err = read(reader, meta, MaxControlFrameSize); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// WriteMeta marshal meta and write to writer
+func WriteMeta(writer io.Writer, meta *Meta) (err error) {
+	return write(writer, meta, MaxControlFrameSize)
+}
+
+// ReadDatagram read one datagram frame from reader
+func ReadDatagram(reader io.Reader) (dg *Datagram, err error) {
+	dg = &Datagram{}
+	if err = read(reader, dg, MaxDatagramFrameSize); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// WriteDatagram write one datagram frame to writer
+func WriteDatagram(writer io.Writer, dg *Datagram) (err error) {
+	return write(writer, dg, MaxDatagramFrameSize)
+}
+
+// read a length prefixed message from reader, frame larger than limit is refused before allocating
+func read(reader io.Reader, msg proto.Message, limit uint32) (err error) {
+	buf, err := readFrame(reader, limit)
+	if err != nil {
+		return
+	}
+	if err = proto.Unmarshal(buf, msg); err != nil {
+		return &FrameError{Op: "unmarshal", Err: err}
+	}
+	return
+}
+
+// readFrame read the raw data of a length prefixed frame
+func readFrame(reader io.Reader, limit uint32) (buf []byte, err error) {
 	// read data length
 	header := make([]byte, 4)
 	if _, err = io.ReadFull(reader, header); err != nil {
-		log.Errorf("reader header error: %v", err)
-		return
+		return nil, &FrameError{Op: "read header", Err: err}
 	}
 	dataLen := binary.BigEndian.Uint32(header)
+	if dataLen > limit {
+		return nil, &FrameError{Op: "read header", Err: fmt.Errorf("%w: %d > %d", FrameTooLarge, dataLen, limit)}
+	}
 
-	buf := make([]byte, dataLen)
+	buf = make([]byte, dataLen)
 	if _, err = io.ReadFull(reader, buf); err != nil {
-		log.Errorf("reader data error: %v", err)
-		return
+		return nil, &FrameError{Op: "read data", Err: err}
 	}
-
-	meta = &Meta{}
-	err = proto.Unmarshal(buf, meta)
-
 	return
 }
 
-// WriteMeta marshal meta and write to writer
-func WriteMeta(writer io.Writer, meta *Meta) (err error) {
+// write marshal message and write to writer with length prefix
+func write(writer io.Writer, msg proto.Message, limit uint32) (err error) {
 	var data []byte
-	if data, err = proto.Marshal(meta); err != nil {
-		return
+	if data, err = proto.Marshal(msg); err != nil {
+		return &FrameError{Op: "marshal", Err: err}
 	}
 	dataLen := uint32(len(data))
+	if len(data) > int(limit) {
+		return &FrameError{Op: "write", Err: fmt.Errorf("%w: %d > %d", FrameTooLarge, len(data), limit)}
+	}
 
 	header := make([]byte, 4)
 	binary.BigEndian.PutUint32(header, dataLen)
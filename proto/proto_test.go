@@ -0,0 +1,125 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func frame(dataLen uint32, data []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, dataLen), data...)
+}
+
+func TestReadMeta_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  []byte
+		target error
+	}{
+		{"empty", nil, io.EOF},
+		{"short header", []byte{0, 0}, io.ErrUnexpectedEOF},
+		{"too large", frame(1<<31, nil), FrameTooLarge},
+		{"short data", frame(10, []byte{1, 2}), io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadMeta(bytes.NewReader(tt.input))
+			var frameErr *FrameError
+			if !errors.As(err, &frameErr) {
+				t.Fatalf("ReadMeta() error = %v, want FrameError", err)
+			}
+			if !errors.Is(err, tt.target) {
+				t.Errorf("ReadMeta() error = %v, want %v", err, tt.target)
+			}
+		})
+	}
+}
+
+func TestWriteMeta_TooLarge(t *testing.T) {
+	meta := &Meta{Net: "tcp", Address: string(make([]byte, MaxControlFrameSize))}
+	if err := WriteMeta(io.Discard, meta); !errors.Is(err, FrameTooLarge) {
+		t.Errorf("WriteMeta() error = %v, want %v", err, FrameTooLarge)
+	}
+}
+
+func TestDatagram_MaxPayload(t *testing.T) {
+	buf := &bytes.Buffer{}
+	dg := &Datagram{Address: "[2001:db8::1]:53", Data: make([]byte, 64<<10)}
+	if err := WriteDatagram(buf, dg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadDatagram(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetAddress() != dg.GetAddress() || len(got.GetData()) != len(dg.GetData()) {
+		t.Errorf("ReadDatagram() = %v, %d bytes", got.GetAddress(), len(got.GetData()))
+	}
+}
+
+func FuzzReadMeta(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(frame(0, nil))
+	f.Add(frame(0xffffffff, nil))
+	f.Add(frame(3, []byte{0x0a, 0x01, 't'}))
+	buf := &bytes.Buffer{}
+	_ = WriteMeta(buf, &Meta{Net: "tcp", Address: "example.com:443"})
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		meta, err := ReadMeta(bytes.NewReader(data))
+		if err != nil {
+			var frameErr *FrameError
+			if !errors.As(err, &frameErr) {
+				t.Fatalf("ReadMeta() error = %v, want FrameError", err)
+			}
+			return
+		}
+		// a decoded meta must survive a round trip
+		out := &bytes.Buffer{}
+		if err = WriteMeta(out, meta); err != nil {
+			t.Fatalf("WriteMeta() error = %v", err)
+		}
+		again, err := ReadMeta(out)
+		if err != nil {
+			t.Fatalf("ReadMeta() of written meta error = %v", err)
+		}
+		if again.GetNet() != meta.GetNet() || again.GetAddress() != meta.GetAddress() {
+			t.Errorf("round trip = %v, want %v", again, meta)
+		}
+	})
+}
+
+func FuzzWriteMeta(f *testing.F) {
+	f.Add("tcp", "example.com:443")
+	f.Add("udp", "[::1]:53")
+	f.Add("", "")
+
+	f.Fuzz(func(t *testing.T, network, address string) {
+		buf := &bytes.Buffer{}
+		err := WriteMeta(buf, &Meta{Net: network, Address: address})
+		if errors.Is(err, FrameTooLarge) {
+			return
+		}
+		if err != nil {
+			// invalid utf-8 is refused by marshal
+			var frameErr *FrameError
+			if !errors.As(err, &frameErr) {
+				t.Fatalf("WriteMeta() error = %v, want FrameError", err)
+			}
+			return
+		}
+		if binary.BigEndian.Uint32(buf.Bytes()) != uint32(buf.Len()-4) {
+			t.Fatalf("length prefix mismatch")
+		}
+		meta, err := ReadMeta(buf)
+		if err != nil {
+			t.Fatalf("ReadMeta() error = %v", err)
+		}
+		if meta.GetNet() != network || meta.GetAddress() != address {
+			t.Errorf("ReadMeta() = %v, want %v %v", meta, network, address)
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// DialError is returned when server response a failed status
+type DialError struct {
+	Status Status
+	Msg    string
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("server response %v: %v", e.Status, e.Msg)
+}
+
+// Err return DialError if response is failed
+func (x *Response) Err() error {
+	if x.GetStatus() == Status_OK {
+		return nil
+	}
+	return &DialError{Status: x.GetStatus(), Msg: x.GetError()}
+}
+
+// StatusOf classify dial error to status
+func StatusOf(err error) Status {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var dialErr *DialError
+	switch {
+	case err == nil:
+		return Status_OK
+	case errors.As(err, &dialErr):
+		return dialErr.Status
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return Status_CONNECTION_REFUSED
+	case errors.Is(err, syscall.ENETUNREACH):
+		return Status_NETWORK_UNREACHABLE
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return Status_HOST_UNREACHABLE
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return Status_TIMEOUT
+	}
+	return Status_GENERAL_FAILURE
+}
+
+// NewResponse build response of dial error, err is nil means success
+func NewResponse(err error) (resp *Response) {
+	resp = &Response{Status: StatusOf(err)}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return
+}
+
+// ReadResponse read one response frame from reader
+func ReadResponse(reader io.Reader) (resp *Response, err error) {
+	resp = &Response{}
+	if err = read(reader, resp, MaxControlFrameSize); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// WriteResponse write one response frame to writer
+func WriteResponse(writer io.Writer, resp *Response) (err error) {
+	return write(writer, resp, MaxControlFrameSize)
+}
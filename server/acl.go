@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"through/config"
+	"through/proto"
+	"through/util"
+)
+
+const (
+	AclActionAllow = "allow"
+	AclActionDeny  = "deny"
+)
+
+// ACL decide which destinations client can dial through server
+type ACL struct {
+	defaultAllow bool
+	allowPrivate bool
+	rules        []aclRule
+}
+
+type aclRule struct {
+	allow      bool
+	cidrs      []*net.IPNet
+	ports      [][2]int
+	domains    []string
+	identities []string
+}
+
+func NewACL(cfg config.AclCfg) (a *ACL, err error) {
+	a = &ACL{allowPrivate: cfg.AllowPrivate}
+	if a.defaultAllow, err = parseAclAction(cfg.Default, true); err != nil {
+		return nil, err
+	}
+
+	for i, r := range cfg.Rules {
+		var ru aclRule
+		if ru, err = newAclRule(r); err != nil {
+			return nil, fmt.Errorf("acl rule %d: %w", i, err)
+		}
+		a.rules = append(a.rules, ru)
+	}
+	return
+}
+
+func parseAclAction(action string, empty bool) (allow bool, err error) {
+	switch strings.ToLower(strings.TrimSpace(action)) {
+	case "":
+		return empty, nil
+	case AclActionAllow:
+		return true, nil
+	case AclActionDeny:
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown acl action %q", action)
+}
+
+func newAclRule(r config.AclRule) (ru aclRule, err error) {
+	if r.Action == "" {
+		return ru, fmt.Errorf("action is required")
+	}
+	if ru.allow, err = parseAclAction(r.Action, false); err != nil {
+		return
+	}
+
+	for _, c := range r.CIDRs {
+		var ipnet *net.IPNet
+		if _, ipnet, err = net.ParseCIDR(strings.TrimSpace(c)); err != nil {
+			return
+		}
+		ru.cidrs = append(ru.cidrs, ipnet)
+	}
+	for _, p := range r.Ports {
+		var pr [2]int
+		if pr, err = util.ParsePortRange(p); err != nil {
+			return
+		}
+		ru.ports = append(ru.ports, pr)
+	}
+	for _, d := range r.Domains {
+		ru.domains = append(ru.domains, strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), ".")))
+	}
+	ru.identities = r.Identities
+	return
+}
+
+// aclTarget a destination to check, domain is empty if client ask for an ip
+type aclTarget struct {
+	identity *Identity
+	domain   string
+	ip       net.IP
+	port     int
+}
+
+func (r *aclRule) match(t *aclTarget) bool {
+	if len(r.identities) > 0 && !r.matchIdentity(t.identity) {
+		return false
+	}
+	if len(r.cidrs) > 0 && !r.matchCIDR(t.ip) {
+		return false
+	}
+	if len(r.ports) > 0 && !r.matchPort(t.port) {
+		return false
+	}
+	if len(r.domains) > 0 && !r.matchDomain(t.domain) {
+		return false
+	}
+	return true
+}
+
+func (r *aclRule) matchCIDR(ip net.IP) bool {
+	for _, c := range r.cidrs {
+		if c.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *aclRule) matchPort(port int) bool {
+	for _, pr := range r.ports {
+		if port >= pr[0] && port <= pr[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain "*" match any domain, "*.example.com" match subdomains, others match exactly
+func (r *aclRule) matchDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, d := range r.domains {
+		switch {
+		case d == "*":
+			return true
+		case strings.HasPrefix(d, "*."):
+			if strings.HasSuffix(domain, d[1:]) {
+				return true
+			}
+		case d == domain:
+			return true
+		}
+	}
+	return false
+}
+
+func (r *aclRule) matchIdentity(id *Identity) bool {
+	for _, name := range r.identities {
+		if id.Has(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivate return true for destinations on server host or its local network
+func isPrivate(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// allowed check one resolved destination with policy rules then acl rules, reason is set when denied
+func (a *ACL) allowed(t *aclTarget, policy *Policy) (ok bool, reason string) {
+	if policy != nil {
+		for i := range policy.rules {
+			if policy.rules[i].match(t) {
+				if policy.rules[i].allow {
+					return true, ""
+				}
+				return false, fmt.Sprintf("denied by policy %v rule %d", policy.identity, i)
+			}
+		}
+	}
+	for i := range a.rules {
+		if a.rules[i].match(t) {
+			if a.rules[i].allow {
+				return true, ""
+			}
+			return false, fmt.Sprintf("denied by acl rule %d", i)
+		}
+	}
+	if !a.allowPrivate && isPrivate(t.ip) {
+		return false, "private address is not allowed"
+	}
+	if !a.defaultAllow {
+		return false, "denied by default acl"
+	}
+	return true, ""
+}
+
+// Resolve resolve address and return the allowed ip addresses to dial,
+// ip is checked instead of host so that dns can't be used to bypass acl
+func (a *ACL) Resolve(ctx context.Context, identity *Identity, policy *Policy, address string) (addrs []string, err error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("port %q format error", portStr)
+	}
+
+	var ips []net.IP
+	domain := ""
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		domain = host
+		ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ia := range ipAddrs {
+			ips = append(ips, ia.IP)
+		}
+	}
+
+	reason := ""
+	for _, ip := range ips {
+		ok, why := a.allowed(&aclTarget{identity: identity, domain: domain, ip: ip, port: port}, policy)
+		if !ok {
+			reason = why
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(ip.String(), portStr))
+	}
+	if len(addrs) == 0 {
+		return nil, &proto.DialError{Status: proto.Status_NOT_ALLOWED, Msg: reason}
+	}
+	return
+}
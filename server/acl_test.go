@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"through/config"
+	"through/proto"
+)
+
+func TestACL_Resolve(t *testing.T) {
+	acl, err := NewACL(config.AclCfg{
+		Default: "allow",
+		Rules: []config.AclRule{
+			{Action: "allow", CIDRs: []string{"10.1.0.0/16"}, Identities: []string{"office"}},
+			{Action: "deny", Ports: []string{"25", "6000-6100"}},
+			{Action: "deny", CIDRs: []string{"203.0.113.0/24", "2001:db8::/32"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		identity string
+		address  string
+		allow    bool
+	}{
+		{"public", "", "198.51.100.1:443", true},
+		{"loopback", "", "127.0.0.1:80", false},
+		{"ipv6 loopback", "", "[::1]:80", false},
+		{"private", "", "192.168.1.1:80", false},
+		{"link local", "", "169.254.169.254:80", false},
+		{"private allowed for identity", "office", "10.1.2.3:22", true},
+		{"private for other identity", "home", "10.1.2.3:22", false},
+		{"private allowed for san", "office.example.com", "10.1.2.3:22", true},
+		{"denied port", "", "198.51.100.1:25", false},
+		{"denied port range", "", "198.51.100.1:6050", false},
+		{"denied cidr", "", "203.0.113.9:443", false},
+		{"denied ipv6 cidr", "", "[2001:db8::1]:443", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var id *Identity
+			if tt.identity != "" {
+				id = &Identity{CN: tt.identity}
+			}
+			if tt.identity == "office.example.com" {
+				id = &Identity{CN: "laptop", SANs: []string{"office"}}
+			}
+			addrs, err := acl.Resolve(context.Background(), id, nil, tt.address)
+			if tt.allow {
+				if err != nil || len(addrs) != 1 {
+					t.Errorf("Resolve() = %v, %v, want allowed", addrs, err)
+				}
+				return
+			}
+			var dialErr *proto.DialError
+			if !errors.As(err, &dialErr) || dialErr.Status != proto.Status_NOT_ALLOWED {
+				t.Errorf("Resolve() error = %v, want NOT_ALLOWED", err)
+			}
+		})
+	}
+}
+
+func TestACL_Default(t *testing.T) {
+	acl, err := NewACL(config.AclCfg{
+		Default:      "deny",
+		AllowPrivate: true,
+		Rules:        []config.AclRule{{Action: "allow", Domains: []string{"*.example.com"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = acl.Resolve(context.Background(), nil, nil, "127.0.0.1:80"); err == nil {
+		t.Errorf("Resolve() want denied by default")
+	}
+}
+
+func TestACLRule_MatchDomain(t *testing.T) {
+	ru, err := newAclRule(config.AclRule{Action: "deny", Domains: []string{"*.example.com", "Example.org."}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for domain, want := range map[string]bool{
+		"www.example.com": true,
+		"example.com":     false,
+		"example.org":     true,
+		"EXAMPLE.ORG":     true,
+		"example.net":     false,
+		"":                false,
+	} {
+		if got := ru.matchDomain(domain); got != want {
+			t.Errorf("matchDomain(%q) = %v, want %v", domain, got, want)
+		}
+	}
+}
+
+func TestNewACL_Invalid(t *testing.T) {
+	for _, cfg := range []config.AclCfg{
+		{Default: "maybe"},
+		{Rules: []config.AclRule{{CIDRs: []string{"10.0.0.0/8"}}}},
+		{Rules: []config.AclRule{{Action: "deny", CIDRs: []string{"10.0.0.0"}}}},
+		{Rules: []config.AclRule{{Action: "deny", Ports: []string{"9000-8000"}}}},
+		{Rules: []config.AclRule{{Action: "deny", Ports: []string{"http"}}}},
+	} {
+		if _, err := NewACL(cfg); err == nil {
+			t.Errorf("NewACL(%+v) want error", cfg)
+		}
+	}
+}
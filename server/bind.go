@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"through/config"
+	"through/proto"
+	"through/util"
+	"time"
+)
+
+const bindTimeout = 2 * time.Minute
+
+// bind listen for one inbound connection and splice it with the tunnel.
+// the address in meta is the expected peer, only connections from its ips are accepted like RFC 1928.
+// unspecified address like 0.0.0.0:0 accept any peer, the acl is not checked for it
+func (c *Connection) bind(conn net.Conn, meta *proto.Meta) {
+	var allowed map[string]bool
+	if !util.AnyPeer(meta.GetAddress()) {
+		// the address of expected peer is checked like dialing
+		ctx, cancel := context.WithTimeout(c.ctx, dialTimeout)
+		addrs, err := c.resolve(ctx, meta.GetAddress())
+		cancel()
+		if err != nil {
+			c.Errorf("bind for %v error: %v", meta.GetAddress(), err)
+			_ = proto.WriteResponse(conn, proto.NewResponse(err))
+			_ = conn.Close()
+			return
+		}
+		allowed = map[string]bool{}
+		for _, addr := range addrs {
+			host, _, _ := net.SplitHostPort(addr)
+			allowed[net.ParseIP(host).String()] = true
+		}
+	}
+
+	lis, err := net.Listen("tcp", ":0")
+	if err != nil {
+		c.Errorf("bind listen error: %v", err)
+		_ = proto.WriteResponse(conn, proto.NewResponse(err))
+		_ = conn.Close()
+		return
+	}
+	defer lis.Close()
+
+	// report the address which peer can connect to
+	host := config.Server.BindHost
+	if host == "" {
+		host, _, _ = net.SplitHostPort(c.conn.LocalAddr().String())
+	}
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	bound := net.JoinHostPort(host, port)
+
+	if err = proto.WriteResponse(conn, &proto.Response{Status: proto.Status_OK, BoundAddress: bound}); err != nil {
+		c.Errorf("write bind meta error: %v", err)
+		_ = conn.Close()
+		return
+	}
+	c.Infof("bind at %v for %v", bound, meta.GetAddress())
+
+	// client send nothing until peer accepted, the tunnel closed by client cancel the bind
+	var accepted atomic.Bool
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		_, _ = conn.Read(make([]byte, 1))
+		if !accepted.Load() {
+			_ = lis.Close()
+		}
+	}()
+
+	peer, err := util.AcceptPeer(lis.(*net.TCPListener), allowed, bindTimeout, func(addr net.Addr) {
+		c.Warnf("bind refuse unexpected peer %v", addr)
+	})
+	accepted.Store(true)
+	_ = conn.SetReadDeadline(time.Now())
+	<-watching
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.Errorf("bind accept error: %v", err)
+		_ = proto.WriteResponse(conn, proto.NewResponse(err))
+		_ = conn.Close()
+		return
+	}
+
+	// the second response carry the peer address
+	if err = proto.WriteResponse(conn, &proto.Response{Status: proto.Status_OK, BoundAddress: peer.RemoteAddr().String()}); err != nil {
+		c.Errorf("write bind peer meta error: %v", err)
+		_ = peer.Close()
+		_ = conn.Close()
+		return
+	}
+	c.Infof("bind accept %v", peer.RemoteAddr())
+
+	util.CopyLoopWait(c.policy.Limit(peer), conn)
+}
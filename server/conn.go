@@ -2,39 +2,259 @@ package server
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net"
 	"through/log"
 	"through/proto"
 	"through/util"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
 )
 
+const dialTimeout = 10 * time.Second
+
+// handshakeTimeout limit the time client take to send hello or the meta of a stream,
+// meta of a connection is not limited since client keep idle connections in pool
+var handshakeTimeout = 10 * time.Second
+
 type Connection struct {
-	conn net.Conn
-	ctx  context.Context
+	conn     net.Conn
+	ctx      context.Context
+	acl      *ACL
+	policies []*Policy
+	hello    *proto.Hello // hello of client, version 0 for legacy client
+	identity *Identity    // from client certificate, set after handshake
+	policy   *Policy      // policy of identity, nil if no policy matched
 	*log.Logger
 }
 
-func NewConnection(ctx context.Context, conn net.Conn, logger *log.Logger) (c *Connection) {
-	return &Connection{ctx: ctx, conn: conn, Logger: logger}
+func NewConnection(ctx context.Context, conn net.Conn, acl *ACL, policies []*Policy, logger *log.Logger) (c *Connection) {
+	return &Connection{ctx: ctx, conn: conn, acl: acl, policies: policies, Logger: logger}
 }
 
 func (c *Connection) Process() {
-	//  read data
-	meta, err := proto.ReadMeta(c.conn)
+	meta, err := c.handshake()
 	if err != nil {
-		log.Errorf("read meta data error: %v", err)
+		// idle pooled connections are closed by client without sending anything
+		if errors.Is(err, io.EOF) {
+			c.Debugf("connection from %v closed before handshake", c.conn.RemoteAddr())
+		} else {
+			c.Errorf("handshake with %v error: %v", c.conn.RemoteAddr(), err)
+		}
+		_ = c.conn.Close()
 		return
 	}
 
-	// dial connection
-	remote, err := net.Dial(meta.GetNet(), meta.GetAddress())
+	// client ask for multiplexing, serve streams on this connection
+	if meta.GetNet() == proto.NetMux && !c.hello.Legacy() {
+		c.serveMux()
+		return
+	}
+
+	c.forward(c.conn, meta)
+}
+
+// handshake exchange hello with client and read the first meta,
+// legacy client send meta directly without hello
+func (c *Connection) handshake() (meta *proto.Meta, err error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer func() { _ = c.conn.SetReadDeadline(time.Time{}) }()
+
+	if c.hello, meta, err = proto.ReadHandshake(c.conn); err != nil {
+		return
+	}
+	// tls handshake is done by the first read
+	if c.identity = identityOf(c.conn); c.identity != nil {
+		c.ctx = WithIdentity(c.ctx, c.identity)
+		c.Logger = c.Logger.With("identity", c.identity.CN, "serial", c.identity.Serial)
+	}
+	c.policy = matchPolicy(c.policies, c.identity)
+	if c.hello.Legacy() {
+		c.Warnf("legacy client from %v, only tcp forwarding is supported", c.conn.RemoteAddr())
+		return
+	}
+
+	reply := proto.NewHello()
+	if err = c.hello.Check(); err != nil {
+		reply.Error = err.Error()
+		_ = proto.WriteHello(c.conn, reply)
+		return
+	}
+	if err = proto.WriteHello(c.conn, reply); err != nil {
+		return
+	}
+	c.Debugf("client %v protocol version %d, capabilities %v", c.conn.RemoteAddr(), c.hello.GetVersion(), c.hello.GetCapabilities())
+
+	_ = c.conn.SetReadDeadline(time.Time{})
+	return proto.ReadMeta(c.conn)
+}
+
+// serveMux accept streams from a multiplexed session, every stream carry its own meta
+func (c *Connection) serveMux() {
+	// echo the mux meta to confirm
+	if err := proto.WriteMeta(c.conn, &proto.Meta{Net: proto.NetMux}); err != nil {
+		c.Errorf("write mux meta error: %v", err)
+		_ = c.conn.Close()
+		return
+	}
+
+	session, err := smux.Server(c.conn, proto.MuxConfig())
 	if err != nil {
-		log.Errorf("dial to %v:%v error:%v", meta.GetNet(), meta.GetAddress(), err)
+		c.Errorf("new mux session error: %v", err)
 		_ = c.conn.Close()
 		return
 	}
-	log.Infof("dial to %v,%v", meta.GetNet(), meta.Address)
+	defer session.Close()
+
+	// close session when server stopping
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			_ = session.Close()
+		case <-session.CloseChan():
+		}
+	}()
+
+	c.Infof("mux session start from %v", c.conn.RemoteAddr())
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) && !errors.Is(err, io.EOF) {
+				c.Errorf("accept stream error: %v", err)
+			}
+			c.Infof("mux session from %v closed", c.conn.RemoteAddr())
+			return
+		}
+
+		go c.processStream(stream)
+	}
+}
+
+func (c *Connection) processStream(stream net.Conn) {
+	_ = stream.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	meta, err := proto.ReadMeta(stream)
+	_ = stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.Errorf("read stream meta data error: %v", err)
+		_ = stream.Close()
+		return
+	}
+
+	if meta.GetNet() == proto.NetMux {
+		c.Errorf("nested mux is not allowed")
+		_ = proto.WriteResponse(stream, &proto.Response{Status: proto.Status_UNSUPPORTED, Error: "nested mux is not allowed"})
+		_ = stream.Close()
+		return
+	}
+
+	c.forward(stream, meta)
+}
+
+// forward dial the address in meta and copy data between conn and remote
+func (c *Connection) forward(conn net.Conn, meta *proto.Meta) {
+	if !c.policy.Acquire() {
+		c.Warnf("max streams of policy %v reached, refuse %v", c.policy.identity, meta.GetAddress())
+		if !c.hello.Legacy() {
+			_ = proto.WriteResponse(conn, &proto.Response{Status: proto.Status_NOT_ALLOWED, Error: "max streams reached"})
+		}
+		_ = conn.Close()
+		return
+	}
+	defer c.policy.Release()
+
+	if c.hello.Legacy() {
+		c.forwardLegacy(conn, meta)
+		return
+	}
+
+	switch meta.GetNet() {
+	case proto.NetUDP:
+		c.relay(conn)
+		return
+	case proto.NetBind:
+		c.bind(conn, meta)
+		return
+	}
+
+	// dial connection
+	start := time.Now()
+	remote, err := c.dial(meta.GetNet(), meta.GetAddress())
+	if err != nil {
+		c.Errorf("dial to %v:%v error:%v", meta.GetNet(), meta.GetAddress(), err)
+		_ = proto.WriteResponse(conn, proto.NewResponse(err))
+		_ = conn.Close()
+		return
+	}
+	c.Infof("dial to %v,%v", meta.GetNet(), meta.Address)
+
+	// tell client the dial result
+	resp := proto.NewResponse(nil)
+	resp.BoundAddress = remote.LocalAddr().String()
+	resp.Latency = time.Since(start).Milliseconds()
+	if err = proto.WriteResponse(conn, resp); err != nil {
+		c.Errorf("write response error: %v", err)
+		_ = remote.Close()
+		_ = conn.Close()
+		return
+	}
 
 	// forward
-	util.CopyLoopWait(remote, c.conn)
+	util.CopyLoopWait(c.policy.Limit(remote), conn)
+}
+
+// forwardLegacy serve legacy client, which expect no response
+func (c *Connection) forwardLegacy(conn net.Conn, meta *proto.Meta) {
+	if meta.GetNet() != "tcp" {
+		c.Errorf("net %v is not supported by legacy client", meta.GetNet())
+		_ = conn.Close()
+		return
+	}
+
+	remote, err := c.dial(meta.GetNet(), meta.GetAddress())
+	if err != nil {
+		c.Errorf("dial to %v:%v error:%v", meta.GetNet(), meta.GetAddress(), err)
+		_ = conn.Close()
+		return
+	}
+	c.Infof("dial to %v,%v", meta.GetNet(), meta.Address)
+
+	util.CopyLoopWait(c.policy.Limit(remote), conn)
+}
+
+// resolve address and check it with acl, denied attempt is logged
+func (c *Connection) resolve(ctx context.Context, address string) (addrs []string, err error) {
+	addrs, err = c.acl.Resolve(ctx, c.identity, c.policy, address)
+	var dialErr *proto.DialError
+	if errors.As(err, &dialErr) {
+		c.Warnf("acl deny %v from %v(%v): %v", address, c.identity, c.conn.RemoteAddr(), dialErr.Msg)
+	}
+	return
+}
+
+// dial the allowed addresses of address in order until one success,
+// kcp is dialed when the client reach a kcp server through this one
+func (c *Connection) dial(network, address string) (remote net.Conn, err error) {
+	ctx, cancel := context.WithTimeout(c.ctx, dialTimeout)
+	defer cancel()
+
+	addrs, err := c.resolve(ctx, address)
+	if err != nil {
+		return
+	}
+	dialer := &net.Dialer{}
+	for _, addr := range addrs {
+		if network == proto.NetKcp {
+			// kcp has no handshake, dial only fail on bad address
+			remote, err = kcp.Dial(addr)
+		} else {
+			remote, err = dialer.DialContext(ctx, network, addr)
+		}
+		if err == nil {
+			return
+		}
+	}
+	return
 }
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"through/config"
+	"through/log"
+	"through/proto"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	config.Common = &config.CommonCfg{
+		Env:     "dev",
+		LogFile: "",
+	}
+	config.Server = &config.ServerCfg{}
+	if err := log.Init(); err != nil {
+		panic(err)
+	}
+	m.Run()
+}
+
+func TestConnection_IdleBeforeMeta(t *testing.T) {
+	timeout := handshakeTimeout
+	handshakeTimeout = 100 * time.Millisecond
+	defer func() { handshakeTimeout = timeout }()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	acl, err := NewACL(config.AclCfg{AllowPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// client keep connections in pool after hello, meta may come much later
+	conn := helloTunnel(t, acl)
+	time.Sleep(3 * handshakeTimeout)
+	if err = proto.WriteMeta(conn, &proto.Meta{Net: "tcp", Address: target.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := proto.ReadResponse(conn)
+	if err != nil {
+		t.Fatalf("idle connection is closed: %v", err)
+	}
+	if err = resp.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnection_UdpRelay(t *testing.T) {
+	echo := udpEchoServer(t)
+
+	acl, err := NewACL(config.AclCfg{AllowPrivate: true, Rules: []config.AclRule{{Action: "deny", Ports: []string{"9"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, resp := openTunnel(t, acl, &proto.Meta{Net: proto.NetUDP})
+	if err = resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// denied target is dropped, datagrams after it still pass
+	for _, addr := range []string{"127.0.0.1:9", echo.String(), "127.0.0.1:9", echo.String()} {
+		if err = proto.WriteDatagram(conn, &proto.Datagram{Address: addr, Data: []byte(addr)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		dg, err := proto.ReadDatagram(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dg.GetAddress() != echo.String() {
+			t.Errorf("datagram from %v, want %v", dg.GetAddress(), echo)
+		}
+		if string(dg.GetData()) == "127.0.0.1:9" {
+			t.Error("datagram to denied target is relayed")
+		}
+	}
+}
+
+func TestConnection_Bind(t *testing.T) {
+	acl, err := NewACL(config.AclCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateAcl, err := NewACL(config.AclCfg{AllowPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialFrom := func(ip, addr string) (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: time.Second, LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		return dialer.Dial("tcp", addr)
+	}
+
+	t.Run("any peer", func(t *testing.T) {
+		// unspecified address is not checked by acl
+		conn, resp := openTunnel(t, acl, &proto.Meta{Net: proto.NetBind, Address: "0.0.0.0:0"})
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+		peer, err := dialFrom("127.0.0.1", resp.GetBoundAddress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		if resp, err = proto.ReadResponse(conn); err != nil || resp.Err() != nil {
+			t.Fatalf("second response = %v, %v", resp, err)
+		}
+		if resp.GetBoundAddress() != peer.LocalAddr().String() {
+			t.Errorf("peer address = %v, want %v", resp.GetBoundAddress(), peer.LocalAddr())
+		}
+		if _, err = peer.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("read %q, %v, want ping", buf, err)
+		}
+	})
+
+	t.Run("expected peer", func(t *testing.T) {
+		conn, resp := openTunnel(t, privateAcl, &proto.Meta{Net: proto.NetBind, Address: "127.0.0.2:0"})
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+		other, err := dialFrom("127.0.0.1", resp.GetBoundAddress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer other.Close()
+		_ = other.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = other.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("unexpected peer read error = %v, want EOF", err)
+		}
+		peer, err := dialFrom("127.0.0.2", resp.GetBoundAddress())
+		if err != nil {
+			t.Skipf("dial from 127.0.0.2: %v", err)
+		}
+		defer peer.Close()
+		if resp, err = proto.ReadResponse(conn); err != nil || resp.GetBoundAddress() != peer.LocalAddr().String() {
+			t.Errorf("second response = %v, %v, want peer %v", resp, err, peer.LocalAddr())
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		_, resp := openTunnel(t, acl, &proto.Meta{Net: proto.NetBind, Address: "127.0.0.1:21"})
+		if resp.GetStatus() != proto.Status_NOT_ALLOWED {
+			t.Errorf("status = %v, want NOT_ALLOWED", resp.GetStatus())
+		}
+	})
+
+	t.Run("client gone", func(t *testing.T) {
+		conn, resp := openTunnel(t, acl, &proto.Meta{Net: proto.NetBind, Address: "0.0.0.0:0"})
+		if err := resp.Err(); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+		time.Sleep(200 * time.Millisecond)
+		if peer, err := dialFrom("127.0.0.1", resp.GetBoundAddress()); err == nil {
+			_ = peer.Close()
+			t.Error("listener is not closed after tunnel closed")
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"through/log"
+	"through/proto"
+	"time"
+)
+
+// openTunnel process a connection with acl, exchange hello and send meta like client, return the first response
+func openTunnel(t *testing.T, acl *ACL, meta *proto.Meta) (conn net.Conn, resp *proto.Response) {
+	conn = helloTunnel(t, acl)
+	if err := proto.WriteMeta(conn, meta); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := proto.ReadResponse(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// helloTunnel process a connection with acl and exchange hello like client
+func helloTunnel(t *testing.T, acl *ACL) (conn net.Conn) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		conn, err := lis.Accept()
+		if err == nil {
+			NewConnection(ctx, conn, acl, nil, log.NewLogger()).Process()
+		}
+	}()
+
+	if conn, err = net.Dial("tcp", lis.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err = proto.WriteHello(conn, proto.NewHello()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = proto.ReadHello(conn); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// udpEchoServer echo every datagram on 127.0.0.1
+func udpEchoServer(t *testing.T) net.Addr {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], from)
+		}
+	}()
+	return pc.LocalAddr()
+}
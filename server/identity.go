@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// Identity of client from its verified certificate
+type Identity struct {
+	CN     string
+	SANs   []string // dns names, emails, ip addresses and uris
+	Serial string   // hex serial number
+}
+
+type identityKey struct{}
+
+// identityOf return identity of tls connection, nil if peer has no certificate
+func identityOf(conn net.Conn) *Identity {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+
+	cert := certs[0]
+	id := &Identity{CN: cert.Subject.CommonName, Serial: fmt.Sprintf("%x", cert.SerialNumber)}
+	id.SANs = append(id.SANs, cert.DNSNames...)
+	id.SANs = append(id.SANs, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		id.SANs = append(id.SANs, ip.String())
+	}
+	for _, u := range cert.URIs {
+		id.SANs = append(id.SANs, u.String())
+	}
+	return id
+}
+
+// Has return true if name is the common name or one of SANs
+func (i *Identity) Has(name string) bool {
+	if i == nil {
+		return false
+	}
+	if i.CN == name {
+		return true
+	}
+	for _, san := range i.SANs {
+		if san == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Identity) String() string {
+	if i == nil {
+		return "anonymous"
+	}
+	return i.CN
+}
+
+// WithIdentity return a context carrying identity
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFrom return identity in context, nil if not set
+func IdentityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
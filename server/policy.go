@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"through/config"
+
+	"golang.org/x/time/rate"
+)
+
+// minBurst allow one max datagram or one copy buffer to pass the limiter at once
+const minBurst = 128 << 10
+
+// Policy limit clients of one identity, limits are shared by all their connections.
+// policy from config is a template, each identity matching it get its own limits by of
+type Policy struct {
+	identity   string
+	rules      []aclRule
+	bandwidth  int64
+	up         *rate.Limiter // client to remote
+	down       *rate.Limiter // remote to client
+	maxStreams int32
+	streams    atomic.Int32
+
+	lc      sync.Mutex
+	clients map[string]*Policy // limits of each identity, keyed by common name
+}
+
+func newPolicy(identity string, rules []aclRule, maxStreams int32, bandwidth int64) (p *Policy) {
+	p = &Policy{identity: identity, rules: rules, maxStreams: maxStreams, bandwidth: bandwidth}
+	if bandwidth > 0 {
+		burst := int(bandwidth)
+		if burst < minBurst {
+			burst = minBurst
+		}
+		p.up = rate.NewLimiter(rate.Limit(bandwidth), burst)
+		p.down = rate.NewLimiter(rate.Limit(bandwidth), burst)
+	}
+	return
+}
+
+func NewPolicies(cfg []config.IdentityPolicy) (ps []*Policy, err error) {
+	for i, c := range cfg {
+		if c.Identity == "" {
+			return nil, fmt.Errorf("policy %d: identity is required", i)
+		}
+		var rules []aclRule
+		for j, r := range c.Rules {
+			var ru aclRule
+			if ru, err = newAclRule(r); err != nil {
+				return nil, fmt.Errorf("policy %v rule %d: %w", c.Identity, j, err)
+			}
+			rules = append(rules, ru)
+		}
+		ps = append(ps, newPolicy(c.Identity, rules, int32(c.MaxStreams), c.Bandwidth))
+	}
+	return
+}
+
+// matchPolicy return limits of identity from the first policy it matches, nil if none
+func matchPolicy(ps []*Policy, id *Identity) *Policy {
+	for _, p := range ps {
+		if p.identity == "*" || id.Has(p.identity) {
+			return p.of(id)
+		}
+	}
+	return nil
+}
+
+// of return limits of identity created from policy on first use, clients without certificate share one
+func (p *Policy) of(id *Identity) *Policy {
+	key := ""
+	if id != nil {
+		key = id.CN
+	}
+	p.lc.Lock()
+	defer p.lc.Unlock()
+	if p.clients == nil {
+		p.clients = make(map[string]*Policy)
+	}
+	c, ok := p.clients[key]
+	if !ok {
+		c = newPolicy(p.identity, p.rules, p.maxStreams, p.bandwidth)
+		p.clients[key] = c
+	}
+	return c
+}
+
+// Acquire take one stream, return false if max streams reached
+func (p *Policy) Acquire() bool {
+	if p == nil {
+		return true
+	}
+	if n := p.streams.Add(1); p.maxStreams > 0 && n > p.maxStreams {
+		p.streams.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Release the stream taken by Acquire
+func (p *Policy) Release() {
+	if p == nil {
+		return
+	}
+	p.streams.Add(-1)
+}
+
+// Limit wrap remote connection with bandwidth limit
+func (p *Policy) Limit(remote net.Conn) net.Conn {
+	if p == nil || p.up == nil {
+		return remote
+	}
+	return &limitConn{Conn: remote, up: p.up, down: p.down}
+}
+
+// WaitUp wait until n bytes can be sent to remote
+func (p *Policy) WaitUp(ctx context.Context, n int) error {
+	if p == nil || p.up == nil {
+		return nil
+	}
+	return waitN(ctx, p.up, n)
+}
+
+// WaitDown wait until n bytes can be sent to client
+func (p *Policy) WaitDown(ctx context.Context, n int) error {
+	if p == nil || p.down == nil {
+		return nil
+	}
+	return waitN(ctx, p.down, n)
+}
+
+// waitN wait for n tokens, n larger than burst is taken in pieces
+func waitN(ctx context.Context, l *rate.Limiter, n int) (err error) {
+	for n > 0 {
+		take := n
+		if take > l.Burst() {
+			take = l.Burst()
+		}
+		if err = l.WaitN(ctx, take); err != nil {
+			return
+		}
+		n -= take
+	}
+	return
+}
+
+// limitConn remote connection whose read and write are limited
+type limitConn struct {
+	net.Conn
+	up   *rate.Limiter
+	down *rate.Limiter
+}
+
+func (l *limitConn) Read(b []byte) (n int, err error) {
+	n, err = l.Conn.Read(b)
+	if n > 0 {
+		if e := waitN(context.Background(), l.down, n); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+func (l *limitConn) Write(b []byte) (n int, err error) {
+	if err = waitN(context.Background(), l.up, len(b)); err != nil {
+		return
+	}
+	return l.Conn.Write(b)
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"through/config"
+)
+
+func TestMatchPolicy(t *testing.T) {
+	ps, err := NewPolicies([]config.IdentityPolicy{
+		{Identity: "office", MaxStreams: 1},
+		{Identity: "*", MaxStreams: 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := matchPolicy(ps, &Identity{CN: "laptop", SANs: []string{"office"}}); p == nil || p.identity != "office" {
+		t.Errorf("matchPolicy() = %v, want office", p)
+	}
+	if p := matchPolicy(ps, &Identity{CN: "home"}); p == nil || p.identity != "*" {
+		t.Errorf("matchPolicy() = %v, want *", p)
+	}
+	if p := matchPolicy(ps[:1], nil); p != nil {
+		t.Errorf("matchPolicy() = %v, want nil", p)
+	}
+}
+
+func TestPolicy_Acquire(t *testing.T) {
+	ps, err := NewPolicies([]config.IdentityPolicy{{Identity: "office", MaxStreams: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ps[0]
+	if !p.Acquire() || !p.Acquire() {
+		t.Fatal("Acquire() = false, want true")
+	}
+	if p.Acquire() {
+		t.Error("Acquire() = true, want false when max streams reached")
+	}
+	p.Release()
+	if !p.Acquire() {
+		t.Error("Acquire() = false after release")
+	}
+
+	var none *Policy
+	if !none.Acquire() {
+		t.Error("nil policy Acquire() = false")
+	}
+	none.Release()
+}
+
+func TestPolicy_PerIdentity(t *testing.T) {
+	ps, err := NewPolicies([]config.IdentityPolicy{{Identity: "*", MaxStreams: 2, Bandwidth: 1 << 20}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each client get the full limits, connections of the same client share them
+	home, laptop := &Identity{CN: "home"}, &Identity{CN: "laptop"}
+	for _, id := range []*Identity{home, laptop} {
+		p := matchPolicy(ps, id)
+		if !p.Acquire() || !p.Acquire() {
+			t.Fatalf("Acquire() of %v = false, want true", id)
+		}
+	}
+	if matchPolicy(ps, home).Acquire() {
+		t.Error("Acquire() = true, want false when max streams of home reached")
+	}
+	if a, b := matchPolicy(ps, home), matchPolicy(ps, laptop); a.up == b.up {
+		t.Error("limiter is shared by different identities")
+	}
+}
+
+func TestPolicy_Rules(t *testing.T) {
+	acl, err := NewACL(config.AclCfg{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := NewPolicies([]config.IdentityPolicy{{
+		Identity: "office",
+		Rules: []config.AclRule{
+			{Action: "allow", CIDRs: []string{"10.0.0.0/8"}},
+			{Action: "deny", CIDRs: []string{"0.0.0.0/0"}},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := &Identity{CN: "office"}
+	if _, err = acl.Resolve(context.Background(), id, ps[0], "10.0.0.1:22"); err != nil {
+		t.Errorf("Resolve() error = %v, want allowed by policy", err)
+	}
+	if _, err = acl.Resolve(context.Background(), id, ps[0], "198.51.100.1:443"); err == nil {
+		t.Error("Resolve() want denied by policy")
+	}
+}
+
+func TestNewPolicies_Invalid(t *testing.T) {
+	for _, cfg := range [][]config.IdentityPolicy{
+		{{MaxStreams: 1}},
+		{{Identity: "office", Rules: []config.AclRule{{Action: "deny", CIDRs: []string{"bad"}}}}},
+	} {
+		if _, err := NewPolicies(cfg); err == nil {
+			t.Errorf("NewPolicies(%+v) want error", cfg)
+		}
+	}
+}
+
+func TestWaitN(t *testing.T) {
+	ps, err := NewPolicies([]config.IdentityPolicy{{Identity: "*", Bandwidth: 1 << 20}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// larger than burst is taken in pieces instead of failing
+	if err = ps[0].WaitUp(context.Background(), 1<<20+64<<10); err != nil {
+		t.Errorf("WaitUp() error = %v", err)
+	}
+}
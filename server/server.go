@@ -5,7 +5,6 @@ import (
 	"crypto/tls"
 	"errors"
 	"github.com/xtaci/kcp-go"
-	"go.uber.org/zap"
 	"net"
 	"sync"
 	"through/config"
@@ -16,6 +15,8 @@ import (
 type Server struct {
 	ctx         context.Context
 	tlsCfg      *tls.Config
+	acl         *ACL
+	policies    []*Policy
 	tcpListener net.Listener
 	kcpListener net.Listener
 	wg          sync.WaitGroup
@@ -23,15 +24,40 @@ type Server struct {
 
 func NewServer(ctx context.Context) (s *Server, err error) {
 	cfg := config.Server
-	tlsCfg, err := util.LoadTlsConfig(cfg.PrivateKey, cfg.CrtFile, cfg.CAFile, false)
+	var crl *util.CRL
+	if cfg.CRLFile != "" {
+		if crl, err = util.LoadCRL(cfg.CRLFile, cfg.CAFile); err != nil {
+			return
+		}
+		go crl.Watch(ctx, util.WatchInterval)
+	}
+	tlsCfg, err := util.LoadServerTlsConfig(ctx, cfg.PrivateKey, cfg.CrtFile, cfg.CAFile, crl)
+	if err != nil {
+		return
+	}
+
+	// servers upgraded without acl block keep forwarding to lan hosts
+	aclCfg := config.AclCfg{AllowPrivate: true}
+	if cfg.ACL != nil {
+		aclCfg = *cfg.ACL
+	} else {
+		log.Warnf("no acl configured, private destinations are allowed, configure acl to deny them")
+	}
+	acl, err := NewACL(aclCfg)
+	if err != nil {
+		return
+	}
+	policies, err := NewPolicies(cfg.Policies)
 	if err != nil {
 		return
 	}
 
 	s = &Server{
-		ctx:    ctx,
-		tlsCfg: tlsCfg,
-		wg:     sync.WaitGroup{},
+		ctx:      ctx,
+		tlsCfg:   tlsCfg,
+		acl:      acl,
+		policies: policies,
+		wg:       sync.WaitGroup{},
 	}
 
 	return
@@ -86,7 +112,7 @@ func (s *Server) listenTcp() {
 
 		log.Infof("accept connection from: %v", conn.RemoteAddr())
 
-		con := NewConnection(s.ctx, conn, log.NewLogger(zap.AddCallerSkip(1)))
+		con := NewConnection(s.ctx, conn, s.acl, s.policies, log.NewLogger().With("remote", conn.RemoteAddr().String()))
 		go con.Process()
 	}
 }
@@ -112,7 +138,7 @@ func (s *Server) listenKcp() {
 
 		// warp with tls
 		conn = tls.Server(conn, s.tlsCfg)
-		con := NewConnection(s.ctx, conn, log.NewLogger(zap.AddCallerSkip(1)))
+		con := NewConnection(s.ctx, conn, s.acl, s.policies, log.NewLogger().With("remote", conn.RemoteAddr().String()))
 		go con.Process()
 	}
 }
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"through/proto"
+)
+
+const maxDatagramSize = 64 * 1024
+
+// maxUdpTargets limit targets cached by an association, the cache is cleared when it's full
+const maxUdpTargets = 1024
+
+// udpTarget result of resolving a target and checking it by acl
+type udpTarget struct {
+	addr *net.UDPAddr
+	err  error
+}
+
+// relay datagrams between tunnel and targets, each datagram frame carry its own target address
+func (c *Connection) relay(conn net.Conn) {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		c.Errorf("listen udp error: %v", err)
+		_ = proto.WriteResponse(conn, proto.NewResponse(err))
+		_ = conn.Close()
+		return
+	}
+	c.Infof("udp relay at %v", pc.LocalAddr())
+
+	resp := proto.NewResponse(nil)
+	resp.BoundAddress = pc.LocalAddr().String()
+	if err = proto.WriteResponse(conn, resp); err != nil {
+		c.Errorf("write response error: %v", err)
+		_ = pc.Close()
+		_ = conn.Close()
+		return
+	}
+
+	// tunnel -> target
+	go func() {
+		defer pc.Close()
+		// targets are resolved once per association, so a slow name don't stall every datagram
+		targets := make(map[string]udpTarget)
+		for {
+			dg, err := proto.ReadDatagram(conn)
+			if err != nil {
+				if errors.Is(err, proto.FrameTooLarge) {
+					c.Errorf("read datagram error: %v", err)
+				}
+				return
+			}
+			target, ok := targets[dg.GetAddress()]
+			if !ok {
+				target.addr, target.err = c.resolveUdp(dg.GetAddress())
+				if len(targets) >= maxUdpTargets {
+					targets = make(map[string]udpTarget)
+				}
+				targets[dg.GetAddress()] = target
+			}
+			if target.err != nil {
+				c.Debugf("resolve udp address %v error: %v", dg.GetAddress(), target.err)
+				continue
+			}
+			addr := target.addr
+			if err = c.policy.WaitUp(c.ctx, len(dg.GetData())); err != nil {
+				return
+			}
+			if _, err = pc.WriteTo(dg.GetData(), addr); err != nil {
+				c.Debugf("write datagram to %v error: %v", addr, err)
+			}
+		}
+	}()
+
+	// target -> tunnel
+	defer conn.Close()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				c.Errorf("read udp error: %v", err)
+			}
+			return
+		}
+		if err = c.policy.WaitDown(c.ctx, n); err != nil {
+			return
+		}
+		if err = proto.WriteDatagram(conn, &proto.Datagram{Address: from.String(), Data: buf[:n]}); err != nil {
+			c.Errorf("write datagram to tunnel error: %v", err)
+			_ = pc.Close()
+			return
+		}
+	}
+}
+
+// resolveUdp resolve the first address of target allowed by acl
+func (c *Connection) resolveUdp(address string) (addr *net.UDPAddr, err error) {
+	ctx, cancel := context.WithTimeout(c.ctx, dialTimeout)
+	defer cancel()
+
+	addrs, err := c.resolve(ctx, address)
+	if err != nil {
+		return
+	}
+	return net.ResolveUDPAddr("udp", addrs[0])
+}
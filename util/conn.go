@@ -4,6 +4,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 )
 
 func CopyLoopWait(c1 net.Conn, c2 net.Conn) {
@@ -21,3 +22,30 @@ func CopyLoopWait(c1 net.Conn, c2 net.Conn) {
 	go cp(c2, c1)
 	wg.Wait()
 }
+
+// AnyPeer return true if ip of address is unspecified, which means any peer can connect to socks BIND
+func AnyPeer(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address == ""
+	}
+	ip := net.ParseIP(host)
+	return host == "" || ip != nil && ip.IsUnspecified()
+}
+
+// AcceptPeer accept the first connection from allowed ips until timeout, any peer if allowed is nil.
+// connections from other ips are closed after passed to refused
+func AcceptPeer(lis *net.TCPListener, allowed map[string]bool, timeout time.Duration, refused func(addr net.Addr)) (peer net.Conn, err error) {
+	_ = lis.SetDeadline(time.Now().Add(timeout))
+	for {
+		if peer, err = lis.Accept(); err != nil {
+			return
+		}
+		host, _, _ := net.SplitHostPort(peer.RemoteAddr().String())
+		if allowed == nil || allowed[net.ParseIP(host).String()] {
+			return
+		}
+		refused(peer.RemoteAddr())
+		_ = peer.Close()
+	}
+}
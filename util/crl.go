@@ -0,0 +1,94 @@
+package util
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"through/log"
+	"time"
+)
+
+// CRL revoked certificates loaded from a pem or der file, it can be reloaded when file change
+type CRL struct {
+	file    string
+	caFile  string // issuer candidates to verify signature, skip verification if empty
+	revoked atomic.Pointer[map[string]struct{}]
+}
+
+// LoadCRL load crl file, its signature is verified by certificates in caFile if set
+func LoadCRL(file, caFile string) (c *CRL, err error) {
+	c = &CRL{file: file, caFile: caFile}
+	if err = c.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload read crl and ca file again, the old list is kept on error
+func (c *CRL) Reload() (err error) {
+	var cas []*x509.Certificate
+	if c.caFile != "" {
+		if cas, err = LoadCertificates(c.caFile); err != nil {
+			return
+		}
+	}
+	data, err := os.ReadFile(c.file)
+	if err != nil {
+		return
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("parse crl %v: %w", c.file, err)
+	}
+
+	if len(cas) > 0 {
+		verified := false
+		for _, ca := range cas {
+			if list.CheckSignatureFrom(ca) == nil {
+				verified = true
+				break
+			}
+		}
+		if !verified {
+			return fmt.Errorf("crl %v is not signed by ca", c.file)
+		}
+	}
+	if !list.NextUpdate.IsZero() && list.NextUpdate.Before(time.Now()) {
+		log.Warnf("crl %v is outdated since %v", c.file, list.NextUpdate)
+	}
+
+	revoked := make(map[string]struct{}, len(list.RevokedCertificateEntries))
+	for _, r := range list.RevokedCertificateEntries {
+		revoked[r.SerialNumber.String()] = struct{}{}
+	}
+	c.revoked.Store(&revoked)
+	log.Infof("load crl %v, %d certificates revoked", c.file, len(revoked))
+	return
+}
+
+// Revoked return true if cert is in the list
+func (c *CRL) Revoked(cert *x509.Certificate) bool {
+	_, ok := (*c.revoked.Load())[cert.SerialNumber.String()]
+	return ok
+}
+
+// Watch reload crl when crl or ca file change until ctx is done
+func (c *CRL) Watch(ctx context.Context, interval time.Duration) {
+	files := []string{c.file}
+	if c.caFile != "" {
+		files = append(files, c.caFile)
+	}
+	WatchFiles(ctx, interval, files, func() error {
+		err := c.Reload()
+		if err != nil {
+			log.Errorf("reload crl error, keep the old one: %v", err)
+		}
+		return err
+	})
+}
@@ -3,8 +3,11 @@ package util
 import (
 	"bytes"
 	_ "embed"
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync/atomic"
 
 	"github.com/oschwald/geoip2-golang"
 	"github.com/xi2/xz"
@@ -15,6 +18,9 @@ var dbBytes []byte
 
 var db *geoip2.Reader
 
+// asnDB optional asn database loaded by LoadASN
+var asnDB atomic.Pointer[geoip2.Reader]
+
 func init() {
 	r, err := xz.NewReader(bytes.NewReader(dbBytes), 0)
 	if err != nil {
@@ -37,3 +43,42 @@ func Country(ip net.IP) string {
 	}
 	return ""
 }
+
+// LoadASN load a GeoLite2-ASN database, it's used after SetASN
+func LoadASN(file string) (r *geoip2.Reader, err error) {
+	// read into memory instead of mmap, so the old one need not be closed
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	if r, err = geoip2.FromBytes(data); err != nil {
+		return
+	}
+	if r.Metadata().DatabaseType != "GeoLite2-ASN" && r.Metadata().DatabaseType != "GeoIP2-ISP" {
+		return nil, fmt.Errorf("%v is %v, not an asn database", file, r.Metadata().DatabaseType)
+	}
+	return
+}
+
+// SetASN replace the asn database loaded before
+func SetASN(r *geoip2.Reader) {
+	asnDB.Store(r)
+}
+
+// HasASN return true if asn database is loaded
+func HasASN() bool {
+	return asnDB.Load() != nil
+}
+
+// ASN return the autonomous system number of ip, 0 if unknown
+func ASN(ip net.IP) uint {
+	r := asnDB.Load()
+	if r == nil || ip == nil {
+		return 0
+	}
+	a, _ := r.ASN(ip)
+	if a != nil {
+		return a.AutonomousSystemNumber
+	}
+	return 0
+}
@@ -1,8 +1,14 @@
 package util
 
 import (
+	"bytes"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/xi2/xz"
 )
 
 func TestCountry(t *testing.T) {
@@ -13,3 +19,28 @@ func TestCountry(t *testing.T) {
 	}
 	t.Logf("%s -> %s", ip, Country(i))
 }
+
+func TestLoadASN(t *testing.T) {
+	r, err := xz.NewReader(bytes.NewReader(dbBytes), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "Country.mmdb")
+	if err = os.WriteFile(file, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rejected database never replace the one in use
+	for _, f := range []string{file, filepath.Join(t.TempDir(), "missing.mmdb")} {
+		if _, err = LoadASN(f); err == nil {
+			t.Errorf("LoadASN(%v) want error", f)
+		}
+	}
+	if HasASN() {
+		t.Error("HasASN() = true without SetASN")
+	}
+}
@@ -0,0 +1,25 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParsePortRange parse "443" or "8000-9000"
+func ParsePortRange(s string) (pr [2]int, err error) {
+	start, end, found := strings.Cut(strings.TrimSpace(s), "-")
+	if pr[0], err = strconv.Atoi(strings.TrimSpace(start)); err != nil {
+		return pr, fmt.Errorf("port range %q format error", s)
+	}
+	pr[1] = pr[0]
+	if found {
+		if pr[1], err = strconv.Atoi(strings.TrimSpace(end)); err != nil {
+			return pr, fmt.Errorf("port range %q format error", s)
+		}
+	}
+	if pr[0] < 0 || pr[1] > 65535 || pr[0] > pr[1] {
+		return pr, fmt.Errorf("port range %q out of range", s)
+	}
+	return
+}
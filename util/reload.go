@@ -0,0 +1,100 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sync/atomic"
+	"through/log"
+	"time"
+)
+
+// WatchInterval how often certificate files are checked
+var WatchInterval = 10 * time.Second
+
+// KeyPair certificate and private key which can be reloaded when files change
+type KeyPair struct {
+	crtFile string
+	keyFile string
+	cert    atomic.Pointer[tls.Certificate]
+}
+
+func LoadKeyPair(crtFile, keyFile string) (k *KeyPair, err error) {
+	k = &KeyPair{crtFile: crtFile, keyFile: keyFile}
+	if err = k.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload read files again, the old certificate is kept on error
+func (k *KeyPair) Reload() (err error) {
+	cert, err := tls.LoadX509KeyPair(k.crtFile, k.keyFile)
+	if err != nil {
+		return
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return
+	}
+	k.cert.Store(&cert)
+	return
+}
+
+// Get return the current certificate
+func (k *KeyPair) Get() *tls.Certificate {
+	return k.cert.Load()
+}
+
+// Watch reload when files change until ctx is done
+func (k *KeyPair) Watch(ctx context.Context, interval time.Duration) {
+	WatchFiles(ctx, interval, []string{k.crtFile, k.keyFile}, func() error {
+		if err := k.Reload(); err != nil {
+			log.Errorf("reload certificate %v error, keep the old one: %v", k.crtFile, err)
+			return err
+		}
+		leaf := k.Get().Leaf
+		log.Infof("reload certificate %v, serial %x, not after %v", k.crtFile, leaf.SerialNumber, leaf.NotAfter)
+		return nil
+	})
+}
+
+// CertPool ca certificates which can be reloaded when file change
+type CertPool struct {
+	file string
+	pool atomic.Pointer[x509.CertPool]
+}
+
+func LoadReloadableCertPool(file string) (p *CertPool, err error) {
+	p = &CertPool{file: file}
+	if err = p.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload read file again, the old pool is kept on error
+func (p *CertPool) Reload() (err error) {
+	pool, err := LoadCertPool(p.file)
+	if err != nil {
+		return
+	}
+	p.pool.Store(pool)
+	return
+}
+
+// Get return the current pool
+func (p *CertPool) Get() *x509.CertPool {
+	return p.pool.Load()
+}
+
+// Watch reload when file change until ctx is done
+func (p *CertPool) Watch(ctx context.Context, interval time.Duration) {
+	WatchFiles(ctx, interval, []string{p.file}, func() error {
+		if err := p.Reload(); err != nil {
+			log.Errorf("reload ca %v error, keep the old one: %v", p.file, err)
+			return err
+		}
+		log.Infof("reload ca %v", p.file)
+		return nil
+	})
+}
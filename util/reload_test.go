@@ -0,0 +1,172 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeyPair_Watch(t *testing.T) {
+	ca := newTestCert(t, "ca", 1, nil, true)
+	old := newTestCert(t, "server.test", 10, ca, false)
+	rotated := newTestCert(t, "server.test", 11, ca, false)
+	dir := t.TempDir()
+	crtFile, keyFile := writeKeyPair(t, dir, old)
+
+	kp, err := LoadKeyPair(crtFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go kp.Watch(ctx, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	// only certificate is written, key doesn't match, the old pair is kept
+	if err = os.WriteFile(crtFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rotated.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := kp.Get().Leaf.SerialNumber.Int64(); got != 10 {
+		t.Fatalf("serial = %v after partial write, want 10", got)
+	}
+
+	writeKeyPair(t, dir, rotated)
+	if !waitFor(t, func() bool { return kp.Get().Leaf.SerialNumber.Int64() == 11 }) {
+		t.Error("certificate is not reloaded")
+	}
+}
+
+func TestLoadServerTlsConfig_Reload(t *testing.T) {
+	ca := newTestCert(t, "ca", 1, nil, true)
+	newCA := newTestCert(t, "new ca", 2, nil, true)
+	server := newTestCert(t, "server.test", 10, ca, false)
+	client := newTestCert(t, "client", 11, ca, false)
+	newClient := newTestCert(t, "client", 12, newCA, false)
+
+	dir := t.TempDir()
+	crtFile, keyFile := writeKeyPair(t, dir, server)
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	interval := WatchInterval
+	WatchInterval = 10 * time.Millisecond
+	defer func() { WatchInterval = interval }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg, err := LoadServerTlsConfig(ctx, keyFile, crtFile, caFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	addr := serveTls(t, cfg, func(conn *tls.Conn) {
+		errc <- conn.Handshake()
+	})
+	dial := func(c *testCert) error {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{c.tlsCert()}})
+		if err == nil {
+			_ = conn.Close()
+		}
+		return <-errc
+	}
+
+	if err = dial(client); err != nil {
+		t.Fatalf("handshake with client of ca: %v", err)
+	}
+	if err = dial(newClient); err == nil {
+		t.Fatal("handshake with client of unknown ca want error")
+	}
+
+	// rotate ca, the new client is accepted without rebuilding config
+	time.Sleep(20 * time.Millisecond)
+	if err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newCA.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(t, func() bool { return dial(newClient) == nil }) {
+		t.Error("ca is not reloaded")
+	}
+	if err = dial(client); err == nil {
+		t.Error("handshake with client of old ca want error")
+	}
+}
+
+func TestLoadServerTlsConfig_ResumeRevoked(t *testing.T) {
+	ca := newTestCert(t, "ca", 1, nil, true)
+	server := newTestCert(t, "server.test", 10, ca, false)
+	client := newTestCert(t, "client", 11, ca, false)
+
+	dir := t.TempDir()
+	crtFile, keyFile := writeKeyPair(t, dir, server)
+	caFile := writePem(t, "CERTIFICATE", ca.cert.Raw)
+	createCRL := func(serials ...int64) []byte {
+		list := &x509.RevocationList{Number: big.NewInt(time.Now().UnixNano()), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+		for _, s := range serials {
+			list.RevokedCertificateEntries = append(list.RevokedCertificateEntries, x509.RevocationListEntry{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, list, ca.cert, ca.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	}
+	crlFile := filepath.Join(dir, "crl.pem")
+	if err := os.WriteFile(crlFile, createCRL(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	crl, err := LoadCRL(crlFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg, err := LoadServerTlsConfig(ctx, keyFile, crtFile, caFile, crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTls(t, cfg, func(conn *tls.Conn) {
+		if conn.Handshake() == nil {
+			// the session ticket is sent after handshake in tls 1.3
+			_, _ = conn.Write([]byte{1})
+		}
+	})
+
+	clientCfg := &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{client.tlsCert()}, ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+	dial := func() (resumed bool, err error) {
+		conn, err := tls.Dial("tcp", addr, clientCfg)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// client certificate is refused after client handshake in tls 1.3, it's found on read
+		if _, err = conn.Read(make([]byte, 1)); err != nil {
+			return
+		}
+		return conn.ConnectionState().DidResume, nil
+	}
+	if _, err = dial(); err != nil {
+		t.Fatal(err)
+	}
+	if resumed, err := dial(); err != nil || !resumed {
+		t.Fatalf("second dial resumed = %v, err = %v, want resumed", resumed, err)
+	}
+
+	if err = os.WriteFile(crlFile, createCRL(11), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = crl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dial(); err == nil {
+		t.Error("revoked client resume session want error")
+	}
+}
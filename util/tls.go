@@ -1,36 +1,245 @@
 package util
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"strings"
 )
 
-// LoadTlsConfig load tls config with private_key ,cert and ca
-func LoadTlsConfig(priKeyFile, crtFile, caFile string, insecure bool) (cfg *tls.Config, err error) {
-	cert, err := tls.LoadX509KeyPair(crtFile, priKeyFile)
+// LoadServerTlsConfig load server tls config which require client certificate signed by ca,
+// certificate revoked by crl is refused, crl can be nil.
+// certificate and ca are reloaded when files change until ctx is done, established connections are kept
+func LoadServerTlsConfig(ctx context.Context, priKeyFile, crtFile, caFile string, crl *CRL) (cfg *tls.Config, err error) {
+	keyPair, err := LoadKeyPair(crtFile, priKeyFile)
 	if err != nil {
 		return nil, err
 	}
+	go keyPair.Watch(ctx, WatchInterval)
+
+	var clientCAs *CertPool
+	if len(caFile) != 0 {
+		if clientCAs, err = LoadReloadableCertPool(caFile); err != nil {
+			return nil, err
+		}
+		go clientCAs.Watch(ctx, WatchInterval)
+	}
+
 	cfg = &tls.Config{
-		ClientAuth:         tls.RequireAndVerifyClientCert,
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: insecure,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return keyPair.Get(), nil
+		},
+		// client certificate is verified by ourself against the current ca.
+		// VerifyConnection is called on resumed sessions too, so revoked clients can't resume
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			var roots *x509.CertPool
+			if clientCAs != nil {
+				roots = clientCAs.Get()
+			}
+			return verifyClient(cs.PeerCertificates, roots, crl)
+		},
 	}
+	return cfg, nil
+}
 
-	if len(caFile) != 0 {
-		ca := x509.NewCertPool()
-		caBytes, err := os.ReadFile(caFile)
+// verifyClient verify client certificate chain like tls.RequireAndVerifyClientCert, then check crl
+func verifyClient(certs []*x509.Certificate, roots *x509.CertPool, crl *CRL) (err error) {
+	if len(certs) == 0 {
+		return errors.New("client present no certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err = certs[0].Verify(opts); err != nil {
+		return fmt.Errorf("verify client certificate: %w", err)
+	}
+
+	if crl != nil && crl.Revoked(certs[0]) {
+		return fmt.Errorf("certificate %x of %v is revoked", certs[0].SerialNumber, certs[0].Subject.CommonName)
+	}
+	return nil
+}
+
+// LoadClientTlsConfig load client certificate, server verification is set by WithServerVerify.
+// certificate is reloaded when files change until ctx is done
+func LoadClientTlsConfig(ctx context.Context, priKeyFile, crtFile string) (cfg *tls.Config, err error) {
+	keyPair, err := LoadKeyPair(crtFile, priKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	go keyPair.Watch(ctx, WatchInterval)
+
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return keyPair.Get(), nil
+		},
+	}, nil
+}
+
+// ServerVerify how client verify the certificate of server
+type ServerVerify struct {
+	CAFile     string   // ca bundle, system roots are used if neither ca nor pins is set
+	Pins       []string // base64 sha256 of server public key, "sha256/" prefix is optional. only the leaf is matched without ca
+	ServerName string   // name to verify, default is host of server address
+	Insecure   bool     // skip verification
+}
+
+// WithServerVerify clone cfg and verify server at addr by v, ca is reloaded when file change until ctx is done
+func WithServerVerify(ctx context.Context, cfg *tls.Config, addr string, v ServerVerify) (c *tls.Config, err error) {
+	c = cfg.Clone()
+	if v.Insecure {
+		c.InsecureSkipVerify = true
+		return
+	}
+
+	serverName := v.ServerName
+	if serverName == "" {
+		if serverName, _, err = net.SplitHostPort(addr); err != nil {
+			return nil, err
+		}
+	}
+	if net.ParseIP(serverName) == nil {
+		c.ServerName = serverName
+	}
+
+	var pins [][]byte
+	for _, p := range v.Pins {
+		p = strings.TrimLeft(strings.TrimPrefix(p, "sha256/"), "/")
+		pin, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("pin %q of %v is not base64 sha256", p, addr)
+		}
+		pins = append(pins, pin)
+	}
+
+	// pinned key is trusted without ca, unless ca is set too
+	var roots *CertPool
+	usePKI := v.CAFile != "" || len(pins) == 0
+	if v.CAFile != "" {
+		if roots, err = LoadReloadableCertPool(v.CAFile); err != nil {
+			return nil, err
+		}
+		go roots.Watch(ctx, WatchInterval)
+	}
+
+	// verification is done by ourself, because pin can't be checked by the standard one
+	c.InsecureSkipVerify = true
+	c.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs, err := parseCertificates(rawCerts)
 		if err != nil {
-			return nil, fmt.Errorf("load ca err: %v", err)
+			return err
 		}
-		if ok := ca.AppendCertsFromPEM(caBytes); !ok {
-			return nil, fmt.Errorf("failed to parse ca %q", caFile)
+		if len(certs) == 0 {
+			return errors.New("server present no certificate")
 		}
 
-		cfg.ClientCAs = ca
+		// without ca only the leaf, whose key signed the handshake, can match pins,
+		// other certificates presented are not verified and can be anything
+		chains := [][]*x509.Certificate{certs[:1]}
+		if usePKI {
+			opts := x509.VerifyOptions{DNSName: serverName, Intermediates: x509.NewCertPool()}
+			if roots != nil {
+				opts.Roots = roots.Get()
+			}
+			for _, cert := range certs[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			if chains, err = certs[0].Verify(opts); err != nil {
+				return fmt.Errorf("verify server %v: %w", addr, err)
+			}
+		}
+
+		if len(pins) > 0 && !matchPins(chains, pins) {
+			return fmt.Errorf("verify server %v: public key not match pins", addr)
+		}
+		return nil
 	}
+	return
+}
 
-	return cfg, nil
+func parseCertificates(rawCerts [][]byte) (certs []*x509.Certificate, err error) {
+	certs = make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return
+}
+
+// matchPins return true if any certificate in chains has a pinned public key
+func matchPins(chains [][]*x509.Certificate, pins [][]byte) bool {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := SPKIHash(cert)
+			for _, pin := range pins {
+				if bytes.Equal(sum, pin) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// SPKIHash return sha256 of the subject public key info of cert
+func SPKIHash(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// LoadCertPool load pem certificates in file
+func LoadCertPool(file string) (pool *x509.CertPool, err error) {
+	certs, err := LoadCertificates(file)
+	if err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return
+}
+
+// LoadCertificates parse all pem certificates in file
+func LoadCertificates(file string) (certs []*x509.Certificate, err error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("load ca err: %v", err)
+	}
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ca %q: %v", file, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("failed to parse ca %q", file)
+	}
+	return
 }
@@ -0,0 +1,162 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"through/config"
+	"through/log"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	config.Common = &config.CommonCfg{
+		Env:     "dev",
+		LogFile: "",
+	}
+	if err := log.Init(); err != nil {
+		panic(err)
+	}
+	m.Run()
+}
+
+func TestWithServerVerify(t *testing.T) {
+	ca := newTestCert(t, "ca", 1, nil, true)
+	otherCA := newTestCert(t, "other", 2, nil, true)
+	server := newTestCert(t, "server.test", 3, ca, false)
+	caFile := writePem(t, "CERTIFICATE", ca.cert.Raw)
+	otherFile := writePem(t, "CERTIFICATE", otherCA.cert.Raw)
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(SPKIHash(server.cert))
+	otherPin := base64.StdEncoding.EncodeToString(SPKIHash(otherCA.cert))
+	caPin := base64.StdEncoding.EncodeToString(SPKIHash(ca.cert))
+
+	tests := []struct {
+		name    string
+		verify  ServerVerify
+		wantErr bool
+	}{
+		{"ca", ServerVerify{CAFile: caFile, ServerName: "server.test"}, false},
+		{"ca with ip", ServerVerify{CAFile: caFile}, false},
+		{"wrong ca", ServerVerify{CAFile: otherFile, ServerName: "server.test"}, true},
+		{"wrong name", ServerVerify{CAFile: caFile, ServerName: "evil.test"}, true},
+		{"pin", ServerVerify{Pins: []string{pin}}, false},
+		{"wrong pin", ServerVerify{Pins: []string{otherPin}}, true},
+		{"ca and wrong pin", ServerVerify{CAFile: caFile, Pins: []string{otherPin}}, true},
+		{"ca and pinned ca", ServerVerify{CAFile: caFile, Pins: []string{caPin}}, false},
+		{"pinned ca without ca", ServerVerify{Pins: []string{caPin}}, true},
+		{"system roots", ServerVerify{}, true},
+		{"insecure", ServerVerify{Insecure: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := WithServerVerify(context.Background(), &tls.Config{}, "127.0.0.1:443", tt.verify)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = handshake(t, server.tlsCert(), cfg); (err != nil) != tt.wantErr {
+				t.Errorf("handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// the pinned certificate appended after an attacker's leaf don't pass
+	evil := newTestCert(t, "server.test", 4, nil, false)
+	mitm := tls.Certificate{Certificate: [][]byte{evil.cert.Raw, server.cert.Raw, ca.cert.Raw}, PrivateKey: evil.key}
+	for _, v := range []ServerVerify{{Pins: []string{pin}}, {Pins: []string{caPin}}, {CAFile: caFile, Pins: []string{pin}}} {
+		cfg, err := WithServerVerify(context.Background(), &tls.Config{}, "127.0.0.1:443", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = handshake(t, mitm, cfg); err == nil {
+			t.Errorf("handshake with %v want error for leaf not pinned", v.Pins)
+		}
+	}
+
+	if _, err := WithServerVerify(context.Background(), &tls.Config{}, "127.0.0.1:443", ServerVerify{Pins: []string{"bad"}}); err == nil {
+		t.Error("WithServerVerify() want error for bad pin")
+	}
+}
+
+func TestCRL(t *testing.T) {
+	ca := newTestCert(t, "ca", 1, nil, true)
+	good := newTestCert(t, "good", 10, ca, false)
+	lost := newTestCert(t, "lost", 11, ca, false)
+	caFile := writePem(t, "CERTIFICATE", ca.cert.Raw)
+
+	createCRL := func(serials ...int64) []byte {
+		list := &x509.RevocationList{Number: big.NewInt(time.Now().UnixNano()), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+		for _, s := range serials {
+			list.RevokedCertificateEntries = append(list.RevokedCertificateEntries, x509.RevocationListEntry{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, list, ca.cert, ca.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	}
+
+	crlFile := filepath.Join(t.TempDir(), "crl.pem")
+	if err := os.WriteFile(crlFile, createCRL(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	crl, err := LoadCRL(crlFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crl.Revoked(lost.cert) {
+		t.Error("Revoked() = true before revoke")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go crl.Watch(ctx, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if err = os.WriteFile(crlFile, createCRL(11), 0600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !crl.Revoked(lost.cert) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !crl.Revoked(lost.cert) {
+		t.Error("Revoked() = false after reload")
+	}
+	if crl.Revoked(good.cert) {
+		t.Error("Revoked() = true for good certificate")
+	}
+
+	// ca rotated with the crl signed by it
+	newCA := newTestCert(t, "new ca", 3, nil, true)
+	newList := &x509.RevocationList{Number: big.NewInt(time.Now().UnixNano()), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: big.NewInt(10), RevocationTime: time.Now()}}}
+	der, err := x509.CreateRevocationList(rand.Reader, newList, newCA.cert, newCA.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newCA.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for !crl.Revoked(good.cert) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !crl.Revoked(good.cert) {
+		t.Error("crl signed by rotated ca is not reloaded")
+	}
+
+	// crl not signed by ca is refused, the old list is kept
+	other := newTestCert(t, "other", 2, nil, true)
+	if _, err = LoadCRL(crlFile, writePem(t, "CERTIFICATE", other.cert.Raw)); err == nil {
+		t.Error("LoadCRL() want error for crl signed by other ca")
+	}
+}
@@ -0,0 +1,48 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// WatchFiles poll files every interval and call onChange when any of them is modified,
+// onChange is called again on next poll if it return error, e.g. only one of key pair is written.
+// it returns when ctx is done
+func WatchFiles(ctx context.Context, interval time.Duration, files []string, onChange func() error) {
+	stat := func() (sum []string) {
+		for _, f := range files {
+			info, err := os.Stat(f)
+			if err != nil {
+				sum = append(sum, "")
+				continue
+			}
+			sum = append(sum, fmt.Sprintf("%v/%d", info.ModTime(), info.Size()))
+		}
+		return
+	}
+
+	last := stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cur := stat()
+		for i := range cur {
+			if cur[i] != last[i] {
+				if onChange() != nil {
+					// keep last, so it's retried
+					cur = last
+				}
+				break
+			}
+		}
+		last = cur
+	}
+}